@@ -86,6 +86,13 @@ func adminGroupDoEdit(w http.ResponseWriter, r *http.Request) {
 		atoi(r.FormValue("upload_per_month")),
 		atoi(r.FormValue("total_uploads")),
 		atoi(r.FormValue("max_retention_seconds")),
+		atoi(r.FormValue("max_storage_bytes")),
+		atoi(r.FormValue("max_width")),
+		atoi(r.FormValue("max_height")),
+		atoi(r.FormValue("max_pixels")),
+		r.FormValue("oversized_images") == "downscale",
+		r.FormValue("metadata_policy"),
+		r.FormValue("watermark") != "",
 	)
 
 	if err != nil {
@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"fmt"
 	"imgu2/controllers/middleware"
 	"imgu2/db"
 	"imgu2/services"
@@ -8,6 +9,9 @@ import (
 	"math"
 	"net/http"
 	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
 )
 
 func adminImages(w http.ResponseWriter, r *http.Request) {
@@ -27,7 +31,41 @@ func adminImages(w http.ResponseWriter, r *http.Request) {
 		uploader = -1
 	}
 
-	if uploader < 0 { // filter is not set
+	// Hamming distances of images similar to the image in the filter
+	distances := make(map[int]int)
+
+	similar := r.URL.Query().Get("similar")
+
+	if similar != "" {
+		img, err := services.Image.FindByFileName(similar)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			slog.Error("admin images", "err", err)
+			return
+		}
+
+		if img == nil {
+			w.WriteHeader(http.StatusNotFound)
+			renderDialog(w, tr("error"), "Image not found", "/admin/images", tr("go_back"))
+			return
+		}
+
+		similarImages, err := services.PerceptualHash.FindSimilar(img)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			slog.Error("admin images", "err", err)
+			return
+		}
+
+		images = []db.Image{*img}
+		for _, v := range similarImages {
+			images = append(images, v.Image)
+			distances[v.Id] = v.Distance
+		}
+
+		// all similar images are shown on a single page
+		page, imageCount = 0, 0
+	} else if uploader < 0 { // filter is not set
 		images, err = services.Image.FindAll(page)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -64,6 +102,8 @@ func adminImages(w http.ResponseWriter, r *http.Request) {
 		"page":            page,
 		"total_page":      int(math.Ceil(float64(imageCount) / 20)),
 		"filter_uploader": uploader,
+		"filter_similar":  similar,
+		"distances":       distances,
 	})
 }
 
@@ -97,3 +137,104 @@ func adminImageDelete(w http.ResponseWriter, r *http.Request) {
 
 	renderDialog(w, tr("info"), "Image deleted", "/admin/images", tr("go_back"))
 }
+
+// block the perceptual hash of an image, so that similar images can not be
+// uploaded
+func adminImageBlock(w http.ResponseWriter, r *http.Request) {
+	fileName := r.FormValue("file_name")
+	if fileName == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	img, err := services.Image.FindByFileName(fileName)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("admin image block", "err", err)
+		return
+	}
+
+	if img == nil {
+		w.WriteHeader(http.StatusNotFound)
+		renderDialog(w, tr("error"), "Image not found", "", "")
+		return
+	}
+
+	ok, err := services.PerceptualHash.Block(img)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("admin image block", "err", err)
+		return
+	}
+
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		renderDialog(w, tr("error"), "The perceptual hash of the image has not been computed yet", "/admin/images", tr("go_back"))
+		return
+	}
+
+	renderDialog(w, tr("info"), "Image blocked", "/admin/images/blocklist", tr("go_back"))
+}
+
+func adminBlocklist(w http.ResponseWriter, r *http.Request) {
+	user := middleware.MustGetUser(r.Context())
+
+	hashes, err := services.PerceptualHash.Blocklist()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("admin blocklist", "err", err)
+		return
+	}
+
+	blocked := make([]H, 0, len(hashes))
+	for _, v := range hashes {
+		blocked = append(blocked, H{
+			"id":   v.Id,
+			"hash": fmt.Sprintf("%016x", uint64(v.Hash)),
+			"note": v.Note,
+			"time": v.Time,
+		})
+	}
+
+	render(w, "admin_blocklist", H{
+		"csrf_token": csrfToken(w),
+		"user":       user,
+		"blocked":    blocked,
+	})
+}
+
+// block a perceptual hash in hex
+func adminBlocklistAdd(w http.ResponseWriter, r *http.Request) {
+	hash, err := strconv.ParseUint(strings.TrimSpace(r.FormValue("hash")), 16, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		renderDialog(w, tr("error"), "Invalid perceptual hash", "/admin/images/blocklist", tr("go_back"))
+		return
+	}
+
+	err = services.PerceptualHash.BlockHash(int64(hash), r.FormValue("note"))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("admin blocklist add", "err", err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/images/blocklist", http.StatusFound)
+}
+
+func adminBlocklistDelete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = services.PerceptualHash.Unblock(id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("admin blocklist delete", "err", err)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/images/blocklist", http.StatusFound)
+}
@@ -1,10 +1,14 @@
 package controllers
 
 import (
+	"errors"
 	"imgu2/controllers/middleware"
+	"imgu2/libvips"
 	"imgu2/services"
+	"io"
 	"log/slog"
 	"net/http"
+	"strings"
 )
 
 func adminSettings(w http.ResponseWriter, r *http.Request) {
@@ -29,6 +33,7 @@ func adminSettings(w http.ResponseWriter, r *http.Request) {
 		"setting":     m,
 		"csrf_token":  csrfToken(w),
 		"user_groups": groups,
+		"input_types": strings.Join(libvips.LibvipsInputTypes(), ", "),
 	})
 }
 
@@ -52,3 +57,64 @@ func doAdminSettings(w http.ResponseWriter, r *http.Request) {
 
 	renderDialog(w, tr("info"), "Settings updated", "/admin/settings", tr("continue"))
 }
+
+// the maximum size of the watermark image in bytes
+const watermarkMaxSize = 1024 * 1024
+
+// serve the png image of the watermark
+func adminWatermarkImage(w http.ResponseWriter, r *http.Request) {
+	b, err := services.Setting.GetWatermarkImage()
+	if err != nil {
+		slog.Error("admin watermark image", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if b == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(b)
+}
+
+// upload the png image of the watermark
+func adminUploadWatermark(w http.ResponseWriter, r *http.Request) {
+	f, fh, err := r.FormFile("file")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		renderDialog(w, tr("error"), tr("error_invalid_watermark"), "/admin/settings", tr("go_back"))
+		return
+	}
+	defer f.Close()
+
+	if fh.Size > watermarkMaxSize {
+		w.WriteHeader(http.StatusBadRequest)
+		renderDialog(w, tr("error"), tr("error_invalid_watermark"), "/admin/settings", tr("go_back"))
+		return
+	}
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = services.Setting.SetWatermarkImage(b)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidWatermark) {
+			w.WriteHeader(http.StatusBadRequest)
+			renderDialog(w, tr("error"), tr("error_invalid_watermark"), "/admin/settings", tr("go_back"))
+			return
+		}
+
+		slog.Error("admin upload watermark", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		renderDialog(w, tr("error"), tr("unknown_error"), "/admin/settings", tr("go_back"))
+		return
+	}
+
+	http.Redirect(w, r, "/admin/settings#watermark", http.StatusFound)
+}
@@ -0,0 +1,402 @@
+package controllers
+
+import (
+	"imgu2/controllers/middleware"
+	"imgu2/db"
+	"imgu2/services"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// upload an image using an api token
+//
+// the form parameters are the same as POST /upload
+func apiUpload(w http.ResponseWriter, r *http.Request) {
+	user := middleware.MustGetUser(r.Context())
+
+	if isBatchUpload(r) {
+		results, ok := handleBatchUpload(w, r, user)
+		if !ok {
+			return
+		}
+
+		writeJSON(w, H{
+			"files": results,
+		})
+		return
+	}
+
+	result, ok := handleFormUpload(w, r, user)
+	if !ok {
+		return
+	}
+
+	siteUrl, err := services.Setting.GetSiteURL()
+	if err != nil {
+		slog.Error("api upload", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, result.json(siteUrl))
+}
+
+// list images uploaded by the owner of the api token
+func apiImages(w http.ResponseWriter, r *http.Request) {
+	user := middleware.MustGetUser(r.Context())
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 0 {
+		page = 0
+	}
+
+	imageCount, err := services.Image.CountByUser(user.Id)
+	if err != nil {
+		slog.Error("api images", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	images, err := services.Image.FindByUser(user.Id, page)
+	if err != nil {
+		slog.Error("api images", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	siteUrl, err := services.Setting.GetSiteURL()
+	if err != nil {
+		slog.Error("api images", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	result := make([]H, 0, len(images))
+	for _, v := range images {
+		expire := int64(0)
+		if v.ExpireTime.Valid {
+			expire = v.ExpireTime.Time.Unix()
+		}
+
+		result = append(result, H{
+			"file_name":      v.FileName,
+			"url":            siteUrl + "/i/" + v.FileName,
+			"preview_url":    siteUrl + "/preview/" + v.FileName,
+			"thumbnail_url":  siteUrl + "/t/" + v.FileName,
+			"uploaded_at":    v.Time.Unix(),
+			"expire":         expire,
+			"width":          v.Width,
+			"height":         v.Height,
+			"frames":         v.Frames,
+			"size":           v.Size,
+			"mime_type":      v.MimeType,
+			"blurhash":       v.BlurHash,
+			"dominant_color": v.DominantColor,
+		})
+	}
+
+	writeJSON(w, H{
+		"images":     result,
+		"page":       page,
+		"total_page": int(math.Ceil(float64(imageCount) / 20)), // page size = 20
+	})
+}
+
+// delete an image owned by the owner of the api token
+func apiDeleteImage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.MustGetUser(r.Context())
+
+	img, ok := findOwnImage(w, r, user)
+	if !ok {
+		return
+	}
+
+	err := services.Image.Delete(img, false)
+	if err != nil {
+		slog.Error("api delete image", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		writeJSON(w, H{
+			"error": "INTERNAL_STORAGE_ERROR",
+		})
+		return
+	}
+
+	writeJSON(w, H{})
+}
+
+// sign transform parameters for an image owned by the owner of the api token
+//
+// the query parameters are the transform parameters of /i/{fileName}
+func apiSignTransform(w http.ResponseWriter, r *http.Request) {
+	user := middleware.MustGetUser(r.Context())
+
+	img, ok := findOwnImage(w, r, user)
+	if !ok {
+		return
+	}
+
+	query, err := services.Transform.Sign(img.FileName, r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, H{
+			"error": "INVALID_TRANSFORM",
+		})
+		return
+	}
+
+	siteUrl, err := services.Setting.GetSiteURL()
+	if err != nil {
+		slog.Error("api sign transform", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, H{
+		"url": siteUrl + "/i/" + img.FileName + "?" + query,
+	})
+}
+
+// edit an image owned by the owner of the api token
+//
+// operations is a JSON list of edit operations, see
+// services.Edit.ParseOperations. The edited image is saved as a new image
+// if save is "new" (the default), which takes the other form parameters of
+// POST /upload, or replaces the image under the same file name if save is
+// "replace".
+func apiEditImage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.MustGetUser(r.Context())
+
+	img, ok := findOwnImage(w, r, user)
+	if !ok {
+		return
+	}
+
+	group, ipAddr, ok := checkUploadPermission(w, r, user)
+	if !ok {
+		return
+	}
+
+	siteUrl, err := services.Setting.GetSiteURL()
+	if err != nil {
+		slog.Error("api edit image", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	switch r.FormValue("save") {
+	case "", "new":
+		opts, ok := parseUploadOptions(w, r.FormValue, group)
+		if !ok {
+			return
+		}
+
+		if len(opts.operations) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, H{
+				"error": "INVALID_EDIT_OPERATIONS",
+			})
+			return
+		}
+
+		b, err := services.Image.Read(img)
+		if err != nil {
+			slog.Error("api edit image", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			writeJSON(w, H{
+				"error": "INTERNAL_STORAGE_ERROR",
+			})
+			return
+		}
+
+		// the stored image is already watermarked
+		g := *group
+		g.Watermark = false
+
+		result, ok := saveUpload(w, user, &g, ipAddr, opts, b, services.Image.MimeType(img), img.OriginalName, "")
+		if !ok {
+			return
+		}
+
+		writeJSON(w, result.json(siteUrl))
+
+	case "replace":
+		ops, err := services.Edit.ParseOperations(r.FormValue("operations"))
+		if err != nil || len(ops) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, H{
+				"error": "INVALID_EDIT_OPERATIONS",
+			})
+			return
+		}
+
+		cancel, uploadErr := reserveUpload(user, group, ipAddr)
+		if uploadErr != nil {
+			uploadErr.write(w)
+			return
+		}
+
+		err = services.Edit.Replace(img, ops, group.MaxFileSize, group.MaxStorageBytes, services.GroupDimensionLimit(group))
+		if err != nil {
+			cancel()
+			uploadErrorOf(err).write(w)
+			return
+		}
+
+		writeJSON(w, H{
+			"file_name": img.FileName,
+			"url":       siteUrl + "/i/" + img.FileName,
+		})
+
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// find the image in the url owned by the user
+//
+// An error response is written if the image is not found or the user is
+// not the uploader.
+func findOwnImage(w http.ResponseWriter, r *http.Request, user *db.User) (*db.Image, bool) {
+	img, status := lookupOwnImage(user, chi.URLParam(r, "fileName"))
+
+	switch status {
+	case http.StatusOK:
+		return img, true
+	case http.StatusNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		writeJSON(w, H{
+			"error": "IMAGE_NOT_FOUND",
+		})
+	case http.StatusForbidden:
+		w.WriteHeader(http.StatusForbidden)
+		writeJSON(w, H{
+			"error": "PERMISSION_DENIED",
+		})
+	default:
+		w.WriteHeader(status)
+	}
+
+	return nil, false
+}
+
+// list the previous versions of an image owned by the owner of the api
+// token, newest first
+func apiImageVersions(w http.ResponseWriter, r *http.Request) {
+	user := middleware.MustGetUser(r.Context())
+
+	img, ok := findOwnImage(w, r, user)
+	if !ok {
+		return
+	}
+
+	versions, err := services.Image.Versions(img)
+	if err != nil {
+		slog.Error("api image versions", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	result := make([]H, 0, len(versions))
+	for _, v := range versions {
+		result = append(result, H{
+			"id":          v.Id,
+			"version":     v.Version,
+			"replaced_at": v.Time.Unix(),
+			"width":       v.Width,
+			"height":      v.Height,
+			"frames":      v.Frames,
+			"size":        v.Size,
+			"mime_type":   v.MimeType,
+		})
+	}
+
+	writeJSON(w, H{
+		"file_name": img.FileName,
+		"version":   img.Version,
+		"versions":  result,
+	})
+}
+
+// upload a new version of an image owned by the owner of the api token
+//
+// the form parameters are the same as POST /upload, except that the
+// format and the expire time of the image are kept
+func apiUploadVersion(w http.ResponseWriter, r *http.Request) {
+	user := middleware.MustGetUser(r.Context())
+
+	img, ok := findOwnImage(w, r, user)
+	if !ok {
+		return
+	}
+
+	if !handleVersionUpload(w, r, user, img) {
+		return
+	}
+
+	writeVersionResult(w, img.FileName)
+}
+
+// make a previous version the current version of an image owned by the
+// owner of the api token
+func apiRestoreVersion(w http.ResponseWriter, r *http.Request) {
+	user := middleware.MustGetUser(r.Context())
+
+	img, ok := findOwnImage(w, r, user)
+	if !ok {
+		return
+	}
+
+	versionId, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ok, err = services.Image.Restore(img, versionId)
+	if err != nil {
+		slog.Error("api restore version", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		writeJSON(w, H{
+			"error": "INTERNAL_STORAGE_ERROR",
+		})
+		return
+	}
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		writeJSON(w, H{
+			"error": "VERSION_NOT_FOUND",
+		})
+		return
+	}
+
+	writeVersionResult(w, img.FileName)
+}
+
+// write the file name, the url and the current version of a replaced image
+func writeVersionResult(w http.ResponseWriter, fileName string) {
+	img, err := services.Image.FindByFileName(fileName)
+	if err != nil || img == nil {
+		// the image is deleted or expired in the meantime
+		slog.Error("find replaced image", "err", err, "file name", fileName)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	siteUrl, err := services.Setting.GetSiteURL()
+	if err != nil {
+		slog.Error("find replaced image", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, H{
+		"file_name": img.FileName,
+		"url":       siteUrl + "/i/" + img.FileName,
+		"version":   img.Version,
+	})
+}
@@ -0,0 +1,51 @@
+package controllers
+
+import (
+	"imgu2/controllers/middleware"
+	"imgu2/services"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+)
+
+func createAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := middleware.MustGetUser(r.Context())
+
+	name := r.FormValue("name")
+	if name == "" || utf8.RuneCountInString(name) > 30 {
+		w.WriteHeader(http.StatusBadRequest)
+		renderDialog(w, tr("error"), tr("invalid_api_token_name"), "/dashboard/account", tr("go_back"))
+		return
+	}
+
+	token, err := services.APIToken.Create(user.Id, name)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("create api token", "err", err)
+		renderDialog(w, tr("error"), tr("unknown_error"), "/dashboard/account", tr("go_back"))
+		return
+	}
+
+	renderDialog(w, tr("info"), tr("api_token_created")+" "+token, "/dashboard/account", tr("continue"))
+}
+
+func deleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := middleware.MustGetUser(r.Context())
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = services.APIToken.Delete(id, user.Id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("delete api token", "err", err)
+		renderDialog(w, tr("error"), tr("unknown_error"), "/dashboard/account", tr("go_back"))
+		return
+	}
+
+	renderDialog(w, tr("info"), tr("api_token_revoked"), "/dashboard/account", tr("continue"))
+}
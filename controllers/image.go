@@ -1,7 +1,11 @@
 package controllers
 
 import (
+	"bytes"
+	"errors"
 	"imgu2/controllers/middleware"
+	"imgu2/db"
+	"imgu2/libvips"
 	"imgu2/services"
 	"imgu2/services/placeholder"
 	"io"
@@ -10,6 +14,7 @@ import (
 	"net/http"
 	"reflect"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -20,7 +25,12 @@ func downloadImage(w http.ResponseWriter, r *http.Request) {
 
 	fileName := chi.URLParam(r, "fileName")
 
-	c, err := services.Image.Get(fileName)
+	if services.Transform.Requested(r.URL.Query()) {
+		transformImage(w, r, fileName)
+		return
+	}
+
+	c, contentType, etag, vary, err := services.Image.Get(fileName, r.Header.Get("Accept"))
 	if err != nil {
 		slog.Error("download image", "err", err)
 
@@ -31,14 +41,21 @@ func downloadImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if vary {
+		w.Header().Add("Vary", "Accept")
+	}
+
 	switch v := c.(type) {
 	case string:
-		http.Redirect(w, r, v, http.StatusMovedPermanently)
+		// the url changes when the image is replaced
+		w.Header().Add("Cache-Control", imageCacheControl)
+		http.Redirect(w, r, v, http.StatusFound)
 
 	case []byte:
-		w.Header().Add("Content-Type", http.DetectContentType(v))
-		w.Header().Add("Cache-Control", "max-age=31536000")
-		w.Write(v)
+		if contentType == "" {
+			contentType = http.DetectContentType(v)
+		}
+		serveImage(w, r, v, contentType, etag)
 
 	case nil: // not found
 		w.Header().Add("Content-Type", "image/png")
@@ -56,6 +73,143 @@ func downloadImage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// images may be replaced under the same url, so cached copies are only used
+// for a short time before they are revalidated with the entity tag
+const imageCacheControl = "max-age=3600, must-revalidate"
+
+// serveImage writes an image which may be replaced under the same url.
+// Revalidation requests are answered with 304 Not Modified if the entity tag
+// is unchanged.
+func serveImage(w http.ResponseWriter, r *http.Request, content []byte, contentType string, etag string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", imageCacheControl)
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+// serve the thumbnail of an image, or redirect to the image if the
+// thumbnail has not been generated
+func downloadThumbnail(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Header().Add("Access-Control-Allow-Methods", "GET")
+
+	fileName := chi.URLParam(r, "fileName")
+
+	img, err := services.Image.FindByFileName(fileName)
+	if err != nil {
+		slog.Error("download thumbnail", "err", err)
+
+		w.Header().Add("Content-Type", "image/png")
+		w.Header().Add("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(placeholder.ERROR)
+		return
+	}
+
+	if img == nil {
+		w.Header().Add("Content-Type", "image/png")
+		w.Header().Add("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(placeholder.NOT_FOUND)
+		return
+	}
+
+	c, err := services.Thumbnail.Get(img)
+	if err != nil {
+		slog.Error("download thumbnail", "err", err)
+
+		w.Header().Add("Content-Type", "image/png")
+		w.Header().Add("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(placeholder.ERROR)
+		return
+	}
+
+	switch v := c.(type) {
+	case string:
+		// the url changes when the image is replaced
+		w.Header().Add("Cache-Control", imageCacheControl)
+		http.Redirect(w, r, v, http.StatusFound)
+
+	case []byte:
+		serveImage(w, r, v, "image/webp", services.Image.ETag(img, "thumb"))
+
+	case nil: // not generated yet
+		w.Header().Add("Cache-Control", "no-cache")
+		http.Redirect(w, r, "/i/"+img.FileName, http.StatusFound)
+
+	default:
+		slog.Error("download thumbnail: unexpected type", "type", reflect.TypeOf(v))
+
+		w.Header().Add("Content-Type", "image/png")
+		w.Header().Add("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(placeholder.ERROR)
+	}
+}
+
+// serve a transformed image, the parameters are described in services/transform.go
+func transformImage(w http.ResponseWriter, r *http.Request, fileName string) {
+	opts, err := services.Transform.Parse(fileName, r.URL.Query())
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, services.ErrTransformNotAllowed):
+			status = http.StatusForbidden
+		case errors.Is(err, services.ErrInvalidTransform):
+			status = http.StatusBadRequest
+		default:
+			slog.Error("transform image", "err", err)
+		}
+
+		w.Header().Add("Content-Type", "image/png")
+		w.Header().Add("Cache-Control", "no-cache")
+		w.WriteHeader(status)
+		w.Write(placeholder.ERROR)
+		return
+	}
+
+	img, err := services.Image.FindByFileName(fileName)
+	if err != nil {
+		slog.Error("transform image", "err", err)
+
+		w.Header().Add("Content-Type", "image/png")
+		w.Header().Add("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(placeholder.ERROR)
+		return
+	}
+
+	if img == nil {
+		w.Header().Add("Content-Type", "image/png")
+		w.Header().Add("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(placeholder.NOT_FOUND)
+		return
+	}
+
+	content, contentType, etag, err := services.Transform.Apply(img, opts)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, services.ErrInvalidTransform):
+			status = http.StatusBadRequest
+		case errors.Is(err, libvips.ErrBusy):
+			status = http.StatusServiceUnavailable
+		default:
+			slog.Error("transform image", "err", err, "file name", fileName)
+		}
+
+		w.Header().Add("Content-Type", "image/png")
+		w.Header().Add("Cache-Control", "no-cache")
+		w.WriteHeader(status)
+		w.Write(placeholder.ERROR)
+		return
+	}
+
+	serveImage(w, r, content, contentType, etag)
+}
+
 func previewImage(w http.ResponseWriter, r *http.Request) {
 	user := middleware.GetUser(r.Context())
 
@@ -89,6 +243,17 @@ func previewImage(w http.ResponseWriter, r *http.Request) {
 		expire = img.ExpireTime.Time.Unix()
 	}
 
+	// previous versions are only listed to the owner
+	var versions []db.ImageVersion
+	if own {
+		versions, err = services.Image.Versions(img)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			slog.Error("preview image", "err", err)
+			return
+		}
+	}
+
 	render(w, "preview", H{
 		"user":        user,
 		"file_name":   fileName,
@@ -96,10 +261,61 @@ func previewImage(w http.ResponseWriter, r *http.Request) {
 		"uploaded_at": img.Time.Unix(),
 		"expire":      expire,
 		"own":         own,
+		"image":       img,
+		"versions":    versions,
 		"csrf_token":  csrfToken(w),
 	})
 }
 
+// upload a new version of an image owned by the user, the response is the
+// same as POST /api/v1/images/{fileName}/versions
+func uploadVersion(w http.ResponseWriter, r *http.Request) {
+	user := middleware.MustGetUser(r.Context())
+
+	img, ok := findOwnImage(w, r, user)
+	if !ok {
+		return
+	}
+
+	if !handleVersionUpload(w, r, user, img) {
+		return
+	}
+
+	writeVersionResult(w, img.FileName)
+}
+
+// make a previous version the current version of an image owned by the user
+func restoreVersion(w http.ResponseWriter, r *http.Request) {
+	user := middleware.MustGetUser(r.Context())
+
+	img, ok := findOwnImagePage(w, user, chi.URLParam(r, "fileName"), "permission_denied")
+	if !ok {
+		return
+	}
+
+	versionId, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ok, err = services.Image.Restore(img, versionId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		renderDialog(w, tr("error"), tr("unknown_error"), "/preview/"+img.FileName, tr("go_back"))
+		slog.Error("restore version", "err", err)
+		return
+	}
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		renderDialog(w, tr("error"), tr("version_not_found"), "/preview/"+img.FileName, tr("go_back"))
+		return
+	}
+
+	renderDialog(w, tr("info"), tr("version_restored"), "/preview/"+img.FileName, tr("continue"))
+}
+
 func myImages(w http.ResponseWriter, r *http.Request) {
 	user := middleware.MustGetUser(r.Context())
 
@@ -140,34 +356,118 @@ func deleteImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	img, err := services.Image.FindByFileName(fileName)
+	img, ok := findOwnImagePage(w, user, fileName, "no_permission_to_delete")
+	if !ok {
+		return
+	}
+
+	err := services.Image.Delete(img, false)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
+		renderDialog(w, tr("error"), tr("unknown_error"), "/dashboard/images", tr("go_back"))
 		slog.Error("delete image", "err", err)
 		return
 	}
 
+	renderDialog(w, tr("info"), tr("image_deleted"), "/dashboard/images", tr("continue"))
+
+}
+
+// find an image uploaded by the user
+//
+// return http.StatusOK and the image, or the status of the error
+func lookupOwnImage(user *db.User, fileName string) (*db.Image, int) {
+	img, err := services.Image.FindByFileName(fileName)
+	if err != nil {
+		slog.Error("find image", "err", err)
+		return nil, http.StatusInternalServerError
+	}
+
 	if img == nil {
-		w.WriteHeader(http.StatusNotFound)
-		renderDialog(w, tr("error"), tr("image_not_found"), "/dashboard/images", tr("go_back"))
-		return
+		return nil, http.StatusNotFound
 	}
 
 	// image uploaded by guest || the user is not the uploader
 	if !img.Uploader.Valid || img.Uploader.Int32 != int32(user.Id) {
+		return nil, http.StatusForbidden
+	}
+
+	return img, http.StatusOK
+}
+
+// find an image uploaded by the user
+//
+// An error page is written if the image is not found or the user is not the
+// uploader, using the translation key forbidden for the latter.
+func findOwnImagePage(w http.ResponseWriter, user *db.User, fileName string, forbidden string) (*db.Image, bool) {
+	img, status := lookupOwnImage(user, fileName)
+
+	switch status {
+	case http.StatusOK:
+		return img, true
+	case http.StatusNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		renderDialog(w, tr("error"), tr("image_not_found"), "/dashboard/images", tr("go_back"))
+	case http.StatusForbidden:
 		w.WriteHeader(http.StatusForbidden)
-		renderDialog(w, tr("error"), tr("no_permission_to_delete"), "/dashboard/images", tr("go_back"))
-		return
+		renderDialog(w, tr("error"), tr(forbidden), "/dashboard/images", tr("go_back"))
+	default:
+		w.WriteHeader(status)
 	}
 
-	err = services.Image.Delete(img, false)
+	return nil, false
+}
+
+// find the image in a deletion link
+//
+// An error page is written if the image is not found or the token is invalid.
+func findImageByDeleteToken(w http.ResponseWriter, r *http.Request) (*db.Image, bool) {
+	img, err := services.Image.FindByFileName(chi.URLParam(r, "fileName"))
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		renderDialog(w, tr("error"), tr("unknown_error"), "/dashboard/images", tr("go_back"))
-		slog.Error("delete image", "err", err)
+		slog.Error("delete by token", "err", err)
+		return nil, false
+	}
+
+	// the same response for both cases, so that the link can not be used
+	// to find out whether an image exists
+	if img == nil || !services.Image.VerifyDeleteToken(img, chi.URLParam(r, "token")) {
+		w.WriteHeader(http.StatusNotFound)
+		renderDialog(w, tr("error"), tr("invalid_delete_link"), "/", tr("go_back"))
+		return nil, false
+	}
+
+	return img, true
+}
+
+// confirm deleting an image using the deletion link
+func deleteByToken(w http.ResponseWriter, r *http.Request) {
+	img, ok := findImageByDeleteToken(w, r)
+	if !ok {
 		return
 	}
 
-	renderDialog(w, tr("info"), tr("image_deleted"), "/dashboard/images", tr("continue"))
+	render(w, "delete_confirm", H{
+		"user":       middleware.GetUser(r.Context()),
+		"file_name":  img.FileName,
+		"csrf_token": csrfToken(w),
+	})
+}
+
+// delete an image using the deletion link, which does not require logging in
+func doDeleteByToken(w http.ResponseWriter, r *http.Request) {
+	img, ok := findImageByDeleteToken(w, r)
+	if !ok {
+		return
+	}
+
+	err := services.Image.Delete(img, false)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		renderDialog(w, tr("error"), tr("unknown_error"), "/", tr("go_back"))
+		slog.Error("delete by token", "err", err)
+		return
+	}
 
+	renderDialog(w, tr("info"), tr("image_deleted"), "/", tr("continue"))
 }
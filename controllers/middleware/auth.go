@@ -7,6 +7,7 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"strings"
 )
 
 // add user to the context if the cookie is valid
@@ -39,6 +40,65 @@ func Auth(next http.Handler) http.Handler {
 	})
 }
 
+// TokenAuth adds user to the context if a valid api token is presented
+// in the Authorization header. Requests without a valid token are rejected.
+func TokenAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, `{"error":"UNAUTHORIZED"}`)
+			return
+		}
+
+		user, err := services.APIToken.FindUser(token)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			slog.Error("token auth: find token", "err", err)
+			return
+		}
+
+		if user == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, `{"error":"UNAUTHORIZED"}`)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "USER", user)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// UploadKeyAuth adds user to the context if a valid upload key is presented
+// in the X-Upload-Key header or the "key" form value. Requests without a valid
+// key are rejected.
+func UploadKeyAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-Upload-Key")
+		if key == "" {
+			key = r.FormValue("key")
+		}
+
+		user, err := services.User.FindByUploadKey(key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			slog.Error("upload key auth: find user", "err", err)
+			return
+		}
+
+		if user == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, `{"error":"UNAUTHORIZED"}`)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "USER", user)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 // abort the request if user is not present in request context
 func RequireAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -9,6 +9,52 @@ import (
 
 func Route(r chi.Router) {
 	r.Use(cmiddleware.Logger)
+
+	// json api authenticated by api tokens, which requires neither csrf tokens nor captcha
+	r.Route("/api/v1", routeAPI)
+
+	// upload endpoint for screenshot tools, authenticated by upload keys
+	r.With(cmiddleware.SetHeader("Content-Type", "application/json"), middleware.UploadKeyAuth).Post("/api/upload", uploadKeyUpload)
+
+	// resumable uploads from the web page
+	r.Route("/upload/tus", func(r chi.Router) {
+		r.Use(middleware.Auth)
+		r.Use(tusResumable)
+		r.Options("/", tusOptions)
+		r.With(middleware.CAPTCHA).Post("/", tusCreate)
+		r.Head("/{id}", tusHead)
+		r.Patch("/{id}", tusPatch)
+		r.Delete("/{id}", tusDelete)
+	})
+
+	r.Group(routeWeb)
+}
+
+func routeAPI(r chi.Router) {
+	r.Use(cmiddleware.SetHeader("Content-Type", "application/json"))
+	r.Use(middleware.TokenAuth)
+
+	r.Post("/upload", apiUpload)
+	r.Get("/images", apiImages)
+	r.Delete("/images/{fileName}", apiDeleteImage)
+	r.Get("/images/{fileName}/transform", apiSignTransform)
+	r.Post("/images/{fileName}/edit", apiEditImage)
+	r.Get("/images/{fileName}/versions", apiImageVersions)
+	r.Post("/images/{fileName}/versions", apiUploadVersion)
+	r.Post("/images/{fileName}/versions/{id}/restore", apiRestoreVersion)
+
+	// resumable uploads
+	r.Route("/tus", func(r chi.Router) {
+		r.Use(tusResumable)
+		r.Options("/", tusOptions)
+		r.Post("/", tusCreate)
+		r.Head("/{id}", tusHead)
+		r.Patch("/{id}", tusPatch)
+		r.Delete("/{id}", tusDelete)
+	})
+}
+
+func routeWeb(r chi.Router) {
 	r.Use(middleware.Auth)
 	r.Use(middleware.CSRF)
 
@@ -41,7 +87,10 @@ func Route(r chi.Router) {
 
 	// image
 	r.Get("/i/{fileName}", downloadImage)
+	r.Get("/t/{fileName}", downloadThumbnail)
 	r.Get("/preview/{fileName}", previewImage)
+	r.Get("/delete/{fileName}/{token}", deleteByToken)
+	r.Post("/delete/{fileName}/{token}", doDeleteByToken)
 
 	// user dashboard
 	r.Group(func(r chi.Router) {
@@ -52,10 +101,17 @@ func Route(r chi.Router) {
 		r.With(middleware.CAPTCHA).Post("/dashboard/change-email", changeEmail)
 		r.Post("/dashboard/change-username", changeUsername)
 		r.Post("/dashboard/unlink", socialLoginUnlink)
+		r.Post("/dashboard/api-tokens", createAPIToken)
+		r.Post("/dashboard/api-tokens/delete", deleteAPIToken)
+		r.Post("/dashboard/upload-key", generateUploadKey)
+		r.Post("/dashboard/upload-key/revoke", revokeUploadKey)
+		r.Get("/dashboard/upload-key/sharex", shareXConfig)
 		r.Get("/dashboard/verify-email", verifyEmail)
 		r.With(middleware.CAPTCHA).Post("/dashboard/verify-email", doVerifyEmail)
 		r.Get("/dashboard/images", myImages)
 		r.Post("/dashboard/images/delete", deleteImage)
+		r.Post("/dashboard/images/{fileName}/versions", uploadVersion)
+		r.Post("/dashboard/images/{fileName}/versions/{id}/restore", restoreVersion)
 	})
 
 	// admin dashboard
@@ -64,6 +120,8 @@ func Route(r chi.Router) {
 		r.Use(middleware.RequireAdmin)
 		r.Get("/admin/settings", adminSettings)
 		r.Post("/admin/settings", doAdminSettings)
+		r.Get("/admin/settings/watermark", adminWatermarkImage)
+		r.Post("/admin/settings/watermark", adminUploadWatermark)
 		r.Get("/admin/storages", adminStorages)
 		r.Get("/admin/storages/{id}", adminEditStorage)
 		r.Post("/admin/storages/{id}", adminDoEditStorage)
@@ -75,6 +133,10 @@ func Route(r chi.Router) {
 		r.Post("/admin/users/change-group-expire", adminChangeUserGroupExpire)
 		r.Get("/admin/images", adminImages)
 		r.Post("/admin/images/delete", adminImageDelete)
+		r.Post("/admin/images/block", adminImageBlock)
+		r.Get("/admin/images/blocklist", adminBlocklist)
+		r.Post("/admin/images/blocklist", adminBlocklistAdd)
+		r.Post("/admin/images/blocklist/delete/{id}", adminBlocklistDelete)
 		r.Get("/admin/groups", adminGroups)
 		r.Get("/admin/groups/{id}", adminGroupEdit)
 		r.Post("/admin/groups/{id}", adminGroupDoEdit)
@@ -0,0 +1,300 @@
+package controllers
+
+import (
+	"errors"
+	"imgu2/controllers/middleware"
+	"imgu2/db"
+	"imgu2/services"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Resumable uploads implementing the tus 1.0.0 core protocol and the
+// creation and termination extensions.
+// https://tus.io/protocols/resumable-upload
+//
+// The upload parameters of POST /upload (expire, format, lossless, Q and effort)
+// are passed in Upload-Metadata, together with "filetype" and "filename" which
+// are the content type and the name of the file.
+
+const tusVersion = "1.0.0"
+
+// tusResumable checks the Tus-Resumable header, which is required on every
+// request except OPTIONS.
+//
+// Browsers can not send this header cross-origin without a CORS preflight,
+// so the check also protects cookie authenticated requests against CSRF.
+func tusResumable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func tusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,termination")
+
+	group, err := services.Group.GetUserGroup(middleware.GetUser(r.Context()))
+	if err != nil {
+		slog.Error("tus options", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Tus-Max-Size", strconv.Itoa(group.MaxFileSize))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// create a new upload
+func tusCreate(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r.Context())
+
+	// the rate limits are checked when the upload is reserved
+	group, ipAddr, ok := checkUploadPolicies(w, r, user)
+	if !ok {
+		return
+	}
+
+	length, err := strconv.Atoi(r.Header.Get("Upload-Length"))
+	if err != nil || length <= 0 {
+		// Upload-Defer-Length is not supported
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if length > group.MaxFileSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		writeJSON(w, H{
+			"error": "FILE_TOO_LARGE",
+		})
+		return
+	}
+
+	metadataHeader := r.Header.Get("Upload-Metadata")
+	metadata, err := services.PartialUpload.ParseMetadata(metadataHeader)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// reject invalid parameters before any data is sent
+	_, ok = parseUploadOptions(w, func(key string) string { return metadata[key] }, group)
+	if !ok {
+		return
+	}
+
+	id, limited, reset, err := services.PartialUpload.Create(nullUserId(user), group, ipAddr, length, metadataHeader)
+	if errors.Is(err, services.ErrTooManyPartialUploads) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		writeJSON(w, H{
+			"error": "TOO_MANY_UPLOADS",
+		})
+		return
+	}
+
+	if err != nil {
+		slog.Error("tus create", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if limited {
+		writeRateLimited(w, reset)
+		return
+	}
+
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// find the upload in the url and check whether it belongs to the user
+//
+// An error response is written if the upload is not found.
+func tusFind(w http.ResponseWriter, r *http.Request) (*db.PartialUpload, int, bool) {
+	user := middleware.GetUser(r.Context())
+
+	u, offset, err := services.PartialUpload.Find(chi.URLParam(r, "id"))
+	if err != nil {
+		slog.Error("tus find", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, 0, false
+	}
+
+	// the random id is the secret of uploads created by guests
+	if u == nil || (u.Uploader.Valid && (user == nil || u.Uploader.Int32 != int32(user.Id))) {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, 0, false
+	}
+
+	return u, offset, true
+}
+
+func tusHead(w http.ResponseWriter, r *http.Request) {
+	u, offset, ok := tusFind(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Length", strconv.Itoa(u.Length))
+	w.Header().Set("Upload-Offset", strconv.Itoa(offset))
+	if u.FileName != "" {
+		w.Header().Set("Imgu2-File-Name", u.FileName)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// receive a chunk, and save the image once all bytes are received
+func tusPatch(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.Atoi(r.Header.Get("Upload-Offset"))
+	if err != nil || offset < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	u, _, ok := tusFind(w, r)
+	if !ok {
+		return
+	}
+
+	newOffset, complete, err := services.PartialUpload.Append(u, offset, r.Body)
+	if err != nil {
+		if errors.Is(err, services.ErrUploadFinished) {
+			tusFinished(w, r)
+			return
+		}
+
+		if errors.Is(err, services.ErrOffsetMismatch) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		// the client may resume from the new offset
+		slog.Debug("tus patch", "err", err, "id", u.Id)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.Itoa(newOffset))
+
+	if !complete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	result, ok := tusFinish(w, r, u)
+	if !ok {
+		// the upload can not be resumed after a failure
+		err := services.PartialUpload.Delete(u.Id)
+		if err != nil {
+			slog.Error("tus patch: delete", "err", err, "id", u.Id)
+		}
+		return
+	}
+
+	w.Header().Set("Imgu2-File-Name", result.fileName)
+	w.Header().Set("Imgu2-Delete-Token", result.deleteToken)
+	w.Header().Set("Imgu2-Mime-Type", result.mimeType)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// respond to a chunk of an upload which has received all bytes, with the
+// result of the upload if the image is saved
+//
+// the delete token is only sent to the request which completes the upload
+func tusFinished(w http.ResponseWriter, r *http.Request) {
+	u, offset, ok := tusFind(w, r)
+	if !ok {
+		return
+	}
+
+	if u.FileName == "" {
+		// the image is still being saved
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.Itoa(offset))
+	w.Header().Set("Imgu2-File-Name", u.FileName)
+	w.Header().Set("Imgu2-Mime-Type", u.MimeType)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// save the received file as an image
+//
+// An error response is written if it fails.
+func tusFinish(w http.ResponseWriter, r *http.Request, u *db.PartialUpload) (*uploadResult, bool) {
+	user := middleware.GetUser(r.Context())
+
+	// the policies may have changed since the upload is created, and the
+	// upload is reserved in the rate limits by services.PartialUpload.Create
+	group, ipAddr, ok := checkUploadPolicies(w, r, user)
+	if !ok {
+		return nil, false
+	}
+
+	metadata, err := services.PartialUpload.ParseMetadata(u.Metadata)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+
+	opts, ok := parseUploadOptions(w, func(key string) string { return metadata[key] }, group)
+	if !ok {
+		return nil, false
+	}
+
+	content, err := services.PartialUpload.ReadAll(u.Id)
+	if err != nil {
+		slog.Error("tus finish", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+
+	result, uploadErr := storeReservedUpload(user, group, ipAddr, opts, content, metadata["filetype"], metadata["filename"], "")
+	if uploadErr != nil {
+		uploadErr.write(w)
+		return nil, false
+	}
+
+	err = services.PartialUpload.Finish(u.Id, result.fileName, result.mimeType)
+	if err != nil {
+		slog.Error("tus finish", "err", err)
+	}
+
+	return result, true
+}
+
+// terminate an upload
+func tusDelete(w http.ResponseWriter, r *http.Request) {
+	u, _, ok := tusFind(w, r)
+	if !ok {
+		return
+	}
+
+	err := services.PartialUpload.Delete(u.Id)
+	if err != nil {
+		slog.Error("tus delete", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
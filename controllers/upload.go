@@ -2,12 +2,19 @@ package controllers
 
 import (
 	"database/sql"
+	"errors"
 	"imgu2/controllers/middleware"
+	"imgu2/db"
+	"imgu2/libvips"
 	"imgu2/services"
 	"io"
 	"log/slog"
+	"math"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/url"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -16,14 +23,14 @@ import (
 func upload(w http.ResponseWriter, r *http.Request) {
 	user := middleware.GetUser(r.Context())
 
-	avifEnabled, err := services.Setting.IsAVIFEncodingEnabled()
+	encodings, err := services.Upload.EnabledEncodings()
 	if err != nil {
 		slog.Error("upload", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	webpEnabled, err := services.Setting.IsWEBPEncodingEnabled()
+	inputTypes, err := services.Upload.InputTypes()
 	if err != nil {
 		slog.Error("upload", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -38,54 +45,482 @@ func upload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	render(w, "upload", H{
-		"user":         user,
-		"csrf_token":   csrfToken(w),
-		"max_time":     group.MaxRetentionSeconds,
-		"group":        group,
-		"avif_enabled": avifEnabled,
-		"webp_enabled": webpEnabled,
+		"user":       user,
+		"csrf_token": csrfToken(w),
+		"max_time":   group.MaxRetentionSeconds,
+		"group":      group,
+		"encodings":  encodings,
+		"accept":     acceptedInputs(inputTypes),
 	})
 }
 
+// file extensions of input types which browsers may not recognize
+var inputTypeExtensions = map[string]string{
+	"image/heic": ".heic",
+	"image/heif": ".heif",
+	"image/jxl":  ".jxl",
+	"image/avif": ".avif",
+}
+
+// the accept attribute of the file input, listing the allowed input types
+func acceptedInputs(inputTypes []string) string {
+	accept := make([]string, 0)
+	for _, t := range inputTypes {
+		accept = append(accept, t)
+		if ext, ok := inputTypeExtensions[t]; ok {
+			accept = append(accept, ext)
+		}
+	}
+	return strings.Join(accept, ",")
+}
+
 func doUpload(w http.ResponseWriter, r *http.Request) {
 	user := middleware.GetUser(r.Context())
 
-	// disallow banned users from uploading
-	if user != nil && user.Role == services.RoleBanned {
-		w.WriteHeader(http.StatusForbidden)
+	if isBatchUpload(r) {
+		results, ok := handleBatchUpload(w, r, user)
+		if !ok {
+			return
+		}
+
 		writeJSON(w, H{
-			"error": "USER_BANNED",
+			"files": results,
 		})
 		return
 	}
 
-	// disallow unverified users from uploading
-	if user != nil && !user.EmailVerified {
-		w.WriteHeader(http.StatusForbidden)
+	result, ok := handleFormUpload(w, r, user)
+	if !ok {
+		return
+	}
+
+	siteUrl, err := services.Setting.GetSiteURL()
+	if err != nil {
+		slog.Error("do upload", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, result.json(siteUrl))
+}
+
+// uploadResult is a successfully uploaded image
+type uploadResult struct {
+	fileName    string
+	deleteToken string // the secret token in the deletion link
+	mimeType    string // the chosen format if the format is auto
+}
+
+// the json response of an uploaded image
+func (u *uploadResult) json(siteUrl string) H {
+	return H{
+		"file_name":     u.fileName,
+		"url":           siteUrl + "/i/" + u.fileName,
+		"preview_url":   siteUrl + "/preview/" + u.fileName,
+		"thumbnail_url": siteUrl + "/t/" + u.fileName,
+		"delete_token":  u.deleteToken,
+		"delete_url":    siteUrl + "/delete/" + u.fileName + "/" + u.deleteToken,
+		"mime_type":     u.mimeType,
+	}
+}
+
+// handleFormUpload checks the user group policies and saves the file
+// in the "file" field of a multipart form, or the file fetched from
+// the "url" field
+//
+// user may be nil to represent a guest user
+//
+// An error response is written if the upload fails.
+func handleFormUpload(w http.ResponseWriter, r *http.Request, user *db.User) (*uploadResult, bool) {
+	group, ipAddr, ok := checkUploadPermission(w, r, user)
+	if !ok {
+		return nil, false
+	}
+
+	opts, ok := parseUploadOptions(w, r.FormValue, group)
+	if !ok {
+		return nil, false
+	}
+
+	// upload by url
+	if sourceURL := r.FormValue("url"); sourceURL != "" {
+		fileContent, contentType, uploadErr := fetchUpload(group, sourceURL)
+		if uploadErr != nil {
+			uploadErr.write(w)
+			return nil, false
+		}
+
+		return saveUpload(w, user, group, ipAddr, opts, fileContent, contentType, urlFileName(sourceURL), sourceURL)
+	}
+
+	_, fileHeaders, err := r.FormFile("file")
+	if err != nil {
+		slog.Debug("upload: read file", "err", err)
+		w.WriteHeader(http.StatusBadRequest)
 		writeJSON(w, H{
-			"error": "EMAIL_NOT_VERIFIED",
+			"error": "MISSING_FILE",
 		})
-		return
+		return nil, false
 	}
 
-	// exipre in seconds
-	expire, err := strconv.Atoi(r.FormValue("expire"))
+	fileContent, uploadErr := readUploadedFile(group, fileHeaders)
+	if uploadErr != nil {
+		uploadErr.write(w)
+		return nil, false
+	}
+
+	return saveUpload(w, user, group, ipAddr, opts, fileContent, fileHeaders.Header.Get("Content-Type"), fileHeaders.Filename, "")
+}
+
+// handleVersionUpload checks the user group policies, and replaces an
+// image with the file in the "file" field of a multipart form, or the file
+// fetched from the "url" field, see services.Upload.UploadVersion
+//
+// The encoding parameters and the edit operations are the same as POST
+// /upload, and the format of the image is kept.
+//
+// An error response is written if the upload fails.
+func handleVersionUpload(w http.ResponseWriter, r *http.Request, user *db.User, img *db.Image) bool {
+	group, ipAddr, ok := checkUploadPermission(w, r, user)
+	if !ok {
+		return false
+	}
+
+	opts := uploadOptions{}
+	if !parseEncodingOptions(w, r.FormValue, &opts) {
+		return false
+	}
+
+	var fileContent []byte
+	var uploadErr *uploadError
+
+	if sourceURL := r.FormValue("url"); sourceURL != "" {
+		fileContent, _, uploadErr = fetchUpload(group, sourceURL)
+	} else {
+		_, fileHeaders, err := r.FormFile("file")
+		if err != nil {
+			slog.Debug("upload version: read file", "err", err)
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, H{
+				"error": "MISSING_FILE",
+			})
+			return false
+		}
+
+		fileContent, uploadErr = readUploadedFile(group, fileHeaders)
+	}
+
+	if uploadErr != nil {
+		uploadErr.write(w)
+		return false
+	}
+
+	cancel, uploadErr := reserveUpload(user, group, ipAddr)
+	if uploadErr != nil {
+		uploadErr.write(w)
+		return false
+	}
+
+	err := services.Upload.UploadVersion(img, fileContent, opts.serviceOptions(user, group, ipAddr))
+	if err != nil {
+		cancel()
+		uploadErrorOf(err).write(w)
+		return false
+	}
+
+	return true
+}
+
+// maximum number of files in a batch upload
+const maxBatchUploadFiles = 50
+
+// isBatchUpload reports whether more than one file or url is sent
+func isBatchUpload(r *http.Request) bool {
+	files, urls := uploadSources(r)
+	return len(files)+len(urls) > 1
+}
+
+// the "file" fields and the non-empty "url" fields of the request
+func uploadSources(r *http.Request) ([]*multipart.FileHeader, []string) {
+	// populate r.MultipartForm and r.Form
+	r.FormValue("url")
+
+	var files []*multipart.FileHeader
+	if r.MultipartForm != nil {
+		files = r.MultipartForm.File["file"]
+	}
+
+	var urls []string
+	for _, v := range r.Form["url"] {
+		if v != "" {
+			urls = append(urls, v)
+		}
+	}
+
+	return files, urls
+}
+
+// handleBatchUpload saves every file in the "file" fields and every url
+// in the "url" fields with the same encoding parameters
+//
+// A failed file does not abort the others. The result of each file is
+// either the same as a single upload or {"error": "..."}, in the order of
+// files followed by urls.
+//
+// An error response is written if the request itself is rejected.
+func handleBatchUpload(w http.ResponseWriter, r *http.Request, user *db.User) ([]H, bool) {
+	group, ipAddr, ok := checkUploadPermission(w, r, user)
+	if !ok {
+		return nil, false
+	}
+
+	opts, ok := parseUploadOptions(w, r.FormValue, group)
+	if !ok {
+		return nil, false
+	}
+
+	siteUrl, err := services.Setting.GetSiteURL()
 	if err != nil {
+		slog.Error("batch upload", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+
+	files, urls := uploadSources(r)
+	if len(files)+len(urls) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
-		return
+		writeJSON(w, H{
+			"error": "MISSING_FILE",
+		})
+		return nil, false
 	}
 
-	if expire < 0 {
+	if len(files)+len(urls) > maxBatchUploadFiles {
 		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, H{
+			"error": "TOO_MANY_FILES",
+		})
+		return nil, false
+	}
+
+	results := make([]H, 0, len(files)+len(urls))
+
+	// upload a single file, and append the result
+	uploadOne := func(read func() ([]byte, string, *uploadError), originalName string, sourceURL string) {
+		// each uploaded file counts towards the rate limits of the following
+		// ones, and the file is not read once the uploader is limited
+		cancel, uploadErr := reserveUpload(user, group, ipAddr)
+		if uploadErr != nil {
+			results = append(results, uploadErr.json())
+			return
+		}
+
+		fileContent, contentType, uploadErr := read()
+		if uploadErr == nil {
+			var result *uploadResult
+			result, uploadErr = storeReservedUpload(user, group, ipAddr, opts, fileContent, contentType, originalName, sourceURL)
+			if uploadErr == nil {
+				results = append(results, result.json(siteUrl))
+				return
+			}
+		}
+		cancel()
+
+		if uploadErr.code == "" {
+			// the file can not be read from the request
+			uploadErr.code = "MISSING_FILE"
+		}
+		results = append(results, uploadErr.json())
+	}
+
+	for _, fh := range files {
+		uploadOne(func() ([]byte, string, *uploadError) {
+			fileContent, uploadErr := readUploadedFile(group, fh)
+			return fileContent, fh.Header.Get("Content-Type"), uploadErr
+		}, fh.Filename, "")
+	}
+
+	for _, u := range urls {
+		uploadOne(func() ([]byte, string, *uploadError) {
+			return fetchUpload(group, u)
+		}, urlFileName(u), u)
+	}
+
+	return results, true
+}
+
+// uploadError is an error response of the upload endpoints
+type uploadError struct {
+	status int
+	code   string    // the "error" field of the json response, may be empty
+	reset  time.Time // see writeRateLimited, if code is "RATE_LIMITED"
+}
+
+func (e *uploadError) write(w http.ResponseWriter) {
+	if e.code == "RATE_LIMITED" {
+		writeRateLimited(w, e.reset)
 		return
 	}
 
+	w.WriteHeader(e.status)
+	if e.code != "" {
+		writeJSON(w, e.json())
+	}
+}
+
+// the json response, or the result of a file in batch uploads
+func (e *uploadError) json() H {
+	if e.code == "RATE_LIMITED" {
+		return H{"error": e.code, "reset": resetUnix(e.reset)}
+	}
+	return H{"error": e.code}
+}
+
+// read a file in a multipart form and check the file size limit
+func readUploadedFile(group *db.Group, fileHeaders *multipart.FileHeader) ([]byte, *uploadError) {
+	// file size limit
+	if fileHeaders.Size > int64(group.MaxFileSize) {
+		return nil, &uploadError{status: http.StatusForbidden, code: "FILE_TOO_LARGE"}
+	}
+
+	file, err := fileHeaders.Open()
+	if err != nil {
+		slog.Error("do upload: open file", "err", err)
+		return nil, &uploadError{status: http.StatusBadRequest, code: "MISSING_FILE"}
+	}
+	defer file.Close()
+
+	// read uploaded file
+	fileContent, err := io.ReadAll(file)
+	if err != nil {
+		slog.Error("do upload: read file", "err", err)
+		return nil, &uploadError{status: http.StatusBadRequest, code: ""}
+	}
+
+	return fileContent, nil
+}
+
+// the last path segment of a url, which is used as the original file name
+func urlFileName(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return ""
+	}
+	return name
+}
+
+// download a remote file for uploading
+//
+// return the content and the content type of the file
+func fetchUpload(group *db.Group, sourceURL string) ([]byte, string, *uploadError) {
+	fileContent, contentType, err := services.Upload.FetchURL(sourceURL, group.MaxFileSize)
+	if err != nil {
+		slog.Debug("upload: fetch url", "err", err, "url", sourceURL)
+
+		switch {
+		case errors.Is(err, services.ErrInvalidURL), errors.Is(err, services.ErrForbiddenURL):
+			return nil, "", &uploadError{status: http.StatusBadRequest, code: "INVALID_URL"}
+		case errors.Is(err, services.ErrRemoteTooLarge):
+			return nil, "", &uploadError{status: http.StatusForbidden, code: "FILE_TOO_LARGE"}
+		default:
+			return nil, "", &uploadError{status: http.StatusBadRequest, code: "FETCH_URL_FAILED"}
+		}
+	}
+
+	return fileContent, contentType, nil
+}
+
+// uploadOptions are the parameters shared by all upload endpoints
+type uploadOptions struct {
+	expire       sql.NullTime
+	targetFormat string
+	lossless     bool
+	Q            int
+	effort       int
+	operations   []libvips.EditOperation // applied before the image is encoded
+}
+
+// serviceOptions are the options of services.Upload.UploadImage, with the
+// limits and the policies of the user group
+func (opts *uploadOptions) serviceOptions(user *db.User, group *db.Group, ipAddr string) *services.UploadOptions {
+	return &services.UploadOptions{
+		UserId:         nullUserId(user),
+		IPAddr:         ipAddr,
+		Expire:         opts.expire,
+		TargetFormat:   opts.targetFormat,
+		FileSizeLimit:  group.MaxFileSize,
+		StorageLimit:   group.MaxStorageBytes,
+		DimensionLimit: services.GroupDimensionLimit(group),
+		MetadataPolicy: group.MetadataPolicy,
+		Watermark:      group.Watermark,
+		Lossless:       opts.lossless,
+		Q:              opts.Q,
+		Effort:         opts.effort,
+		Ops:            opts.operations,
+	}
+}
+
+// checkUploadPermission checks whether the user is allowed to upload
+// according to the user group policies and the rate limits.
+//
+// user may be nil to represent a guest user
+//
+// An error response is written if the user is not allowed to upload.
+// Otherwise, the user group and the ip address of the uploader are returned.
+func checkUploadPermission(w http.ResponseWriter, r *http.Request, user *db.User) (*db.Group, string, bool) {
+	group, ipAddr, ok := checkUploadPolicies(w, r, user)
+	if !ok {
+		return nil, "", false
+	}
+
+	// upload rate limits
+	limited, reset, err := services.Upload.CheckRateLimit(nullUserId(user), group, ipAddr)
+	if err != nil {
+		slog.Error("upload: rate limit", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, "", false
+	}
+
+	if limited {
+		writeRateLimited(w, reset)
+		return nil, "", false
+	}
+
+	return group, ipAddr, true
+}
+
+// checkUploadPolicies is checkUploadPermission without the rate limits, for
+// uploads which are already reserved in the rate limits
+func checkUploadPolicies(w http.ResponseWriter, r *http.Request, user *db.User) (*db.Group, string, bool) {
+	// disallow banned users from uploading
+	if user != nil && user.Role == services.RoleBanned {
+		w.WriteHeader(http.StatusForbidden)
+		writeJSON(w, H{
+			"error": "USER_BANNED",
+		})
+		return nil, "", false
+	}
+
+	// disallow unverified users from uploading
+	if user != nil && !user.EmailVerified {
+		w.WriteHeader(http.StatusForbidden)
+		writeJSON(w, H{
+			"error": "EMAIL_NOT_VERIFIED",
+		})
+		return nil, "", false
+	}
+
 	// check user group policies
 	group, err := services.Group.GetUserGroup(user)
 	if err != nil {
 		slog.Error("upload", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, "", false
 	}
 
 	if !group.AllowUpload {
@@ -94,7 +529,64 @@ func doUpload(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, H{
 			"error": "PERMISSION_DENIED",
 		})
-		return
+		return nil, "", false
+	}
+
+	// ip address
+	ipAddr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("do upload: remote addr", "err", err)
+		return nil, "", false
+	}
+
+	// storage quota, the size of the new image is checked after it is encoded
+	if group.MaxStorageBytes > 0 {
+		used, err := services.Upload.StorageUsage(nullUserId(user), ipAddr)
+		if err != nil {
+			slog.Error("upload: storage usage", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return nil, "", false
+		}
+
+		if used >= group.MaxStorageBytes {
+			w.WriteHeader(http.StatusForbidden)
+			writeJSON(w, H{
+				"error": "STORAGE_QUOTA_EXCEEDED",
+			})
+			return nil, "", false
+		}
+	}
+
+	return group, ipAddr, true
+}
+
+// parseUploadOptions reads the expire time and encoding parameters using
+// value, which is usually r.FormValue.
+//
+// An error response is written if any parameter is invalid.
+func parseUploadOptions(w http.ResponseWriter, value func(key string) string, group *db.Group) (*uploadOptions, bool) {
+	opts := uploadOptions{}
+
+	// optional parameters use the default value if they are not present
+	atoi := func(key string, defaultValue int) (int, error) {
+		s := value(key)
+		if s == "" {
+			return defaultValue, nil
+		}
+		return strconv.Atoi(s)
+	}
+
+	// exipre in seconds
+	expire, err := atoi("expire", 0)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+
+	if expire < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
 	}
 
 	// image retention seconds limit
@@ -112,149 +604,260 @@ func doUpload(w http.ResponseWriter, r *http.Request) {
 			writeJSON(w, H{
 				"error": "EXPIRE_TOO_LARGE",
 			})
-			return
+			return nil, false
 		}
 	}
 
-	file, fileHeaders, err := r.FormFile("file")
-	if err != nil {
-		slog.Debug("upload: read file", "err", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	// file size limit
-	if fileHeaders.Size > int64(group.MaxFileSize) {
-		w.WriteHeader(http.StatusForbidden)
-		writeJSON(w, H{
-			"error": "FILE_TOO_LARGE",
-		})
-		return
+	if expire != 0 {
+		opts.expire = sql.NullTime{Valid: true, Time: time.Now().Add(time.Second * time.Duration(expire))}
 	}
 
 	// image format
-	targetFormat := ""
-	switch r.FormValue("format") {
-	case "webp":
-		targetFormat = "image/webp"
-
-		webpEnabled, err := services.Setting.IsWEBPEncodingEnabled()
+	format := value("format")
+	if format == "" {
+		// default to webp if it is enabled
+		webpEnabled, err := services.Upload.IsEncodingEnabled("webp")
 		if err != nil {
 			slog.Error("upload", "err", err)
 			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return nil, false
 		}
-		if !webpEnabled {
-			w.WriteHeader(http.StatusBadRequest)
-			writeJSON(w, H{
-				"error": "UNSUPPORTED_ENCODING",
-			})
-			return
+
+		format = "png"
+		if webpEnabled {
+			format = "webp"
 		}
+	}
 
-	case "jpeg":
-		targetFormat = "image/jpeg"
-	case "gif":
-		targetFormat = "image/gif"
-	case "png":
-		targetFormat = "image/png"
-	case "avif":
-		targetFormat = "image/avif"
+	switch format {
+	case services.AUTO_FORMAT:
+		opts.targetFormat = services.AUTO_FORMAT
+	case "webp", "png", "jpeg", "gif", "avif", "jxl":
+		opts.targetFormat = "image/" + format
 
-		avifEnabled, err := services.Setting.IsAVIFEncodingEnabled()
+		enabled, err := services.Upload.IsEncodingEnabled(format)
 		if err != nil {
 			slog.Error("upload", "err", err)
 			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return nil, false
 		}
-		if !avifEnabled {
+		if !enabled {
 			w.WriteHeader(http.StatusBadRequest)
 			writeJSON(w, H{
 				"error": "UNSUPPORTED_ENCODING",
 			})
-			return
+			return nil, false
 		}
 	default:
 		w.WriteHeader(http.StatusBadRequest)
-		return
+		return nil, false
 	}
 
-	// read uploaded file
-	fileContent, err := io.ReadAll(file)
-	if err != nil {
-		slog.Error("do upload: read file", "err", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	if !parseEncodingOptions(w, value, &opts) {
+		return nil, false
 	}
 
-	// ip address
-	ipAddr, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		slog.Error("do upload: remote addr", "err", err)
-		return
+	return &opts, true
+}
+
+// parseEncodingOptions reads the encoding parameters and the edit
+// operations into opts using value, which is usually r.FormValue.
+//
+// An error response is written if any parameter is invalid.
+func parseEncodingOptions(w http.ResponseWriter, value func(key string) string, opts *uploadOptions) bool {
+	// optional parameters use the default value if they are not present
+	atoi := func(key string, defaultValue int) (int, error) {
+		s := value(key)
+		if s == "" {
+			return defaultValue, nil
+		}
+		return strconv.Atoi(s)
 	}
 
-	// encoding parameters
-	var (
-		lossless bool
-		Q        int
-		effort   int
-	)
+	var err error
 
-	lossless, err = strconv.ParseBool(r.FormValue("lossless"))
-	if err != nil {
-		slog.Error("do upload: parse encoding param 'lossless'", "err", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	// encoding parameters
+	// negative Q and effort let libvips choose the default value
+	if value("lossless") != "" {
+		opts.lossless, err = strconv.ParseBool(value("lossless"))
+		if err != nil {
+			slog.Error("do upload: parse encoding param 'lossless'", "err", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return false
+		}
 	}
-	Q, err = strconv.Atoi(r.FormValue("Q"))
+	opts.Q, err = atoi("Q", -1)
 	if err != nil {
 		slog.Error("do upload: parse encoding param 'Q'", "err", err)
 		w.WriteHeader(http.StatusBadRequest)
-		return
+		return false
 	}
-	effort, err = strconv.Atoi(r.FormValue("effort"))
+	opts.effort, err = atoi("effort", -1)
 	if err != nil {
 		slog.Error("do upload: parse encoding param 'effort'", "err", err)
 		w.WriteHeader(http.StatusBadRequest)
-		return
+		return false
 	}
 
-	userId := sql.NullInt32{}
-	if user != nil {
-		userId.Valid = true
-		userId.Int32 = int32(user.Id)
+	// edit operations, see services.Edit.ParseOperations
+	opts.operations, err = services.Edit.ParseOperations(value("operations"))
+	if err != nil {
+		slog.Debug("do upload: parse edit operations", "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, H{
+			"error": "INVALID_EDIT_OPERATIONS",
+		})
+		return false
 	}
 
-	// upload
-	var fileName string
-	if expire == 0 {
-		fileName, err = services.Upload.UploadImage(userId, fileContent, sql.NullTime{}, ipAddr, targetFormat, group.MaxFileSize, lossless, Q, effort, fileHeaders.Header.Get("Content-Type"))
-	} else {
-		t := time.Now().Add(time.Second * time.Duration(expire))
-		fileName, err = services.Upload.UploadImage(userId, fileContent, sql.NullTime{Valid: true, Time: t}, ipAddr, targetFormat, group.MaxFileSize, lossless, Q, effort, fileHeaders.Header.Get("Content-Type"))
+	return true
+}
+
+// saveUpload re-encodes and stores the uploaded file
+//
+// originalName is the name of the uploaded file, which may be empty
+//
+// sourceURL is empty if the file is not fetched from a url
+//
+// An error response is written if the upload fails.
+func saveUpload(w http.ResponseWriter, user *db.User, group *db.Group, ipAddr string, opts *uploadOptions, fileContent []byte, contentType string, originalName string, sourceURL string) (*uploadResult, bool) {
+	result, uploadErr := storeUpload(user, group, ipAddr, opts, fileContent, contentType, originalName, sourceURL)
+	if uploadErr != nil {
+		uploadErr.write(w)
+		return nil, false
+	}
+
+	return result, true
+}
+
+// storeUpload is saveUpload without writing the error response
+func storeUpload(user *db.User, group *db.Group, ipAddr string, opts *uploadOptions, fileContent []byte, contentType string, originalName string, sourceURL string) (*uploadResult, *uploadError) {
+	cancel, uploadErr := reserveUpload(user, group, ipAddr)
+	if uploadErr != nil {
+		return nil, uploadErr
+	}
+
+	result, uploadErr := storeReservedUpload(user, group, ipAddr, opts, fileContent, contentType, originalName, sourceURL)
+	if uploadErr != nil {
+		cancel()
+		return nil, uploadErr
+	}
+
+	return result, nil
+}
+
+// storeReservedUpload is storeUpload for uploads which are already reserved
+// in the rate limits, see reserveUpload
+func storeReservedUpload(user *db.User, group *db.Group, ipAddr string, opts *uploadOptions, fileContent []byte, contentType string, originalName string, sourceURL string) (*uploadResult, *uploadError) {
+	// file size limit
+	if len(fileContent) > group.MaxFileSize {
+		return nil, &uploadError{status: http.StatusForbidden, code: "FILE_TOO_LARGE"}
 	}
 
+	serviceOpts := opts.serviceOptions(user, group, ipAddr)
+	serviceOpts.ContentType = contentType
+	serviceOpts.OriginalName = originalName
+	serviceOpts.SourceURL = sourceURL
+
+	fileName, deleteToken, mimeType, err := services.Upload.UploadImage(fileContent, serviceOpts)
 	if err != nil {
-		slog.Error("do upload: upload", "err", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		return nil, uploadErrorOf(err)
+	}
 
-		if strings.HasPrefix(err.Error(), "upload: ") {
-			// storage driver error
-			writeJSON(w, H{
-				"error": "INTERNAL_STORAGE_ERROR",
-			})
-		} else {
-			// malformated image
-			writeJSON(w, H{
-				"error": "IMAGE_PROCESSING_ERROR",
-			})
-		}
-		return
+	return &uploadResult{fileName, deleteToken, mimeType}, nil
+}
+
+// reserveUpload records an upload before the image is encoded, see
+// services.Upload.ReserveUpload
+//
+// The rate limits are checked again together with recording the upload,
+// since concurrent uploads may pass checkUploadPermission. cancel must be
+// called if the upload fails.
+func reserveUpload(user *db.User, group *db.Group, ipAddr string) (func(), *uploadError) {
+	limited, reset, cancel, err := services.Upload.ReserveUpload(nullUserId(user), group, ipAddr)
+	if err != nil {
+		return nil, uploadErrorOf(err)
+	}
+
+	if limited {
+		return nil, &uploadError{status: http.StatusTooManyRequests, code: "RATE_LIMITED", reset: reset}
+	}
+
+	return cancel, nil
+}
+
+// the error response of a failed services.Upload.UploadImage
+func uploadErrorOf(err error) *uploadError {
+	var uploadErr *uploadError
+
+	switch {
+	case errors.Is(err, services.ErrStorageQuotaExceeded):
+		uploadErr = &uploadError{status: http.StatusForbidden, code: "STORAGE_QUOTA_EXCEEDED"}
+	case errors.Is(err, services.ErrImageDimensionsTooLarge):
+		uploadErr = &uploadError{status: http.StatusForbidden, code: "IMAGE_DIMENSIONS_TOO_LARGE"}
+	case errors.Is(err, services.ErrEncodedFileTooLarge):
+		uploadErr = &uploadError{status: http.StatusForbidden, code: "FILE_TOO_LARGE"}
+	case errors.Is(err, services.ErrInputTypeNotAllowed):
+		uploadErr = &uploadError{status: http.StatusUnsupportedMediaType, code: "INPUT_TYPE_NOT_ALLOWED"}
+	case errors.Is(err, services.ErrImageBlocked):
+		uploadErr = &uploadError{status: http.StatusForbidden, code: "IMAGE_BLOCKED"}
+	case errors.Is(err, services.ErrInvalidEditOperations):
+		uploadErr = &uploadError{status: http.StatusBadRequest, code: "INVALID_EDIT_OPERATIONS"}
+	case errors.Is(err, libvips.ErrUnsupportedInput):
+		uploadErr = &uploadError{status: http.StatusUnsupportedMediaType, code: "UNSUPPORTED_IMAGE_FORMAT"}
+	case errors.Is(err, libvips.ErrCorruptInput):
+		uploadErr = &uploadError{status: http.StatusBadRequest, code: "CORRUPT_IMAGE"}
+	case errors.Is(err, libvips.ErrBusy):
+		uploadErr = &uploadError{status: http.StatusServiceUnavailable, code: "BUSY"}
+	case errors.Is(err, libvips.ErrTimeout):
+		uploadErr = &uploadError{status: http.StatusServiceUnavailable, code: "IMAGE_PROCESSING_TIMEOUT"}
+	case errors.Is(err, libvips.ErrOutOfMemory):
+		uploadErr = &uploadError{status: http.StatusServiceUnavailable, code: "OUT_OF_MEMORY"}
+	case errors.Is(err, libvips.ErrEncode):
+		uploadErr = &uploadError{status: http.StatusInternalServerError, code: "IMAGE_PROCESSING_ERROR"}
+	default:
+		// storage drivers and the database
+		uploadErr = &uploadError{status: http.StatusInternalServerError, code: "INTERNAL_STORAGE_ERROR"}
+	}
+
+	if uploadErr.status >= 500 {
+		slog.Error("upload", "err", err, "code", uploadErr.code)
+	} else {
+		slog.Info("upload rejected", "err", err, "code", uploadErr.code)
+	}
+
+	return uploadErr
+}
+
+// user id of the uploader, which is nil for guest users
+func nullUserId(user *db.User) sql.NullInt32 {
+	userId := sql.NullInt32{}
+	if user != nil {
+		userId.Valid = true
+		userId.Int32 = int32(user.Id)
+	}
+	return userId
+}
+
+// respond with RATE_LIMITED and the time when the upload quota resets
+//
+// reset is 0 if the quota never resets
+func writeRateLimited(w http.ResponseWriter, reset time.Time) {
+	if !reset.IsZero() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(reset).Seconds()))))
 	}
 
+	w.WriteHeader(http.StatusTooManyRequests)
 	writeJSON(w, H{
-		"file_name": fileName,
+		"error": "RATE_LIMITED",
+		"reset": resetUnix(reset),
 	})
 }
+
+// the unix time of reset, or zero if the limit never resets
+func resetUnix(reset time.Time) int64 {
+	if reset.IsZero() {
+		return 0
+	}
+	return reset.Unix()
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"encoding/json"
+	"imgu2/controllers/middleware"
+	"imgu2/services"
+	"log/slog"
+	"net/http"
+)
+
+// upload endpoint for screenshot tools (e.g. ShareX, PicGo and Flameshot)
+//
+// the form parameters are the same as POST /upload, but only "file" is required
+func uploadKeyUpload(w http.ResponseWriter, r *http.Request) {
+	user := middleware.MustGetUser(r.Context())
+
+	result, ok := handleFormUpload(w, r, user)
+	if !ok {
+		return
+	}
+
+	siteUrl, err := services.Setting.GetSiteURL()
+	if err != nil {
+		slog.Error("upload key upload", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, result.json(siteUrl))
+}
+
+func generateUploadKey(w http.ResponseWriter, r *http.Request) {
+	user := middleware.MustGetUser(r.Context())
+
+	_, err := services.User.GenerateUploadKey(user.Id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("generate upload key", "err", err)
+		renderDialog(w, tr("error"), tr("unknown_error"), "/dashboard/account", tr("go_back"))
+		return
+	}
+
+	http.Redirect(w, r, "/dashboard/account#upload-key", http.StatusFound)
+}
+
+func revokeUploadKey(w http.ResponseWriter, r *http.Request) {
+	user := middleware.MustGetUser(r.Context())
+
+	err := services.User.RevokeUploadKey(user.Id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("revoke upload key", "err", err)
+		renderDialog(w, tr("error"), tr("unknown_error"), "/dashboard/account", tr("go_back"))
+		return
+	}
+
+	renderDialog(w, tr("info"), tr("upload_key_revoked"), "/dashboard/account", tr("continue"))
+}
+
+// download a ShareX custom uploader config (.sxcu)
+func shareXConfig(w http.ResponseWriter, r *http.Request) {
+	user := middleware.MustGetUser(r.Context())
+
+	key, err := services.User.GetUploadKey(user.Id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("sharex config", "err", err)
+		return
+	}
+
+	if key == "" {
+		w.WriteHeader(http.StatusNotFound)
+		renderDialog(w, tr("error"), tr("upload_key_not_generated"), "/dashboard/account", tr("go_back"))
+		return
+	}
+
+	siteName, err := services.Setting.GetSiteName()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("sharex config", "err", err)
+		return
+	}
+
+	siteUrl, err := services.Setting.GetSiteURL()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("sharex config", "err", err)
+		return
+	}
+
+	// https://getsharex.com/docs/custom-uploader
+	b, err := json.MarshalIndent(H{
+		"Version":         "15.0.0",
+		"Name":            siteName,
+		"DestinationType": "ImageUploader, FileUploader",
+		"RequestMethod":   "POST",
+		"RequestURL":      siteUrl + "/api/upload",
+		"Headers": H{
+			"X-Upload-Key": key,
+		},
+		"Body":         "MultipartFormData",
+		"FileFormName": "file",
+		"URL":          "{json:url}",
+		"ThumbnailURL": "{json:thumbnail_url}",
+		"DeletionURL":  "{json:delete_url}",
+		"ErrorMessage": "{json:error}",
+	}, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("sharex config", "err", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="imgu2.sxcu"`)
+	w.Write(b)
+}
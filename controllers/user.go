@@ -16,8 +16,31 @@ import (
 func dashboardIndex(w http.ResponseWriter, r *http.Request) {
 	user := middleware.MustGetUser(r.Context())
 
+	group, err := services.Group.GetUserGroup(user)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("dashboard", "err", err)
+		return
+	}
+
+	storageUsed, err := services.Upload.StorageUsage(nullUserId(user), "")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("dashboard", "err", err)
+		return
+	}
+
+	// percentage of the storage quota used
+	storagePercent := 0
+	if group.MaxStorageBytes > 0 {
+		storagePercent = min(100, storageUsed*100/group.MaxStorageBytes)
+	}
+
 	render(w, "dashboard", H{
-		"user": user,
+		"user":            user,
+		"storage_used":    storageUsed,
+		"storage_limit":   group.MaxStorageBytes,
+		"storage_percent": storagePercent,
 	})
 }
 
@@ -52,8 +75,32 @@ func accountSetting(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	apiTokens, err := services.APIToken.FindByUser(user.Id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("account setting", "err", err)
+		return
+	}
+
+	uploadKey, err := services.User.GetUploadKey(user.Id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("account setting", "err", err)
+		return
+	}
+
+	siteUrl, err := services.Setting.GetSiteURL()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("account setting", "err", err)
+		return
+	}
+
 	render(w, "account", H{
 		"user":          user,
+		"api_tokens":    apiTokens,
+		"upload_key":    uploadKey,
+		"site_url":      siteUrl,
 		"google_login":  googleLogin,
 		"google_linked": googleLinked,
 		"github_login":  githubLogin,
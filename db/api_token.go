@@ -0,0 +1,107 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+type APIToken struct {
+	Id        int
+	UserId    int
+	Name      string
+	TokenHash string // sha256 hash of the token in hex
+	CreatedAt time.Time
+
+	// LastUsedAt is null if the token has never been used
+	LastUsedAt sql.NullTime
+}
+
+func APITokenCreate(userId int, name string, tokenHash string) (int, error) {
+	r, err := DB.Exec("INSERT INTO api_tokens(user, name, token_hash, created_at) VALUES (?, ?, ?, ?)", userId, name, tokenHash, time.Now().Unix())
+	if err != nil {
+		return 0, fmt.Errorf("db: %w", err)
+	}
+
+	id, err := r.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("db: %w", err)
+	}
+
+	return int(id), nil
+}
+
+// return (nil, nil) if not found
+func APITokenFindByHash(tokenHash string) (*APIToken, error) {
+	var t APIToken
+	var createdAt int64
+	var lastUsedAt int64
+
+	row := DB.QueryRow("SELECT id, user, name, token_hash, created_at, last_used_at FROM api_tokens WHERE token_hash = ? LIMIT 1", tokenHash)
+	err := row.Scan(&t.Id, &t.UserId, &t.Name, &t.TokenHash, &createdAt, &lastUsedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("db: %w", err)
+	}
+
+	t.CreatedAt = time.Unix(createdAt, 0)
+
+	if lastUsedAt > 0 {
+		t.LastUsedAt.Valid = true
+		t.LastUsedAt.Time = time.Unix(lastUsedAt, 0)
+	}
+
+	return &t, nil
+}
+
+func APITokenFindByUser(userId int) ([]APIToken, error) {
+	tokens := make([]APIToken, 0)
+
+	rows, err := DB.Query("SELECT id, user, name, token_hash, created_at, last_used_at FROM api_tokens WHERE user = ? ORDER BY id ASC", userId)
+	if err != nil {
+		return nil, fmt.Errorf("db: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t APIToken
+		var createdAt int64
+		var lastUsedAt int64
+
+		err := rows.Scan(&t.Id, &t.UserId, &t.Name, &t.TokenHash, &createdAt, &lastUsedAt)
+		if err != nil {
+			return nil, fmt.Errorf("db: %w", err)
+		}
+
+		t.CreatedAt = time.Unix(createdAt, 0)
+
+		if lastUsedAt > 0 {
+			t.LastUsedAt.Valid = true
+			t.LastUsedAt.Time = time.Unix(lastUsedAt, 0)
+		}
+
+		tokens = append(tokens, t)
+	}
+
+	return tokens, nil
+}
+
+func APITokenUpdateLastUsed(id int) error {
+	_, err := DB.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", time.Now().Unix(), id)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
+
+// delete a token owned by the user
+func APITokenDelete(id int, userId int) error {
+	_, err := DB.Exec("DELETE FROM api_tokens WHERE id = ? AND user = ?", id, userId)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
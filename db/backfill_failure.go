@@ -0,0 +1,49 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// tasks which fill in missing data of existing images
+const (
+	BackfillMetadata  = "metadata"
+	BackfillThumbnail = "thumbnail"
+	BackfillBlurHash  = "blurhash"
+	BackfillPHash     = "phash"
+)
+
+// images are skipped by a backfill task after failing this many times
+const backfillMaxAttempts = 3
+
+// the condition for excluding images which the backfill task keeps failing
+// to process, the task and backfillMaxAttempts are the arguments
+const backfillSkipCondition = "id NOT IN (SELECT image FROM backfill_failures WHERE task = ? AND attempts >= ?)"
+
+// record that the backfill task failed to process an image
+func BackfillFailureRecord(imageId int, task string) error {
+	_, err := DB.Exec("INSERT INTO backfill_failures(image, task, attempts, time) VALUES (?, ?, 1, ?) ON CONFLICT (image, task) DO UPDATE SET attempts = attempts + 1, time = excluded.time", imageId, task, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
+
+// remove the failures of an image, so that a replaced file is processed again
+func backfillFailureClear(tx *sql.Tx, imageId int) error {
+	_, err := tx.Exec("DELETE FROM backfill_failures WHERE image = ?", imageId)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
+
+// remove the failures of a deleted image
+func BackfillFailureDeleteByImage(imageId int) error {
+	_, err := DB.Exec("DELETE FROM backfill_failures WHERE image = ?", imageId)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
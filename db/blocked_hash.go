@@ -0,0 +1,55 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// BlockedHash is the perceptual hash of a banned image
+type BlockedHash struct {
+	Id   int
+	Hash int64
+	Note string
+	Time time.Time
+}
+
+func BlockedHashCreate(hash int64, note string) error {
+	_, err := DB.Exec("INSERT INTO blocked_hashes(hash, note, time) VALUES (?, ?, ?)", hash, note, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
+
+// find all blocked hashes, newest first
+func BlockedHashFindAll() ([]BlockedHash, error) {
+	hashes := make([]BlockedHash, 0)
+
+	rows, err := DB.Query("SELECT id, hash, note, time FROM blocked_hashes ORDER BY id DESC")
+	if err != nil {
+		return nil, fmt.Errorf("db: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var h BlockedHash
+		var timeUnix int64
+		err := rows.Scan(&h.Id, &h.Hash, &h.Note, &timeUnix)
+		if err != nil {
+			return nil, fmt.Errorf("db: %w", err)
+		}
+
+		h.Time = time.Unix(timeUnix, 0)
+		hashes = append(hashes, h)
+	}
+
+	return hashes, nil
+}
+
+func BlockedHashDelete(id int) error {
+	_, err := DB.Exec("DELETE FROM blocked_hashes WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
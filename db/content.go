@@ -0,0 +1,143 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Content is a file in a storage driver, which is shared by all images
+// with the same content
+type Content struct {
+	Id           int
+	Hash         string // sha256 hash of the file in hex
+	StorageId    int
+	InternalName string // the file name used in storage drivers
+	Size         int
+	RefCount     int // number of images using this file
+}
+
+const contentColumns = "id, hash, storage, internal_name, size, ref_count"
+
+func scanContent(row scanner) (*Content, error) {
+	var c Content
+	err := row.Scan(&c.Id, &c.Hash, &c.StorageId, &c.InternalName, &c.Size, &c.RefCount)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// create a content with one reference
+func ContentCreate(hash string, storage int, internalName string, size int) (int, error) {
+	r, err := DB.Exec("INSERT INTO contents(hash, storage, internal_name, size, ref_count) VALUES (?, ?, ?, ?, 1)", hash, storage, internalName, size)
+	if err != nil {
+		return 0, fmt.Errorf("db: %w", err)
+	}
+
+	id, err := r.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("db: %w", err)
+	}
+
+	return int(id), nil
+}
+
+// return (nil, nil) if not found
+func ContentFindByHash(hash string) (*Content, error) {
+	row := DB.QueryRow("SELECT "+contentColumns+" FROM contents WHERE hash = ?", hash)
+	c, err := scanContent(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("db: %w", err)
+	}
+	return c, nil
+}
+
+// return (nil, nil) if not found
+func ContentFindById(id int) (*Content, error) {
+	row := DB.QueryRow("SELECT "+contentColumns+" FROM contents WHERE id = ?", id)
+	c, err := scanContent(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("db: %w", err)
+	}
+	return c, nil
+}
+
+// add a reference to the content
+func ContentRef(id int) error {
+	_, err := DB.Exec("UPDATE contents SET ref_count = ref_count + 1 WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
+
+// remove a reference to the content, and delete it if there are
+// no references left
+func ContentUnref(id int) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+
+	defer tx.Rollback()
+
+	err = contentUnref(tx, id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+
+	return nil
+}
+
+func contentUnref(tx *sql.Tx, id int) error {
+	_, err := tx.Exec("UPDATE contents SET ref_count = ref_count - 1 WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+
+	_, err = tx.Exec("DELETE FROM contents WHERE id = ? AND ref_count <= 0", id)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+
+	return nil
+}
+
+// delete an image and remove its reference to the content
+func ImageDeleteWithContent(imageId int, contentId int) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM images WHERE id = ?", imageId)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+
+	err = contentUnref(tx, contentId)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+
+	return nil
+}
@@ -158,5 +158,193 @@ func migrate() {
 		DELETE FROM settings WHERE key = 'USER_MAX_TIME';
 	`)
 
+	// add personal api tokens
+	doMigration(3, 4, `
+		CREATE TABLE IF NOT EXISTS api_tokens (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user INTEGER NOT NULL REFERENCES users(id),
+			name TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			created_at INTEGER NOT NULL,
+			last_used_at INTEGER NOT NULL DEFAULT 0
+		);
+	`)
+
+	// add upload keys for screenshot tools
+	doMigration(4, 5, `
+		ALTER TABLE users ADD upload_key TEXT NOT NULL DEFAULT '';
+		CREATE UNIQUE INDEX IF NOT EXISTS users_upload_key ON users(upload_key) WHERE upload_key != '';
+	`)
+
+	// record the source url of images uploaded by url
+	doMigration(5, 6, `
+		ALTER TABLE images ADD source_url TEXT NOT NULL DEFAULT '';
+	`)
+
+	// add resumable uploads
+	doMigration(6, 7, `
+		CREATE TABLE IF NOT EXISTS partial_uploads (
+			id TEXT PRIMARY KEY,
+			uploader INTEGER REFERENCES users(id),
+			uploader_ip TEXT NOT NULL,
+			length INTEGER NOT NULL,
+			metadata TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL,
+			file_name TEXT NOT NULL DEFAULT ''
+		);
+	`)
+
+	// add content deduplication
+	doMigration(7, 8, `
+		CREATE TABLE IF NOT EXISTS contents (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			hash TEXT NOT NULL UNIQUE,
+			storage INTEGER REFERENCES storages(id),
+			internal_name TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			ref_count INTEGER NOT NULL
+		);
+		ALTER TABLE images ADD content INTEGER REFERENCES contents(id);
+	`)
+
+	// add image metadata
+	//
+	// the metadata of existing images is filled in by probing the stored
+	// files after storage drivers are initialized (services.Image.FillMetadata)
+	doMigration(8, 9, `
+		ALTER TABLE images ADD width INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE images ADD height INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE images ADD frames INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE images ADD size INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE images ADD mime_type TEXT NOT NULL DEFAULT '';
+		ALTER TABLE images ADD original_name TEXT NOT NULL DEFAULT '';
+		ALTER TABLE images ADD source_content_type TEXT NOT NULL DEFAULT '';
+	`)
+
+	// add storage quota
+	doMigration(9, 10, `
+		ALTER TABLE groups ADD max_storage_bytes INTEGER NOT NULL DEFAULT 0;
+	`)
+
+	// add deletion links
+	doMigration(10, 11, `
+		ALTER TABLE images ADD delete_token_hash TEXT NOT NULL DEFAULT '';
+	`)
+
+	// add thumbnails
+	doMigration(11, 12, `
+		ALTER TABLE images ADD thumbnail INTEGER REFERENCES contents(id);
+	`)
+
+	// add avif and webp variants
+	doMigration(12, 13, `
+		CREATE TABLE IF NOT EXISTS image_variants (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			image INTEGER NOT NULL REFERENCES images(id),
+			mime_type TEXT NOT NULL,
+			content INTEGER NOT NULL REFERENCES contents(id),
+			size INTEGER NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS image_variants_image ON image_variants(image);
+	`)
+
+	// add maximum image dimensions
+	doMigration(13, 14, `
+		ALTER TABLE groups ADD max_width INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE groups ADD max_height INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE groups ADD max_pixels INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE groups ADD downscale_oversized BOOLEAN NOT NULL DEFAULT FALSE;
+	`)
+
+	// add metadata policy
+	doMigration(14, 15, `
+		ALTER TABLE groups ADD metadata_policy TEXT NOT NULL DEFAULT 'strip';
+	`)
+
+	// add watermark opt-out
+	doMigration(15, 16, `
+		ALTER TABLE groups ADD watermark BOOLEAN NOT NULL DEFAULT TRUE;
+	`)
+
+	// add blurhash and dominant colour
+	doMigration(16, 17, `
+		ALTER TABLE images ADD blurhash TEXT NOT NULL DEFAULT '';
+		ALTER TABLE images ADD dominant_color TEXT NOT NULL DEFAULT '';
+	`)
+
+	// add perceptual hashes and the hash blocklist
+	doMigration(17, 18, `
+		ALTER TABLE images ADD phash INTEGER;
+		CREATE TABLE IF NOT EXISTS blocked_hashes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			hash INTEGER NOT NULL,
+			note TEXT NOT NULL,
+			time INTEGER NOT NULL
+		);
+	`)
+
+	// keep previous versions of replaced images
+	doMigration(18, 19, `
+		ALTER TABLE images ADD version INTEGER NOT NULL DEFAULT 1;
+		CREATE TABLE IF NOT EXISTS image_versions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			image INTEGER NOT NULL REFERENCES images(id),
+			version INTEGER NOT NULL,
+			storage INTEGER NOT NULL,
+			internal_name TEXT NOT NULL,
+			content INTEGER REFERENCES contents(id),
+			width INTEGER NOT NULL,
+			height INTEGER NOT NULL,
+			frames INTEGER NOT NULL,
+			size INTEGER NOT NULL,
+			mime_type TEXT NOT NULL,
+			blurhash TEXT NOT NULL,
+			dominant_color TEXT NOT NULL,
+			phash INTEGER,
+			time INTEGER NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS image_versions_image ON image_versions(image);
+	`)
+
+	// finish resumable uploads only once and keep their results
+	doMigration(19, 20, `
+		ALTER TABLE partial_uploads ADD finishing BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE partial_uploads ADD delete_token TEXT NOT NULL DEFAULT '';
+		ALTER TABLE partial_uploads ADD mime_type TEXT NOT NULL DEFAULT '';
+	`)
+
+	// count uploads for rate limits in a log which is not changed by
+	// deleting images, starting with the existing images
+	doMigration(20, 21, `
+		CREATE TABLE IF NOT EXISTS upload_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			uploader INTEGER REFERENCES users(id),
+			uploader_ip TEXT NOT NULL,
+			time INTEGER NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS upload_log_uploader ON upload_log(uploader, time);
+		CREATE INDEX IF NOT EXISTS upload_log_uploader_ip ON upload_log(uploader_ip, time);
+		INSERT INTO upload_log(uploader, uploader_ip, time) SELECT uploader, uploader_ip, time FROM images;
+	`)
+
+	// stop retrying images which backfill tasks fail to process
+	doMigration(21, 22, `
+		CREATE TABLE IF NOT EXISTS backfill_failures (
+			image INTEGER NOT NULL REFERENCES images(id),
+			task TEXT NOT NULL,
+			attempts INTEGER NOT NULL,
+			time INTEGER NOT NULL,
+			PRIMARY KEY (image, task)
+		);
+	`)
+
+	// reserve the rate limits of resumable uploads when they are created, and
+	// stop keeping the delete tokens of finished uploads in plain text
+	doMigration(22, 23, `
+		ALTER TABLE partial_uploads DROP delete_token;
+		ALTER TABLE partial_uploads ADD upload_log INTEGER REFERENCES upload_log(id);
+	`)
+
 	slog.Debug("database migration done")
 }
@@ -22,13 +22,33 @@ type Group struct {
 	// The number of seconds an uploaded image is kept for before it is deleted.
 	// Zero means uploaded images are stored without a time limit.
 	MaxRetentionSeconds int
+
+	// The maximum total size in bytes of images stored by a user.
+	// Zero means there is no limit.
+	MaxStorageBytes int
+
+	// The maximum width, height and number of pixels (width * height) of
+	// a frame of uploaded images. Zero means there is no limit.
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int
+
+	// Downscale images exceeding the limits instead of rejecting them
+	DownscaleOversized bool
+
+	// The metadata kept in uploaded images, which is "strip" (strip all),
+	// "icc" (keep only the icc profile) or "keep" (keep all)
+	MetadataPolicy string
+
+	// Draw the watermark on uploaded images, if the watermark is enabled
+	Watermark bool
 }
 
 // returns (nil, nil) if the group id does not exist
 func GroupFindById(id int) (*Group, error) {
 	var g Group
 
-	row := DB.QueryRow("SELECT id, name, allow_upload, max_file_size, upload_per_minute, upload_per_hour, upload_per_day, upload_per_month, total_uploads, max_retention_seconds FROM groups WHERE id = ?", id)
+	row := DB.QueryRow("SELECT id, name, allow_upload, max_file_size, upload_per_minute, upload_per_hour, upload_per_day, upload_per_month, total_uploads, max_retention_seconds, max_storage_bytes, max_width, max_height, max_pixels, downscale_oversized, metadata_policy, watermark FROM groups WHERE id = ?", id)
 
 	err := row.Scan(
 		&g.Id,
@@ -41,6 +61,13 @@ func GroupFindById(id int) (*Group, error) {
 		&g.UploadPerMonth,
 		&g.TotalUpload,
 		&g.MaxRetentionSeconds,
+		&g.MaxStorageBytes,
+		&g.MaxWidth,
+		&g.MaxHeight,
+		&g.MaxPixels,
+		&g.DownscaleOversized,
+		&g.MetadataPolicy,
+		&g.Watermark,
 	)
 
 	if err != nil {
@@ -57,7 +84,7 @@ func GroupFindAll() ([]Group, error) {
 
 	groups := make([]Group, 0)
 
-	rows, err := DB.Query("SELECT id, name, allow_upload, max_file_size, upload_per_minute, upload_per_hour, upload_per_day, upload_per_month, total_uploads, max_retention_seconds FROM groups")
+	rows, err := DB.Query("SELECT id, name, allow_upload, max_file_size, upload_per_minute, upload_per_hour, upload_per_day, upload_per_month, total_uploads, max_retention_seconds, max_storage_bytes, max_width, max_height, max_pixels, downscale_oversized, metadata_policy, watermark FROM groups")
 	if err != nil {
 		return nil, fmt.Errorf("db: %w", err)
 	}
@@ -76,6 +103,13 @@ func GroupFindAll() ([]Group, error) {
 			&g.UploadPerMonth,
 			&g.TotalUpload,
 			&g.MaxRetentionSeconds,
+			&g.MaxStorageBytes,
+			&g.MaxWidth,
+			&g.MaxHeight,
+			&g.MaxPixels,
+			&g.DownscaleOversized,
+			&g.MetadataPolicy,
+			&g.Watermark,
 		)
 
 		if err != nil {
@@ -154,8 +188,8 @@ func GroupDelete(id int) error {
 	return nil
 }
 
-func GroupEdit(id int, name string, allow_upload bool, max_file_size, upload_per_minute, upload_per_hour, upload_per_day, upload_per_month, total_uploads, max_retention_seconds int) error {
-	_, err := DB.Exec("UPDATE groups SET name = ?, allow_upload = ?, max_file_size = ?, upload_per_minute = ?, upload_per_hour = ?, upload_per_day = ?, upload_per_month = ?, total_uploads = ?, max_retention_seconds = ? WHERE id = ?", name, allow_upload, max_file_size, upload_per_minute, upload_per_hour, upload_per_day, upload_per_month, total_uploads, max_retention_seconds, id)
+func GroupEdit(id int, name string, allow_upload bool, max_file_size, upload_per_minute, upload_per_hour, upload_per_day, upload_per_month, total_uploads, max_retention_seconds, max_storage_bytes, max_width, max_height, max_pixels int, downscale_oversized bool, metadata_policy string, watermark bool) error {
+	_, err := DB.Exec("UPDATE groups SET name = ?, allow_upload = ?, max_file_size = ?, upload_per_minute = ?, upload_per_hour = ?, upload_per_day = ?, upload_per_month = ?, total_uploads = ?, max_retention_seconds = ?, max_storage_bytes = ?, max_width = ?, max_height = ?, max_pixels = ?, downscale_oversized = ?, metadata_policy = ?, watermark = ? WHERE id = ?", name, allow_upload, max_file_size, upload_per_minute, upload_per_hour, upload_per_day, upload_per_month, total_uploads, max_retention_seconds, max_storage_bytes, max_width, max_height, max_pixels, downscale_oversized, metadata_policy, watermark, id)
 	if err != nil {
 		return fmt.Errorf("db: %w", err)
 	}
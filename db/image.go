@@ -16,12 +16,81 @@ type Image struct {
 	UploaderIP   string
 	Time         time.Time
 	ExpireTime   sql.NullTime
+	SourceURL    string // the url which the image is fetched from (empty for uploaded files)
+
+	// ContentId is the stored file shared by images with the same content,
+	// which is null for images uploaded before deduplication is added
+	ContentId sql.NullInt32
+
+	// sha256 hash of the secret token in the deletion link in hex,
+	// which is empty for images uploaded before deletion links are added
+	DeleteTokenHash string
+
+	// Thumbnail is the content of the thumbnail, which is null if the
+	// thumbnail has not been generated
+	Thumbnail sql.NullInt32
+
+	// Version is incremented every time the stored file is replaced
+	Version int
+
+	ImageMetadata
+}
+
+// ImageMetadata describes the stored file of an image.
+//
+// MimeType is empty if the metadata of an image uploaded before it is
+// recorded has not been filled in yet.
+type ImageMetadata struct {
+	Width             int
+	Height            int
+	Frames            int // number of frames of animated images, or 1
+	Size              int // size of the stored file in bytes
+	MimeType          string
+	OriginalName      string        // the file name on the uploader's computer (may be empty)
+	SourceContentType string        // the content type of the uploaded file (may be empty)
+	BlurHash          string        // empty if it has not been computed
+	DominantColor     string        // #rrggbb, empty if it has not been computed
+	PHash             sql.NullInt64 // perceptual hash of the uploaded file, null if it has not been computed
+}
+
+// columns selected by scanImage
+const imageColumns = "id, storage, uploader, file_name, uploader_ip, time, expire_time, internal_name, source_url, content, width, height, frames, size, mime_type, original_name, source_content_type, delete_token_hash, thumbnail, blurhash, dominant_color, phash, version"
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scan a row which is selected with imageColumns
+func scanImage(row scanner) (*Image, error) {
+	var i Image
+	var timeUnix int64
+	var timeExpireUnix sql.NullInt64
+
+	err := row.Scan(&i.Id, &i.StorageId, &i.Uploader, &i.FileName, &i.UploaderIP, &timeUnix, &timeExpireUnix, &i.InternalName, &i.SourceURL, &i.ContentId, &i.Width, &i.Height, &i.Frames, &i.Size, &i.MimeType, &i.OriginalName, &i.SourceContentType, &i.DeleteTokenHash, &i.Thumbnail, &i.BlurHash, &i.DominantColor, &i.PHash, &i.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	i.Time = time.Unix(timeUnix, 0)
+
+	if timeExpireUnix.Valid {
+		i.ExpireTime.Valid = true
+		i.ExpireTime.Time = time.Unix(timeExpireUnix.Int64, 0)
+	}
+
+	return &i, nil
 }
 
 // expire may be nil
 //
 // uploader may be set to nil to represent guest user
-func ImageCreate(storage int, uploader sql.NullInt32, fileName string, internalName string, uploaderIP string, expire sql.NullTime) (int, error) {
+//
+// sourceURL is empty if the image is not fetched from a url
+//
+// contentId is the id of the stored file in the contents table
+//
+// deleteTokenHash is the hash of the token in the deletion link
+func ImageCreate(storage int, uploader sql.NullInt32, fileName string, internalName string, uploaderIP string, expire sql.NullTime, sourceURL string, contentId int, deleteTokenHash string, meta ImageMetadata) (int, error) {
 
 	// convert expire to unix time stamp
 	expireUnix := sql.NullInt64{}
@@ -31,7 +100,7 @@ func ImageCreate(storage int, uploader sql.NullInt32, fileName string, internalN
 		expireUnix.Int64 = expire.Time.Unix()
 	}
 
-	r, err := DB.Exec("INSERT INTO images(storage, uploader, file_name, uploader_ip, time, expire_time, internal_name) VALUES (?, ?, ?, ?, ?, ?, ?)", storage, uploader, fileName, uploaderIP, time.Now().Unix(), expireUnix, internalName)
+	r, err := DB.Exec("INSERT INTO images(storage, uploader, file_name, uploader_ip, time, expire_time, internal_name, source_url, content, width, height, frames, size, mime_type, original_name, source_content_type, delete_token_hash, blurhash, dominant_color, phash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", storage, uploader, fileName, uploaderIP, time.Now().Unix(), expireUnix, internalName, sourceURL, contentId, meta.Width, meta.Height, meta.Frames, meta.Size, meta.MimeType, meta.OriginalName, meta.SourceContentType, deleteTokenHash, meta.BlurHash, meta.DominantColor, meta.PHash)
 	if err != nil {
 		return 0, fmt.Errorf("db: %w", err)
 	}
@@ -48,12 +117,8 @@ func ImageCreate(storage int, uploader sql.NullInt32, fileName string, internalN
 //
 // return (nil, nil) if not found
 func ImageFindByFileName(fileName string) (*Image, error) {
-	var i Image
-	var timeUnix int64
-	var timeExpireUnix sql.NullInt64
-
-	row := DB.QueryRow("SELECT id, storage, uploader, file_name, uploader_ip, time, expire_time, internal_name FROM images WHERE file_name = ? AND (expire_time IS NULL OR expire_time > unixepoch()) LIMIT 1", fileName)
-	err := row.Scan(&i.Id, &i.StorageId, &i.Uploader, &i.FileName, &i.UploaderIP, &timeUnix, &timeExpireUnix, &i.InternalName)
+	row := DB.QueryRow("SELECT "+imageColumns+" FROM images WHERE file_name = ? AND (expire_time IS NULL OR expire_time > unixepoch()) LIMIT 1", fileName)
+	i, err := scanImage(row)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -61,102 +126,263 @@ func ImageFindByFileName(fileName string) (*Image, error) {
 		return nil, fmt.Errorf("db: %w", err)
 	}
 
-	i.Time = time.Unix(timeUnix, 0)
+	return i, nil
+}
 
-	if timeExpireUnix.Valid {
-		i.ExpireTime.Valid = true
-		i.ExpireTime.Time = time.Unix(timeExpireUnix.Int64, 0)
+func ImageFindExpired() ([]Image, error) {
+	images := make([]Image, 0)
+
+	rows, err := DB.Query("SELECT " + imageColumns + " FROM images WHERE expire_time IS NOT NULL AND expire_time < unixepoch()")
+	if err != nil {
+		return nil, fmt.Errorf("db: %w", err)
 	}
+	defer rows.Close()
 
-	return &i, nil
+	for rows.Next() {
+		i, err := scanImage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("db: %w", err)
+		}
+
+		images = append(images, *i)
+	}
+
+	return images, nil
 }
 
-func ImageFindExpired() ([]Image, error) {
+// find images whose metadata has not been filled in, ordered by id
+//
+// only images with an id greater than afterId are returned, and images
+// which repeatedly fail to be probed are skipped
+func ImageFindWithoutMetadata(afterId int, limit int) ([]Image, error) {
 	images := make([]Image, 0)
 
-	rows, err := DB.Query("SELECT id, storage, uploader, file_name, uploader_ip, time, expire_time, internal_name FROM images WHERE expire_time IS NOT NULL AND expire_time < unixepoch()")
+	rows, err := DB.Query("SELECT "+imageColumns+" FROM images WHERE mime_type = '' AND "+backfillSkipCondition+" AND id > ? ORDER BY id ASC LIMIT ?", BackfillMetadata, backfillMaxAttempts, afterId, limit)
 	if err != nil {
 		return nil, fmt.Errorf("db: %w", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var i Image
-		var timeUnix int64
-		var timeExpireUnix sql.NullInt64
-		err := rows.Scan(&i.Id, &i.StorageId, &i.Uploader, &i.FileName, &i.UploaderIP, &timeUnix, &timeExpireUnix, &i.InternalName)
+		i, err := scanImage(rows)
 		if err != nil {
 			return nil, fmt.Errorf("db: %w", err)
 		}
 
-		i.Time = time.Unix(timeUnix, 0)
+		images = append(images, *i)
+	}
+
+	return images, nil
+}
+
+// update the dimensions, frame count, size and mime type of an image
+func ImageSetMetadata(id int, width int, height int, frames int, size int, mimeType string) error {
+	_, err := DB.Exec("UPDATE images SET width = ?, height = ?, frames = ?, size = ?, mime_type = ? WHERE id = ?", width, height, frames, size, mimeType, id)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
+
+// find images without thumbnails, ordered by id
+//
+// images whose thumbnail repeatedly fails to be generated are skipped
+func ImageFindWithoutThumbnail(afterId int, limit int) ([]Image, error) {
+	images := make([]Image, 0)
 
-		if timeExpireUnix.Valid {
-			i.ExpireTime.Valid = true
-			i.ExpireTime.Time = time.Unix(timeExpireUnix.Int64, 0)
+	rows, err := DB.Query("SELECT "+imageColumns+" FROM images WHERE thumbnail IS NULL AND "+backfillSkipCondition+" AND id > ? ORDER BY id ASC LIMIT ?", BackfillThumbnail, backfillMaxAttempts, afterId, limit)
+	if err != nil {
+		return nil, fmt.Errorf("db: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		i, err := scanImage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("db: %w", err)
 		}
 
-		images = append(images, i)
+		images = append(images, *i)
 	}
 
 	return images, nil
 }
 
-func ImageDelete(id int) error {
-	_, err := DB.Exec("DELETE FROM images WHERE id = ?", id)
+// replace the stored file of an image, the thumbnail is removed and the
+// version is incremented
+//
+// The previous file is moved to image_versions if keepVersion is true.
+//
+// the original name and the source content type in meta are ignored
+func ImageSetContent(id int, storage int, internalName string, contentId int, meta ImageMetadata, keepVersion bool) error {
+	tx, err := DB.Begin()
 	if err != nil {
 		return fmt.Errorf("db: %w", err)
 	}
+
+	defer tx.Rollback()
+
+	if keepVersion {
+		err = imageVersionPush(tx, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE images SET storage = ?, internal_name = ?, content = ?, width = ?, height = ?, frames = ?, size = ?, mime_type = ?, blurhash = ?, dominant_color = ?, phash = ?, thumbnail = NULL, version = version + 1 WHERE id = ?", storage, internalName, contentId, meta.Width, meta.Height, meta.Frames, meta.Size, meta.MimeType, meta.BlurHash, meta.DominantColor, meta.PHash, id)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+
+	err = backfillFailureClear(tx, id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+
 	return nil
 }
 
-func ImageFindByUser(userId int, skip int, limit int) ([]Image, error) {
+// find images whose BlurHash has not been computed, ordered by id
+//
+// images whose BlurHash repeatedly fails to be computed are skipped
+func ImageFindWithoutBlurHash(afterId int, limit int) ([]Image, error) {
 	images := make([]Image, 0)
 
-	rows, err := DB.Query("SELECT id, storage, uploader, file_name, uploader_ip, time, expire_time, internal_name FROM images WHERE uploader = ? AND (expire_time IS NULL OR expire_time > unixepoch()) ORDER BY id DESC LIMIT ? OFFSET ?", userId, limit, skip)
+	rows, err := DB.Query("SELECT "+imageColumns+" FROM images WHERE blurhash = '' AND "+backfillSkipCondition+" AND id > ? ORDER BY id ASC LIMIT ?", BackfillBlurHash, backfillMaxAttempts, afterId, limit)
 	if err != nil {
 		return nil, fmt.Errorf("db: %w", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var i Image
-		var timeUnix int64
-		var timeExpireUnix sql.NullInt64
-		err := rows.Scan(&i.Id, &i.StorageId, &i.Uploader, &i.FileName, &i.UploaderIP, &timeUnix, &timeExpireUnix, &i.InternalName)
+		i, err := scanImage(rows)
 		if err != nil {
 			return nil, fmt.Errorf("db: %w", err)
 		}
 
-		i.Time = time.Unix(timeUnix, 0)
+		images = append(images, *i)
+	}
 
-		if timeExpireUnix.Valid {
-			i.ExpireTime.Valid = true
-			i.ExpireTime.Time = time.Unix(timeExpireUnix.Int64, 0)
+	return images, nil
+}
+
+// update the BlurHash and the dominant colour of an image
+func ImageSetBlurHash(id int, blurHash string, dominantColor string) error {
+	_, err := DB.Exec("UPDATE images SET blurhash = ?, dominant_color = ? WHERE id = ?", blurHash, dominantColor, id)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
+
+// find images whose perceptual hash has not been computed, ordered by id
+//
+// images whose perceptual hash repeatedly fails to be computed are skipped
+func ImageFindWithoutPHash(afterId int, limit int) ([]Image, error) {
+	images := make([]Image, 0)
+
+	rows, err := DB.Query("SELECT "+imageColumns+" FROM images WHERE phash IS NULL AND "+backfillSkipCondition+" AND id > ? ORDER BY id ASC LIMIT ?", BackfillPHash, backfillMaxAttempts, afterId, limit)
+	if err != nil {
+		return nil, fmt.Errorf("db: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		i, err := scanImage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("db: %w", err)
 		}
 
-		images = append(images, i)
+		images = append(images, *i)
 	}
 
 	return images, nil
 }
 
-// count uploaded images by a user
-func ImageCountByUser(userId int) (int, error) {
-	r := DB.QueryRow("SELECT COUNT(*) FROM images WHERE uploader = ? AND (expire_time IS NULL OR expire_time > unixepoch())", userId)
+// find unexpired images with a perceptual hash, ordered by id
+func ImageFindWithPHash(afterId int, limit int) ([]Image, error) {
+	images := make([]Image, 0)
 
-	var cnt int
-	err := r.Scan(&cnt)
+	rows, err := DB.Query("SELECT "+imageColumns+" FROM images WHERE phash IS NOT NULL AND (expire_time IS NULL OR expire_time > unixepoch()) AND id > ? ORDER BY id ASC LIMIT ?", afterId, limit)
 	if err != nil {
-		return 0, fmt.Errorf("db: %w", err)
+		return nil, fmt.Errorf("db: %w", err)
 	}
+	defer rows.Close()
 
-	return cnt, nil
+	for rows.Next() {
+		i, err := scanImage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("db: %w", err)
+		}
+
+		images = append(images, *i)
+	}
+
+	return images, nil
 }
 
-// number of images
-func ImageCountAll() (int, error) {
-	r := DB.QueryRow("SELECT COUNT(*) FROM images WHERE (expire_time IS NULL OR expire_time > unixepoch())")
+func ImageSetPHash(id int, phash int64) error {
+	_, err := DB.Exec("UPDATE images SET phash = ? WHERE id = ?", phash, id)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
+
+// set the thumbnail of an image if it does not have one
+//
+// return false if the image is not found or already has a thumbnail
+func ImageSetThumbnail(id int, contentId int) (bool, error) {
+	r, err := DB.Exec("UPDATE images SET thumbnail = ? WHERE id = ? AND thumbnail IS NULL", contentId, id)
+	if err != nil {
+		return false, fmt.Errorf("db: %w", err)
+	}
+
+	n, err := r.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("db: %w", err)
+	}
+
+	return n == 1, nil
+}
+
+func ImageDelete(id int) error {
+	_, err := DB.Exec("DELETE FROM images WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
+
+func ImageFindByUser(userId int, skip int, limit int) ([]Image, error) {
+	images := make([]Image, 0)
+
+	rows, err := DB.Query("SELECT "+imageColumns+" FROM images WHERE uploader = ? AND (expire_time IS NULL OR expire_time > unixepoch()) ORDER BY id DESC LIMIT ? OFFSET ?", userId, limit, skip)
+	if err != nil {
+		return nil, fmt.Errorf("db: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		i, err := scanImage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("db: %w", err)
+		}
+
+		images = append(images, *i)
+	}
+
+	return images, nil
+}
+
+// count uploaded images by a user
+func ImageCountByUser(userId int) (int, error) {
+	r := DB.QueryRow("SELECT COUNT(*) FROM images WHERE uploader = ? AND (expire_time IS NULL OR expire_time > unixepoch())", userId)
 
 	var cnt int
 	err := r.Scan(&cnt)
@@ -167,9 +393,9 @@ func ImageCountAll() (int, error) {
 	return cnt, nil
 }
 
-// count the number of images in a storage driver
-func ImageCountByStorage(id int) (int, error) {
-	r := DB.QueryRow("SELECT COUNT(*) FROM images WHERE storage = ?", id)
+// number of images
+func ImageCountAll() (int, error) {
+	r := DB.QueryRow("SELECT COUNT(*) FROM images WHERE (expire_time IS NULL OR expire_time > unixepoch())")
 
 	var cnt int
 	err := r.Scan(&cnt)
@@ -183,30 +409,48 @@ func ImageCountByStorage(id int) (int, error) {
 func ImageFindAll(skip int, limit int) ([]Image, error) {
 	images := make([]Image, 0)
 
-	rows, err := DB.Query("SELECT id, storage, uploader, file_name, uploader_ip, time, expire_time, internal_name FROM images WHERE (expire_time IS NULL OR expire_time > unixepoch()) ORDER BY id DESC LIMIT ? OFFSET ?", limit, skip)
+	rows, err := DB.Query("SELECT "+imageColumns+" FROM images WHERE (expire_time IS NULL OR expire_time > unixepoch()) ORDER BY id DESC LIMIT ? OFFSET ?", limit, skip)
 	if err != nil {
 		return nil, fmt.Errorf("db: %w", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var i Image
-		var timeUnix int64
-		var timeExpireUnix sql.NullInt64
-		err := rows.Scan(&i.Id, &i.StorageId, &i.Uploader, &i.FileName, &i.UploaderIP, &timeUnix, &timeExpireUnix, &i.InternalName)
+		i, err := scanImage(rows)
 		if err != nil {
 			return nil, fmt.Errorf("db: %w", err)
 		}
 
-		i.Time = time.Unix(timeUnix, 0)
+		images = append(images, *i)
+	}
 
-		if timeExpireUnix.Valid {
-			i.ExpireTime.Valid = true
-			i.ExpireTime.Time = time.Unix(timeExpireUnix.Int64, 0)
-		}
+	return images, nil
+}
 
-		images = append(images, i)
+// the condition for matching images or upload_log rows uploaded by a user,
+// or by a guest from ipAddr if uploader is nil
+func imageUploaderCondition(uploader sql.NullInt32, ipAddr string) (string, []any) {
+	if uploader.Valid {
+		return "uploader = ?", []any{uploader.Int32}
 	}
+	return "uploader IS NULL AND uploader_ip = ?", []any{ipAddr}
+}
 
-	return images, nil
+// total size of unexpired images uploaded by a user, including their
+// previous versions
+//
+// uploader may be set to nil to count images uploaded by guests from ipAddr
+func ImageSumSize(uploader sql.NullInt32, ipAddr string) (int, error) {
+	cond, args := imageUploaderCondition(uploader, ipAddr)
+
+	// previous versions of the images are counted
+	r := DB.QueryRow("SELECT (SELECT COALESCE(SUM(size), 0) FROM images WHERE "+cond+" AND (expire_time IS NULL OR expire_time > unixepoch())) + (SELECT COALESCE(SUM(size), 0) FROM image_versions WHERE image IN (SELECT id FROM images WHERE "+cond+" AND (expire_time IS NULL OR expire_time > unixepoch())))", append(args, args...)...)
+
+	var size int
+	err := r.Scan(&size)
+	if err != nil {
+		return 0, fmt.Errorf("db: %w", err)
+	}
+
+	return size, nil
 }
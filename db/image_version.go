@@ -0,0 +1,146 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ImageVersion is a previous stored file of an image, which is kept after
+// the image is replaced and can be restored
+type ImageVersion struct {
+	Id           int
+	ImageId      int
+	Version      int // the version of the image when the file was current
+	StorageId    int
+	InternalName string
+	Time         time.Time // when the file was replaced
+
+	// ContentId is null for files stored before deduplication is added
+	ContentId sql.NullInt32
+
+	// the original name and the source content type are not kept
+	ImageMetadata
+}
+
+const imageVersionColumns = "id, image, version, storage, internal_name, content, width, height, frames, size, mime_type, blurhash, dominant_color, phash, time"
+
+func scanImageVersion(row scanner) (*ImageVersion, error) {
+	var v ImageVersion
+	var timeUnix int64
+
+	err := row.Scan(&v.Id, &v.ImageId, &v.Version, &v.StorageId, &v.InternalName, &v.ContentId, &v.Width, &v.Height, &v.Frames, &v.Size, &v.MimeType, &v.BlurHash, &v.DominantColor, &v.PHash, &timeUnix)
+	if err != nil {
+		return nil, err
+	}
+
+	v.Time = time.Unix(timeUnix, 0)
+
+	return &v, nil
+}
+
+// copy the current file of an image to image_versions, the reference to
+// the content is moved along with it
+func imageVersionPush(tx *sql.Tx, imageId int) error {
+	_, err := tx.Exec("INSERT INTO image_versions(image, version, storage, internal_name, content, width, height, frames, size, mime_type, blurhash, dominant_color, phash, time) SELECT id, version, storage, internal_name, content, width, height, frames, size, mime_type, blurhash, dominant_color, phash, unixepoch() FROM images WHERE id = ?", imageId)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
+
+// find the previous versions of an image, newest first
+func ImageVersionFindByImage(imageId int) ([]ImageVersion, error) {
+	versions := make([]ImageVersion, 0)
+
+	rows, err := DB.Query("SELECT "+imageVersionColumns+" FROM image_versions WHERE image = ? ORDER BY version DESC", imageId)
+	if err != nil {
+		return nil, fmt.Errorf("db: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		v, err := scanImageVersion(rows)
+		if err != nil {
+			return nil, fmt.Errorf("db: %w", err)
+		}
+
+		versions = append(versions, *v)
+	}
+
+	return versions, nil
+}
+
+// return (nil, nil) if not found
+func ImageVersionFindById(id int) (*ImageVersion, error) {
+	row := DB.QueryRow("SELECT "+imageVersionColumns+" FROM image_versions WHERE id = ?", id)
+	v, err := scanImageVersion(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("db: %w", err)
+	}
+	return v, nil
+}
+
+// delete a version, the reference to its content is not removed
+func ImageVersionDelete(id int) error {
+	_, err := DB.Exec("DELETE FROM image_versions WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
+
+// make a previous version the current file of an image with a new version
+// number, and move the current file to image_versions. The thumbnail is
+// removed.
+//
+// return false if the version of the image is not found
+func ImageVersionRestore(imageId int, versionId int) (bool, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return false, fmt.Errorf("db: %w", err)
+	}
+
+	defer tx.Rollback()
+
+	var cnt int
+	err = tx.QueryRow("SELECT COUNT(*) FROM image_versions WHERE id = ? AND image = ?", versionId, imageId).Scan(&cnt)
+	if err != nil {
+		return false, fmt.Errorf("db: %w", err)
+	}
+
+	if cnt == 0 {
+		return false, nil
+	}
+
+	err = imageVersionPush(tx, imageId)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec("UPDATE images SET (storage, internal_name, content, width, height, frames, size, mime_type, blurhash, dominant_color, phash) = (SELECT storage, internal_name, content, width, height, frames, size, mime_type, blurhash, dominant_color, phash FROM image_versions WHERE id = ?), thumbnail = NULL, version = version + 1 WHERE id = ?", versionId, imageId)
+	if err != nil {
+		return false, fmt.Errorf("db: %w", err)
+	}
+
+	_, err = tx.Exec("DELETE FROM image_versions WHERE id = ?", versionId)
+	if err != nil {
+		return false, fmt.Errorf("db: %w", err)
+	}
+
+	err = backfillFailureClear(tx, imageId)
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("db: %w", err)
+	}
+
+	return true, nil
+}
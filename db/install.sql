@@ -71,6 +71,21 @@ INSERT OR IGNORE INTO settings(key, value) VALUES('GITHUB_SECRET', '');
 
 INSERT OR IGNORE INTO settings(key, value) VALUES('AVIF_ENCODING', 'true');
 INSERT OR IGNORE INTO settings(key, value) VALUES('WEBP_ENCODING', 'true');
+INSERT OR IGNORE INTO settings(key, value) VALUES('JXL_ENCODING', 'true');
+INSERT OR IGNORE INTO settings(key, value) VALUES('TRANSFORM_PRESETS', '');
+INSERT OR IGNORE INTO settings(key, value) VALUES('STORE_VARIANTS', 'false');
+INSERT OR IGNORE INTO settings(key, value) VALUES('AUTO_FORMAT_MIN_SSIM', '0');
+INSERT OR IGNORE INTO settings(key, value) VALUES('AUTO_FORMAT_TIME_BUDGET', '5000');
+INSERT OR IGNORE INTO settings(key, value) VALUES('PHASH_BLOCK_DISTANCE', '4');
+INSERT OR IGNORE INTO settings(key, value) VALUES('IMAGE_VERSIONS_KEPT', '5');
+INSERT OR IGNORE INTO settings(key, value) VALUES('ALLOWED_INPUT_TYPES', 'image/png,image/jpeg,image/gif,image/webp,image/avif,image/heic,image/heif,image/jxl,image/tiff,image/svg+xml,application/pdf');
+
+INSERT OR IGNORE INTO settings(key, value) VALUES('WATERMARK', 'none');
+INSERT OR IGNORE INTO settings(key, value) VALUES('WATERMARK_TEXT', '');
+INSERT OR IGNORE INTO settings(key, value) VALUES('WATERMARK_IMAGE', '');
+INSERT OR IGNORE INTO settings(key, value) VALUES('WATERMARK_POSITION', 'bottom-right');
+INSERT OR IGNORE INTO settings(key, value) VALUES('WATERMARK_OPACITY', '50');
+INSERT OR IGNORE INTO settings(key, value) VALUES('WATERMARK_SCALE', '20');
 
 INSERT OR IGNORE INTO settings(key, value) VALUES('LANGUAGE', 'en_us');
 
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PartialUpload is a resumable upload (tus protocol) which is being
+// staged on local disk
+type PartialUpload struct {
+	Id         string
+	Uploader   sql.NullInt32
+	UploaderIP string
+	Length     int    // the total size of the upload in bytes
+	Metadata   string // raw Upload-Metadata header
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	Finishing  bool   // all bytes are received and the image is being saved
+	FileName   string // the file name of the image after the upload is finished
+	MimeType   string // the mime type of the image after the upload is finished
+
+	// the record in upload_log reserved when the upload is created, which
+	// counts towards the rate limits
+	UploadLog sql.NullInt32
+}
+
+func PartialUploadCreate(id string, uploader sql.NullInt32, uploaderIP string, length int, metadata string, uploadLog int) error {
+	now := time.Now().Unix()
+	_, err := DB.Exec("INSERT INTO partial_uploads(id, uploader, uploader_ip, length, metadata, created_at, updated_at, upload_log) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", id, uploader, uploaderIP, length, metadata, now, now, uploadLog)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
+
+// return (nil, nil) if not found
+func PartialUploadFindById(id string) (*PartialUpload, error) {
+	var p PartialUpload
+	var createdAt int64
+	var updatedAt int64
+
+	row := DB.QueryRow("SELECT id, uploader, uploader_ip, length, metadata, created_at, updated_at, finishing, file_name, mime_type, upload_log FROM partial_uploads WHERE id = ? LIMIT 1", id)
+	err := row.Scan(&p.Id, &p.Uploader, &p.UploaderIP, &p.Length, &p.Metadata, &createdAt, &updatedAt, &p.Finishing, &p.FileName, &p.MimeType, &p.UploadLog)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("db: %w", err)
+	}
+
+	p.CreatedAt = time.Unix(createdAt, 0)
+	p.UpdatedAt = time.Unix(updatedAt, 0)
+
+	return &p, nil
+}
+
+// find ids of uploads which have not been updated since t
+func PartialUploadFindStale(t time.Time) ([]string, error) {
+	ids := make([]string, 0)
+
+	rows, err := DB.Query("SELECT id FROM partial_uploads WHERE updated_at < ?", t.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("db: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, fmt.Errorf("db: %w", err)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func PartialUploadTouch(id string) error {
+	_, err := DB.Exec("UPDATE partial_uploads SET updated_at = ? WHERE id = ?", time.Now().Unix(), id)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
+
+// mark the upload as being finished
+//
+// return false if it is already marked
+func PartialUploadSetFinishing(id string) (bool, error) {
+	r, err := DB.Exec("UPDATE partial_uploads SET finishing = TRUE, updated_at = ? WHERE id = ? AND NOT finishing", time.Now().Unix(), id)
+	if err != nil {
+		return false, fmt.Errorf("db: %w", err)
+	}
+
+	n, err := r.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("db: %w", err)
+	}
+
+	return n == 1, nil
+}
+
+func PartialUploadSetResult(id string, fileName string, mimeType string) error {
+	_, err := DB.Exec("UPDATE partial_uploads SET file_name = ?, mime_type = ?, updated_at = ? WHERE id = ?", fileName, mimeType, time.Now().Unix(), id)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
+
+// count the uploads of a user which are not finished, and sum their lengths
+//
+// uploader may be set to nil to count uploads by guests from ipAddr
+func PartialUploadCountOpen(uploader sql.NullInt32, ipAddr string) (int, int, error) {
+	cond, args := imageUploaderCondition(uploader, ipAddr)
+
+	r := DB.QueryRow("SELECT COUNT(*), COALESCE(SUM(length), 0) FROM partial_uploads WHERE "+cond+" AND file_name = ''", args...)
+
+	var cnt, size int
+	err := r.Scan(&cnt, &size)
+	if err != nil {
+		return 0, 0, fmt.Errorf("db: %w", err)
+	}
+
+	return cnt, size, nil
+}
+
+func PartialUploadDelete(id string) error {
+	_, err := DB.Exec("DELETE FROM partial_uploads WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
@@ -70,6 +70,24 @@ func StorageUpdate(id int, enabled bool, allowUpload bool, config string) error
 	return nil
 }
 
+// counts the rows referencing files in a storage driver, which are images
+// uploaded before deduplication, contents (including thumbnails and
+// variants) and previous versions of images
+const storageCountFilesQuery = "SELECT (SELECT COUNT(*) FROM images WHERE storage = ?1) + (SELECT COUNT(*) FROM contents WHERE storage = ?1) + (SELECT COUNT(*) FROM image_versions WHERE storage = ?1)"
+
+// count the files stored in a storage driver
+func StorageCountFiles(id int) (int, error) {
+	r := DB.QueryRow(storageCountFilesQuery, id)
+
+	var cnt int
+	err := r.Scan(&cnt)
+	if err != nil {
+		return 0, fmt.Errorf("db: %w", err)
+	}
+
+	return cnt, nil
+}
+
 func StorageDelete(id int) error {
 	tx, err := DB.Begin()
 	if err != nil {
@@ -79,7 +97,7 @@ func StorageDelete(id int) error {
 	defer tx.Rollback()
 
 	// check whether the storage driver is empty
-	r := tx.QueryRow("SELECT COUNT(*) FROM images WHERE storage = ?", id)
+	r := tx.QueryRow(storageCountFilesQuery, id)
 
 	var cnt int
 	err = r.Scan(&cnt)
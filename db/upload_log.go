@@ -0,0 +1,69 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// record an upload, which counts towards the rate limits even if the image
+// is deleted
+//
+// return the id of the record
+func UploadLogCreate(uploader sql.NullInt32, uploaderIP string) (int, error) {
+	r, err := DB.Exec("INSERT INTO upload_log(uploader, uploader_ip, time) VALUES (?, ?, ?)", uploader, uploaderIP, time.Now().Unix())
+	if err != nil {
+		return 0, fmt.Errorf("db: %w", err)
+	}
+
+	id, err := r.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("db: %w", err)
+	}
+
+	return int(id), nil
+}
+
+func UploadLogDelete(id int) error {
+	_, err := DB.Exec("DELETE FROM upload_log WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
+
+// count uploads after since
+//
+// uploader may be set to nil to count uploads by guests from ipAddr
+func UploadLogCountSince(uploader sql.NullInt32, ipAddr string, since time.Time) (int, error) {
+	cond, args := imageUploaderCondition(uploader, ipAddr)
+	args = append(args, since.Unix())
+
+	r := DB.QueryRow("SELECT COUNT(*) FROM upload_log WHERE "+cond+" AND time > ?", args...)
+
+	var cnt int
+	err := r.Scan(&cnt)
+	if err != nil {
+		return 0, fmt.Errorf("db: %w", err)
+	}
+
+	return cnt, nil
+}
+
+// find the time of the n-th (starting from 0) oldest upload after since
+//
+// uploader may be set to nil to find uploads by guests from ipAddr
+func UploadLogFindTimeSince(uploader sql.NullInt32, ipAddr string, since time.Time, n int) (time.Time, error) {
+	cond, args := imageUploaderCondition(uploader, ipAddr)
+	args = append(args, since.Unix(), n)
+
+	r := DB.QueryRow("SELECT time FROM upload_log WHERE "+cond+" AND time > ? ORDER BY time ASC LIMIT 1 OFFSET ?", args...)
+
+	var timeUnix int64
+	err := r.Scan(&timeUnix)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("db: %w", err)
+	}
+
+	return time.Unix(timeUnix, 0), nil
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 )
@@ -194,3 +195,43 @@ func UserResetExpiredGroup(id int) error {
 	}
 	return nil
 }
+
+// find a user by upload key
+//
+// return (nil, nil) if not found
+func UserFindByUploadKey(key string) (*User, error) {
+	row := DB.QueryRow("SELECT id FROM users WHERE upload_key = ? AND upload_key != '' LIMIT 1", key)
+
+	var id int
+	err := row.Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("db: %w", err)
+	}
+
+	return UserFindById(id)
+}
+
+// return an empty string if the upload key is not generated
+func UserFindUploadKey(id int) (string, error) {
+	row := DB.QueryRow("SELECT upload_key FROM users WHERE id = ?", id)
+
+	var key string
+	err := row.Scan(&key)
+	if err != nil {
+		return "", fmt.Errorf("db: %w", err)
+	}
+
+	return key, nil
+}
+
+// set key to an empty string to revoke the upload key
+func UserChangeUploadKey(id int, key string) error {
+	_, err := DB.Exec("UPDATE users SET upload_key = ? WHERE id = ?", key, id)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"fmt"
+)
+
+// ImageVariant is an alternative encoding of an image, which is served to
+// clients accepting its format
+type ImageVariant struct {
+	Id        int
+	ImageId   int
+	MimeType  string
+	ContentId int
+	Size      int
+
+	// the stored file in the contents table
+	StorageId    int
+	InternalName string
+}
+
+func ImageVariantCreate(imageId int, mimeType string, contentId int, size int) error {
+	_, err := DB.Exec("INSERT INTO image_variants(image, mime_type, content, size) VALUES (?, ?, ?, ?)", imageId, mimeType, contentId, size)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
+
+// find all variants of an image, ordered by size
+func ImageVariantFindByImage(imageId int) ([]ImageVariant, error) {
+	variants := make([]ImageVariant, 0)
+
+	rows, err := DB.Query("SELECT v.id, v.image, v.mime_type, v.content, v.size, c.storage, c.internal_name FROM image_variants v JOIN contents c ON v.content = c.id WHERE v.image = ? ORDER BY v.size ASC", imageId)
+	if err != nil {
+		return nil, fmt.Errorf("db: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v ImageVariant
+		err := rows.Scan(&v.Id, &v.ImageId, &v.MimeType, &v.ContentId, &v.Size, &v.StorageId, &v.InternalName)
+		if err != nil {
+			return nil, fmt.Errorf("db: %w", err)
+		}
+
+		variants = append(variants, v)
+	}
+
+	return variants, nil
+}
+
+func ImageVariantDelete(id int) error {
+	_, err := DB.Exec("DELETE FROM image_variants WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package libvips
+
+// the mime types of formats whose pages are the frames of an animation,
+// other multi-page formats are documents, e.g. pdf and tiff
+var animationTypes = map[string]bool{
+	"image/gif":  true,
+	"image/webp": true,
+	"image/avif": true,
+	"image/jxl":  true,
+}
+
+// the number of frames of an image of the mime type with the number of
+// pages, timed is whether the image has animation metadata
+//
+// documents and heif collections are still images, only the first page of
+// which is kept
+func animationFrames(mimeType string, pages int, timed bool) int {
+	if pages > 1 && (animationTypes[mimeType] || timed) {
+		return pages
+	}
+	return 1
+}
@@ -0,0 +1,32 @@
+package libvips
+
+import "testing"
+
+func TestAnimationFrames(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		pages    int
+		timed    bool
+		want     int
+	}{
+		{"still image", "image/png", 1, false, 1},
+		{"animated gif", "image/gif", 10, true, 10},
+		{"animated webp", "image/webp", 5, false, 5},
+		{"single frame gif", "image/gif", 1, true, 1},
+		{"multi-page pdf", "application/pdf", 12, false, 1},
+		{"multi-page tiff", "image/tiff", 3, false, 1},
+		{"heic collection", "image/heic", 2, false, 1},
+		{"heic sequence", "image/heic", 24, true, 24},
+		{"unknown type", "", 4, false, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := animationFrames(tt.mimeType, tt.pages, tt.timed)
+			if got != tt.want {
+				t.Errorf("animationFrames(%q, %d, %v) = %d, want %d", tt.mimeType, tt.pages, tt.timed, got, tt.want)
+			}
+		})
+	}
+}
@@ -2,9 +2,12 @@ package libvips
 
 /*
 #cgo pkg-config: vips libheif
+#cgo LDFLAGS: -lm
 #include <libheif/heif.h>
 #include "vips/vips.h"
+#include <math.h>
 #include <stdio.h>
+#include <string.h>
 
 #ifdef __APPLE__
 	#include <stdlib.h>
@@ -12,9 +15,33 @@ package libvips
 	#include <malloc.h>
 #endif
 
-void libvips_error() {
-	printf("libvips: error: %s\n", vips_error_buffer());
-	vips_error_clear();
+// Functions called from go return -1 if the image can not be loaded, -2 if
+// it can not be processed or encoded, -3 if the deadline is exceeded, -4 if
+// the format of the image is unknown, and -5 if the image has too many
+// pixels. The errors of failed functions are moved from the vips error
+// buffer to the calling thread, see libvips_take_error.
+
+// the vips error buffer of the last failed function on this thread
+static __thread char* libvips_thread_error = NULL;
+
+// The vips error buffer is shared by all threads, so the errors of a failed
+// function are moved to the calling thread as soon as it returns, before
+// they are mixed up with the errors of later jobs.
+static int libvips_capture_error(int ret) {
+	if (ret) {
+		g_free(libvips_thread_error);
+		libvips_thread_error = vips_error_buffer_copy();
+		vips_error_clear();
+	}
+	return ret;
+}
+
+// return the errors of the last failed function on this thread, which must
+// be freed with g_free, or NULL
+char* libvips_take_error() {
+	char* e = libvips_thread_error;
+	libvips_thread_error = NULL;
+	return e;
 }
 
 void libipvs_malloc_trim() {
@@ -25,14 +52,60 @@ void libipvs_malloc_trim() {
 
 int libvips_init() {
 	if (VIPS_INIT("")) {
-		libvips_error();
-		return -1;
+		return libvips_capture_error(-1);
 	}
 	vips_leak_set(TRUE);
+	// cached operations would keep decoded images in memory
 	vips_cache_set_max(0);
+	vips_cache_set_max_mem(0);
+	return 0;
+}
+
+// the maximum number of pixels of an image including all frames, which is
+// checked before the image is decoded, 0 means no limit
+static guint64 libvips_max_pixels = 0;
+
+void libvips_set_max_pixels(long long n) {
+	libvips_max_pixels = n > 0 ? n : 0;
+}
+
+// check the format of the image in buf, and its size against
+// libvips_max_pixels. Only the header of the image is read.
+static int libvips_check_input(char* buf, int len, int animated) {
+	if (!vips_foreign_find_load_buffer(buf, len)) {
+		return -4;
+	}
+
+	if (!libvips_max_pixels) {
+		return 0;
+	}
+
+	VipsImage* img;
+	if (animated) {
+		img = vips_image_new_from_buffer(buf, len, "", "n", -1, NULL);
+	} else {
+		img = vips_image_new_from_buffer(buf, len, "", NULL);
+	}
+	if (!img) {
+		return -1;
+	}
+
+	guint64 pixels = (guint64)vips_image_get_width(img) * vips_image_get_height(img);
+	g_object_unref(img);
+
+	if (pixels > libvips_max_pixels) {
+		vips_error("libvips", "too many pixels: %" G_GUINT64_FORMAT, pixels);
+		return -5;
+	}
+
 	return 0;
 }
 
+// whether libvips has the operation, e.g. "jxlsave_buffer"
+int libvips_has_operation(char* name) {
+	return vips_type_find("VipsOperation", name) != 0;
+}
+
 const char* libvips_version() {
 	return vips_version_string();
 }
@@ -51,29 +124,341 @@ int linear_interp(int min, int max, int n){
 	return res;
 }
 
-int libvips_encode(
-	char* buf,
-	int len,
+// whether the metadata field is removed by libvips_prepare
+static int libvips_is_stripped_field(const char* name, int keep_icc) {
+	const char* prefixes[] = {"exif-", "xmp-", "iptc-", "photoshop-", "png-comment-", "gif-comment"};
+
+	for (int i = 0; i < sizeof(prefixes) / sizeof(prefixes[0]); i++) {
+		if (vips_isprefix(prefixes[i], name)) {
+			return 1;
+		}
+	}
+
+	return !keep_icc && strcmp(name, VIPS_META_ICC_NAME) == 0;
+}
+
+// auto-rotate, convert to sRGB and remove metadata before saving
+//
+// metadata: 0 strips all metadata, 1 keeps only the icc profile, 2 keeps all metadata
+//
+// *img is replaced by the prepared image
+int libvips_prepare(VipsImage** img, int animated, int metadata) {
+	VipsImage* t;
+
+	// the frames of animated images are stacked vertically, which can not be rotated as a whole
+	if (!animated) {
+		if (vips_autorot(*img, &t, NULL)) {
+			return -1;
+		}
+		g_object_unref(*img);
+		*img = t;
+	}
+
+	if (vips_image_get_typeof(*img, VIPS_META_ICC_NAME)) {
+		int depth = (*img)->BandFmt == VIPS_FORMAT_USHORT ? 16 : 8;
+		if (vips_icc_transform(*img, &t, "srgb", "embedded", TRUE, "intent", VIPS_INTENT_PERCEPTUAL, "depth", depth, NULL)) {
+			return -1;
+		}
+		g_object_unref(*img);
+		*img = t;
+	} else {
+		// images without profiles, e.g. CMYK jpegs
+		VipsInterpretation interpretation = vips_image_guess_interpretation(*img);
+		if (interpretation != VIPS_INTERPRETATION_sRGB && interpretation != VIPS_INTERPRETATION_B_W &&
+			interpretation != VIPS_INTERPRETATION_RGB16 && interpretation != VIPS_INTERPRETATION_GREY16) {
+			if (vips_colourspace(*img, &t, VIPS_INTERPRETATION_sRGB, NULL)) {
+				return -1;
+			}
+			g_object_unref(*img);
+			*img = t;
+		}
+	}
+
+	if (metadata >= 2) {
+		return 0;
+	}
+
+	// the metadata of the copy can be changed without affecting the source
+	if (vips_copy(*img, &t, NULL)) {
+		return -1;
+	}
+	g_object_unref(*img);
+	*img = t;
+
+	gchar** fields = vips_image_get_fields(*img);
+	for (int i = 0; fields[i]; i++) {
+		if (libvips_is_stripped_field(fields[i], metadata == 1)) {
+			vips_image_remove(*img, fields[i]);
+		}
+	}
+	g_strfreev(fields);
+
+	return 0;
+}
+
+typedef struct {
+	char* text;       // either text or image is set
+	void* image;      // png
+	int image_len;
+	int position;     // 0 top left, 1 top right, 2 bottom left, 3 bottom right, 4 center
+	int opacity;      // [0,100]
+	int scale;        // width of the watermark in percent of the image width
+} libvips_watermark;
+
+// create the RGBA overlay of a watermark which is width pixels wide
+static int libvips_watermark_overlay(libvips_watermark* wm, int width, int max_height, VipsImage** out) {
+	VipsImage* overlay;
+	VipsImage* t;
+
+	if (wm->text) {
+		// vips_text renders pango markup
+		char* escaped = g_markup_escape_text(wm->text, -1);
+		VipsImage* mask;
+		int err = vips_text(&mask, escaped, "dpi", 300, NULL);
+		g_free(escaped);
+		if (err) {
+			return -1;
+		}
+
+		// white text, the mask is the alpha channel
+		VipsImage* white;
+		if (vips_linear1(mask, &white, 0, 255, "uchar", TRUE, NULL)) {
+			g_object_unref(mask);
+			return -1;
+		}
+
+		VipsImage* bands[] = {white, white, white, mask};
+		err = vips_bandjoin(bands, &t, 4, NULL);
+		g_object_unref(white);
+		g_object_unref(mask);
+		if (err) {
+			return -1;
+		}
+		overlay = t;
+	} else {
+		overlay = vips_image_new_from_buffer(wm->image, wm->image_len, "", NULL);
+		if (!overlay) {
+			return -1;
+		}
+
+		if (vips_colourspace(overlay, &t, VIPS_INTERPRETATION_sRGB, NULL)) {
+			g_object_unref(overlay);
+			return -1;
+		}
+		g_object_unref(overlay);
+		overlay = t;
+
+		if (!vips_image_hasalpha(overlay)) {
+			if (vips_bandjoin_const1(overlay, &t, 255, NULL)) {
+				g_object_unref(overlay);
+				return -1;
+			}
+			g_object_unref(overlay);
+			overlay = t;
+		}
+	}
+
+	if (vips_copy(overlay, &t, "interpretation", VIPS_INTERPRETATION_sRGB, NULL)) {
+		g_object_unref(overlay);
+		return -1;
+	}
+	g_object_unref(overlay);
+	overlay = t;
+
+	double scale = (double)width / vips_image_get_width(overlay);
+	if (vips_image_get_height(overlay) * scale > max_height) {
+		scale = (double)max_height / vips_image_get_height(overlay);
+	}
+	if (vips_resize(overlay, &t, scale, NULL)) {
+		g_object_unref(overlay);
+		return -1;
+	}
+	g_object_unref(overlay);
+	overlay = t;
+
+	double a[] = {1, 1, 1, wm->opacity / 100.0};
+	double b[] = {0, 0, 0, 0};
+	if (vips_linear(overlay, &t, a, b, 4, "uchar", TRUE, NULL)) {
+		g_object_unref(overlay);
+		return -1;
+	}
+	g_object_unref(overlay);
+
+	*out = t;
+	return 0;
+}
+
+// draw the watermark on every frame of *img, which is replaced by the result
+int libvips_apply_watermark(VipsImage** img, libvips_watermark* wm) {
+	int width = vips_image_get_width(*img);
+	int page_height = vips_image_get_page_height(*img);
+	int n_pages = vips_image_get_height(*img) / page_height;
+
+	VipsImage* overlay;
+	if (libvips_watermark_overlay(wm, VIPS_MAX(1, width * wm->scale / 100), page_height, &overlay)) {
+		return -1;
+	}
+
+	int ow = vips_image_get_width(overlay);
+	int oh = vips_image_get_height(overlay);
+	int margin = VIPS_MIN(width, page_height) / 50;
+
+	int x, y;
+	switch (wm->position) {
+	case 0: x = margin; y = margin; break;
+	case 1: x = width - ow - margin; y = margin; break;
+	case 2: x = margin; y = page_height - oh - margin; break;
+	case 4: x = (width - ow) / 2; y = (page_height - oh) / 2; break;
+	default: x = width - ow - margin; y = page_height - oh - margin; break;
+	}
+
+	// the frames of animated images are stacked vertically
+	VipsImage** in = g_new(VipsImage*, n_pages + 1);
+	int* modes = g_new(int, n_pages);
+	int* xs = g_new(int, n_pages);
+	int* ys = g_new(int, n_pages);
+
+	in[0] = *img;
+	for (int i = 0; i < n_pages; i++) {
+		in[i + 1] = overlay;
+		modes[i] = VIPS_BLEND_MODE_OVER;
+		xs[i] = x;
+		ys[i] = y + i * page_height;
+	}
+
+	VipsArrayInt* x_array = vips_array_int_new(xs, n_pages);
+	VipsArrayInt* y_array = vips_array_int_new(ys, n_pages);
+
+	int had_alpha = vips_image_hasalpha(*img);
+
+	VipsImage* t;
+	int err = vips_composite(in, &t, n_pages + 1, modes, "x", x_array, "y", y_array, NULL);
+
+	vips_area_unref(VIPS_AREA(x_array));
+	vips_area_unref(VIPS_AREA(y_array));
+	g_free(in);
+	g_free(modes);
+	g_free(xs);
+	g_free(ys);
+	g_object_unref(overlay);
+
+	if (err) {
+		return -1;
+	}
+
+	g_object_unref(*img);
+	*img = t;
+
+	// the alpha channel is added by compositing
+	if (!had_alpha && vips_image_hasalpha(*img)) {
+		if (vips_extract_band(*img, &t, 0, "n", vips_image_get_bands(*img) - 1, NULL)) {
+			return -1;
+		}
+		g_object_unref(*img);
+		*img = t;
+	}
+
+	return 0;
+}
+
+#define LIBVIPS_MAX_INPUTS 4
+
+// the evaluation of an image is killed after the deadline
+typedef struct {
+	gint64 deadline; // in g_get_monotonic_time, or 0 if there is no deadline
+	int killed;
+
+	// the images watched until the deadline is released, see libvips_watch_input
+	int n_inputs;
+	VipsImage* inputs[LIBVIPS_MAX_INPUTS];
+	gulong handlers[LIBVIPS_MAX_INPUTS];
+} libvips_deadline;
+
+// a deadline timeout_ms milliseconds from now, 0 means no deadline
+libvips_deadline libvips_deadline_after(int timeout_ms) {
+	libvips_deadline d = {0};
+	if (timeout_ms > 0) {
+		d.deadline = g_get_monotonic_time() + (gint64)timeout_ms * 1000;
+	}
+	return d;
+}
+
+static void libvips_eval(VipsImage* img, VipsProgress* progress, libvips_deadline* d) {
+	if (g_get_monotonic_time() > d->deadline) {
+		d->killed = 1;
+		vips_image_set_kill(img, TRUE);
+		// the image being computed, which is a temporary image if img is
+		// decoded by a loader
+		if (progress->im && progress->im != img) {
+			vips_image_set_kill(progress->im, TRUE);
+		}
+	}
+}
+
+// watch the evaluation of img until libvips_unwatch_deadline is called
+gulong libvips_watch_deadline(VipsImage* img, libvips_deadline* d) {
+	if (d->deadline <= 0) {
+		return 0;
+	}
+	vips_image_set_progress(img, TRUE);
+	return g_signal_connect(img, "eval", G_CALLBACK(libvips_eval), d);
+}
+
+// images may outlive the deadline in the operation cache
+void libvips_unwatch_deadline(VipsImage* img, gulong handler) {
+	if (handler) {
+		g_signal_handler_disconnect(img, handler);
+		vips_image_set_progress(img, FALSE);
+		vips_image_set_kill(img, FALSE);
+	}
+}
+
+// watch a loaded image until libvips_deadline_finish is called
+//
+// Loaders decode images into temporary images the first time their pixels
+// are needed, and report the progress on the loaded image, so decoding is
+// killed after the deadline too. Thumbnails are decoded while they are
+// evaluated.
+static void libvips_watch_input(VipsImage* img, libvips_deadline* d) {
+	if (d->deadline <= 0 || d->n_inputs >= LIBVIPS_MAX_INPUTS) {
+		return;
+	}
+	g_object_ref(img);
+	d->inputs[d->n_inputs] = img;
+	d->handlers[d->n_inputs] = libvips_watch_deadline(img, d);
+	d->n_inputs++;
+}
+
+// stop watching the inputs of a job, and return -3 instead of the result
+// of the job if it is killed
+static int libvips_deadline_finish(libvips_deadline* d, int ret) {
+	for (int i = 0; i < d->n_inputs; i++) {
+		libvips_unwatch_deadline(d->inputs[i], d->handlers[i]);
+		g_object_unref(d->inputs[i]);
+	}
+	d->n_inputs = 0;
+
+	if (ret && d->killed) {
+		ret = -3;
+	}
+	return libvips_capture_error(ret);
+}
+
+// encode img to the out type, the image is not unreferenced
+int libvips_save(
+	VipsImage* img,
 	void** out_buf,
 	size_t* out_size,
 	int outType,
-	int animated,
 	int lossless,
 	int Q,            // [0,100]
-	int effort        // [0,100]
+	int effort,       // [0,100]
+	libvips_deadline* deadline
 ){
-	VipsImage* img;
-	if (animated) {
-		img = vips_image_new_from_buffer(buf, len, "", "n", -1, "access", VIPS_ACCESS_SEQUENTIAL, NULL);
-	} else {
-		img = vips_image_new_from_buffer(buf, len, "", "access", VIPS_ACCESS_SEQUENTIAL, NULL);
-	}
-
-	if (!img) {
-		libvips_error();
-		return -1;
-	}
+	int err;
 
+	// images are decoded lazily while they are saved
+	gulong handler = libvips_watch_deadline(img, deadline);
 	if (outType == 1) { // webp
 		if (Q < 0) {
 			Q = 75;
@@ -83,34 +468,19 @@ int libvips_encode(
 		} else {
 			effort = linear_interp(0, 6, effort);
 		}
-		if (vips_webpsave_buffer(img, out_buf, out_size, "lossless", lossless, "Q", Q, "effort", effort, NULL)) {
-			g_object_unref(img);
-			libipvs_malloc_trim();
-			libvips_error();
-			return -2;
-		}
+		err = vips_webpsave_buffer(img, out_buf, out_size, "lossless", lossless, "Q", Q, "effort", effort, NULL);
 	} else if (outType == 2) { // png
 		if (effort < 0) {
 			effort = 6;
 		} else {
 			effort = linear_interp(0, 9, effort);
 		}
-		if (vips_pngsave_buffer(img, out_buf, out_size, "compression", effort, NULL)) {
-			g_object_unref(img);
-			libipvs_malloc_trim();
-			libvips_error();
-			return -2;
-		}
+		err = vips_pngsave_buffer(img, out_buf, out_size, "compression", effort, NULL);
 	} else if (outType == 3) { // jpeg
 		if (Q < 0) {
 			Q = 75;
 		}
-		if (vips_jpegsave_buffer(img, out_buf, out_size,  "Q", Q, NULL)) {
-			g_object_unref(img);
-			libipvs_malloc_trim();
-			libvips_error();
-			return -2;
-		}
+		err = vips_jpegsave_buffer(img, out_buf, out_size,  "Q", Q, NULL);
 	} else if (outType == 4) { // gif
 		if (Q < 0) {
 			Q = 8;
@@ -122,12 +492,7 @@ int libvips_encode(
 		} else {
 			effort = linear_interp(1, 10, effort);
 		}
-		if ( vips_gifsave_buffer(img, out_buf, out_size, "bitdepth", Q, "effort", effort, NULL)) {
-			g_object_unref(img);
-			libipvs_malloc_trim();
-			libvips_error();
-			return -2;
-		}
+		err = vips_gifsave_buffer(img, out_buf, out_size, "bitdepth", Q, "effort", effort, NULL);
 	} else if (outType == 5) { // avif
 		if (Q < 0) {
 			Q = 50;
@@ -137,94 +502,1110 @@ int libvips_encode(
 		} else {
 			effort = linear_interp(0, 9, effort);
 		}
-		if (vips_heifsave_buffer(img, out_buf, out_size, "lossless", lossless, "Q", Q, "effort", effort, "compression", VIPS_FOREIGN_HEIF_COMPRESSION_AV1, "encoder", VIPS_FOREIGN_HEIF_ENCODER_AOM, NULL)) {
-			g_object_unref(img);
-			libipvs_malloc_trim();
-			libvips_error();
-			return -2;
+		err = vips_heifsave_buffer(img, out_buf, out_size, "lossless", lossless, "Q", Q, "effort", effort, "compression", VIPS_FOREIGN_HEIF_COMPRESSION_AV1, "encoder", VIPS_FOREIGN_HEIF_ENCODER_AOM, NULL);
+	} else if (outType == 6) { // jxl
+		if (Q < 0) {
+			Q = 75;
+		}
+		if (effort < 0) {
+			effort = 7;
+		} else {
+			effort = linear_interp(1, 9, effort);
 		}
+		// jxlsave is optional, so it is looked up at runtime
+		err = vips_image_write_to_buffer(img, ".jxl", out_buf, out_size, "lossless", lossless, "Q", Q, "effort", effort, NULL);
 	} else {
-		g_object_unref(img);
-		libipvs_malloc_trim();
-		printf("libvips: unsupported out type: %d\n", outType);
+		vips_error("libvips_save", "unsupported out type: %d", outType);
+		err = -1;
+	}
+
+	libvips_unwatch_deadline(img, handler);
+
+	if (err) {
 		return -2;
 	}
 
-	g_object_unref(img);
-	libipvs_malloc_trim();
 	return 0;
 }
 
-void libvips_g_free(void* p) {
-	g_free(p);
-	libipvs_malloc_trim();
-}
+static int libvips_encode_image(
+	char* buf,
+	int len,
+	void** out_buf,
+	size_t* out_size,
+	int outType,
+	int animated,
+	int lossless,
+	int Q,
+	int effort,
+	int width,
+	int height,
+	int metadata,
+	libvips_watermark* watermark,
+	libvips_deadline* deadline
+){
+	VipsImage* img = NULL;
+	if (width > 0 && height > 0) {
+		// shrink-on-load avoids decoding the full image where the format supports it
+		if (vips_thumbnail_buffer(buf, len, &img, width, "height", height, "size", VIPS_SIZE_DOWN, "option_string", animated ? "n=-1" : "", NULL)) {
+			img = NULL;
+		}
+	} else if (animated) {
+		img = vips_image_new_from_buffer(buf, len, "", "n", -1, "access", VIPS_ACCESS_SEQUENTIAL, NULL);
+	} else {
+		img = vips_image_new_from_buffer(buf, len, "", "access", VIPS_ACCESS_SEQUENTIAL, NULL);
+	}
 
-int libvips_heif_load_plugins(char* directory) {
-	int nPlugins;
-	struct heif_error error = heif_load_plugins(directory, NULL, &nPlugins, 0);
-	if (error.code != heif_error_Ok) {
-		printf("libvips: libvips_heif_load_plugins: %s\n", error.message);
+	if (!img) {
 		return -1;
 	}
-	return 0;
-}
-*/
-import "C"
-
-import (
-	"log/slog"
-	"os"
-	"unsafe"
-)
-
-type Format int
-
-const (
-	FORMAT_WEBP = Format(1)
-	FORMAT_PNG  = Format(2)
-	FORMAT_JEPG = Format(3)
-	FORMAT_GIF  = Format(4)
-	FORMAT_AVIF = Format(5)
-)
 
-func LibvipsInit() {
-	if C.libvips_init() != 0 {
-		panic("libvips init")
+	// rotating requires random access
+	int orientation = 1;
+	if (!animated && vips_image_get_typeof(img, VIPS_META_ORIENTATION)) {
+		vips_image_get_int(img, VIPS_META_ORIENTATION, &orientation);
 	}
-	slog.Debug("libvips", "version", LibvipsVersion())
-
-	// For some unknown reason, libheif plugins are not loaded automatically
-	// on Ubuntu (at least not on my Ubuntu 23.10). Loading these plugins
-	// manually is required, or AVIF encoding will not work.
+	if (orientation > 1 && !(width > 0 && height > 0)) {
+		g_object_unref(img);
+		img = vips_image_new_from_buffer(buf, len, "", NULL);
+		if (!img) {
+			return -1;
+		}
+	}
+	libvips_watch_input(img, deadline);
 
-	// IMGU2_DEBUG_LIBHEIF_PLUGIN_PATHS is the path to the plugin directory.
-	// For example, it might be set to /usr/lib/x86_64-linux-gnu/libheif/plugins
-	// on Ubuntu 23.10
-	libheifPlugin := os.Getenv("IMGU2_DEBUG_LIBHEIF_PLUGIN_PATHS")
-	if libheifPlugin != "" {
-		slog.Info("libvips_heif_load_plugins", "path", libheifPlugin)
-		cstring := C.CString(libheifPlugin)
-		defer C.free((unsafe.Pointer(cstring)))
+	if (libvips_prepare(&img, animated, metadata)) {
+		g_object_unref(img);
+		libipvs_malloc_trim();
+		return -2;
+	}
 
-		if C.libvips_heif_load_plugins(cstring) != 0 {
-			panic("heif_load_plugins")
-		}
+	if (watermark && libvips_apply_watermark(&img, watermark)) {
+		g_object_unref(img);
+		libipvs_malloc_trim();
+		return -2;
 	}
-}
 
-func LibvipsShutdown() {
-	C.libvips_shutdown()
-}
+	int ret = libvips_save(img, out_buf, out_size, outType, lossless, Q, effort, deadline);
 
-func LibvipsVersion() string {
-	return C.GoString(C.libvips_version())
+	g_object_unref(img);
+	libipvs_malloc_trim();
+	return ret;
 }
 
-// encode in to target format
-//
-// return nil if any error occurred
-func LibvipsEncode(in []byte, target Format, animated bool, lossless bool, Q int, effort int) []byte {
+int libvips_encode(
+	char* buf,
+	int len,
+	void** out_buf,
+	size_t* out_size,
+	int outType,
+	int animated,
+	int lossless,
+	int Q,            // [0,100]
+	int effort,       // [0,100]
+	int width,        // downscale to fit inside width x height, 0 to keep the size
+	int height,
+	int metadata,     // see libvips_prepare
+	libvips_watermark* watermark, // may be NULL
+	int timeout_ms    // 0 for no timeout
+){
+	libvips_deadline deadline = libvips_deadline_after(timeout_ms);
+
+	int ret = libvips_check_input(buf, len, animated);
+	if (!ret) {
+		ret = libvips_encode_image(buf, len, out_buf, out_size, outType, animated, lossless, Q, effort, width, height, metadata, watermark, &deadline);
+	}
+
+	return libvips_deadline_finish(&deadline, ret);
+}
+
+// crop, resize and rotate the first frame of an image, in that order,
+// all metadata is removed
+//
+// the crop area is ignored if crop_width or crop_height is 0
+//
+// width or height may be 0 to keep the aspect ratio, images are never enlarged
+static int libvips_transform_image(
+	char* buf,
+	int len,
+	void** out_buf,
+	size_t* out_size,
+	int outType,
+	int crop_x,
+	int crop_y,
+	int crop_width,
+	int crop_height,
+	int width,
+	int height,
+	int cover,
+	int angle,
+	libvips_deadline* deadline
+){
+	VipsImage* img = vips_image_new_from_buffer(buf, len, "", NULL);
+	if (!img) {
+		return -1;
+	}
+	libvips_watch_input(img, deadline);
+
+	// the crop area is relative to the upright image
+	if (libvips_prepare(&img, 0, 0)) {
+		g_object_unref(img);
+		libipvs_malloc_trim();
+		return -2;
+	}
+
+	VipsImage* t;
+
+	if (crop_width > 0 && crop_height > 0) {
+		if (vips_extract_area(img, &t, crop_x, crop_y, crop_width, crop_height, NULL)) {
+			g_object_unref(img);
+			libipvs_malloc_trim();
+			return -2;
+		}
+		g_object_unref(img);
+		img = t;
+	}
+
+	if (width > 0 || height > 0) {
+		// VIPS_MAX_COORD, the size is only limited by the other side
+		if (width <= 0) {
+			width = 10000000;
+		}
+		if (height <= 0) {
+			height = 10000000;
+		}
+		if (vips_thumbnail_image(img, &t, width, "height", height, "size", VIPS_SIZE_DOWN, "crop", cover ? VIPS_INTERESTING_CENTRE : VIPS_INTERESTING_NONE, NULL)) {
+			g_object_unref(img);
+			libipvs_malloc_trim();
+			return -2;
+		}
+		g_object_unref(img);
+		img = t;
+	}
+
+	if (angle == 90 || angle == 180 || angle == 270) {
+		VipsAngle a = angle == 90 ? VIPS_ANGLE_D90 : (angle == 180 ? VIPS_ANGLE_D180 : VIPS_ANGLE_D270);
+		if (vips_rot(img, &t, a, NULL)) {
+			g_object_unref(img);
+			libipvs_malloc_trim();
+			return -2;
+		}
+		g_object_unref(img);
+		img = t;
+	}
+
+	int ret = libvips_save(img, out_buf, out_size, outType, 0, -1, -1, deadline);
+
+	g_object_unref(img);
+	libipvs_malloc_trim();
+	return ret;
+}
+
+int libvips_transform(
+	char* buf,
+	int len,
+	void** out_buf,
+	size_t* out_size,
+	int outType,
+	int crop_x,
+	int crop_y,
+	int crop_width,
+	int crop_height,
+	int width,
+	int height,
+	int cover,        // crop to fill the box instead of fitting inside it
+	int angle,        // 0, 90, 180 or 270
+	int timeout_ms    // 0 for no timeout
+){
+	libvips_deadline deadline = libvips_deadline_after(timeout_ms);
+
+	int ret = libvips_check_input(buf, len, 0);
+	if (!ret) {
+		ret = libvips_transform_image(buf, len, out_buf, out_size, outType, crop_x, crop_y, crop_width, crop_height, width, height, cover, angle, &deadline);
+	}
+
+	return libvips_deadline_finish(&deadline, ret);
+}
+
+// an operation of libvips_edit, the fields used depend on the type
+typedef struct {
+	int type;         // 1 crop, 2 rotate, 3 flip, 4 resize, 5 rect, 6 line, 7 arrow, 8 text, 9 blur
+	int x;            // crop, rect, blur and text position, or the start of lines
+	int y;
+	int width;        // crop, rect, blur and resize size, 0 keeps the aspect ratio when resizing
+	int height;
+	int x2;           // the end of lines
+	int y2;
+	int angle;        // 90, 180 or 270
+	int vertical;     // flip vertically instead of horizontally
+	int color[3];     // stroke and text colour
+	int fill[3];      // rect fill colour
+	int filled;       // whether rects are filled
+	int line_width;
+	char* text;
+	int font_size;    // in pixels
+	double sigma;     // blur radius
+} libvips_edit_op;
+
+// clip the area to the image, return 0 if nothing is left
+static int libvips_clip(VipsImage* img, int* x, int* y, int* width, int* height) {
+	VipsRect area = {*x, *y, *width, *height};
+	VipsRect image = {0, 0, vips_image_get_width(img), vips_image_get_height(img)};
+	vips_rect_intersectrect(&area, &image, &area);
+
+	*x = area.left;
+	*y = area.top;
+	*width = area.width;
+	*height = area.height;
+
+	return !vips_rect_isempty(&area);
+}
+
+// draw a line which is line_width pixels wide with round caps
+static int libvips_draw_thick_line(VipsImage* img, double* ink, int n, double x1, double y1, double x2, double y2, int line_width) {
+	if (line_width <= 1) {
+		return vips_draw_line(img, ink, n, x1, y1, x2, y2, NULL);
+	}
+
+	double length = hypot(x2 - x1, y2 - y1);
+	if (length > 0) {
+		// parallel lines half a pixel apart leave no gaps
+		double px = -(y2 - y1) / length;
+		double py = (x2 - x1) / length;
+		double half = (line_width - 1) / 2.0;
+		for (double o = -half; o <= half; o += 0.5) {
+			if (vips_draw_line(img, ink, n, round(x1 + px * o), round(y1 + py * o), round(x2 + px * o), round(y2 + py * o), NULL)) {
+				return -1;
+			}
+		}
+	}
+
+	if (vips_draw_circle(img, ink, n, x1, y1, line_width / 2, "fill", TRUE, NULL) ||
+		vips_draw_circle(img, ink, n, x2, y2, line_width / 2, "fill", TRUE, NULL)) {
+		return -1;
+	}
+
+	return 0;
+}
+
+// render text in a colour as an RGBA image
+static int libvips_text_overlay(char* text, int font_size, int* color, VipsImage** out) {
+	char font[32];
+	snprintf(font, sizeof(font), "sans %dpx", font_size);
+
+	// vips_text renders pango markup
+	char* escaped = g_markup_escape_text(text, -1);
+	VipsImage* mask;
+	int err = vips_text(&mask, escaped, "font", font, NULL);
+	g_free(escaped);
+	if (err) {
+		return -1;
+	}
+
+	// the mask is the alpha channel
+	double c[] = {color[0], color[1], color[2]};
+	VipsImage* fill = vips_image_new_from_image(mask, c, 3);
+	if (!fill) {
+		g_object_unref(mask);
+		return -1;
+	}
+
+	VipsImage* bands[] = {fill, mask};
+	VipsImage* t;
+	err = vips_bandjoin(bands, &t, 2, NULL);
+	g_object_unref(fill);
+	g_object_unref(mask);
+	if (err) {
+		return -1;
+	}
+
+	err = vips_copy(t, out, "interpretation", VIPS_INTERPRETATION_sRGB, NULL);
+	g_object_unref(t);
+	return err;
+}
+
+// apply an operation to a single 8-bit sRGB frame, *frame is replaced by the result
+static int libvips_edit_frame(VipsImage** frame, libvips_edit_op* op, libvips_deadline* deadline) {
+	VipsImage* img = *frame;
+	VipsImage* t = NULL;
+	int bands = vips_image_get_bands(img);
+	int x = op->x, y = op->y, width = op->width, height = op->height;
+
+	switch (op->type) {
+	case 1: // crop
+		if (!libvips_clip(img, &x, &y, &width, &height)) {
+			vips_error("libvips_edit", "crop area is outside the image");
+			return -1;
+		}
+		if (vips_extract_area(img, &t, x, y, width, height, NULL)) {
+			return -1;
+		}
+		break;
+
+	case 2: // rotate
+		if (vips_rot(img, &t, op->angle == 90 ? VIPS_ANGLE_D90 : (op->angle == 180 ? VIPS_ANGLE_D180 : VIPS_ANGLE_D270), NULL)) {
+			return -1;
+		}
+		break;
+
+	case 3: // flip
+		if (vips_flip(img, &t, op->vertical ? VIPS_DIRECTION_VERTICAL : VIPS_DIRECTION_HORIZONTAL, NULL)) {
+			return -1;
+		}
+		break;
+
+	case 4: { // resize
+		double hscale = (double)width / vips_image_get_width(img);
+		double vscale = (double)height / vips_image_get_height(img);
+		if (width <= 0) {
+			hscale = vscale;
+		}
+		if (height <= 0) {
+			vscale = hscale;
+		}
+		if (vips_resize(img, &t, hscale, "vscale", vscale, NULL)) {
+			return -1;
+		}
+		break;
+	}
+
+	case 5: // rect
+	case 6: // line
+	case 7: { // arrow
+		// drawing modifies the image in place, the frame is computed here
+		gulong handler = libvips_watch_deadline(img, deadline);
+		t = vips_image_copy_memory(img);
+		libvips_unwatch_deadline(img, handler);
+		if (!t) {
+			return -1;
+		}
+
+		double ink[] = {op->color[0], op->color[1], op->color[2], 255};
+		int err = 0;
+
+		if (op->type == 5) {
+			double fill[] = {op->fill[0], op->fill[1], op->fill[2], 255};
+			int lw = op->line_width;
+			if (op->filled) {
+				err = vips_draw_rect(t, fill, bands, x, y, width, height, "fill", TRUE, NULL);
+			}
+			if (!err && lw > 0) {
+				err = vips_draw_rect(t, ink, bands, x, y, width, lw, "fill", TRUE, NULL) ||
+					vips_draw_rect(t, ink, bands, x, y + height - lw, width, lw, "fill", TRUE, NULL) ||
+					vips_draw_rect(t, ink, bands, x, y, lw, height, "fill", TRUE, NULL) ||
+					vips_draw_rect(t, ink, bands, x + width - lw, y, lw, height, "fill", TRUE, NULL);
+			}
+		} else {
+			err = libvips_draw_thick_line(t, ink, bands, op->x, op->y, op->x2, op->y2, op->line_width);
+
+			if (!err && op->type == 7 && (op->x != op->x2 || op->y != op->y2)) {
+				double angle = atan2(op->y2 - op->y, op->x2 - op->x);
+				double length = VIPS_MAX(10, op->line_width * 4);
+				for (int i = -1; i <= 1 && !err; i += 2) {
+					double a = angle + i * G_PI / 6;
+					err = libvips_draw_thick_line(t, ink, bands, op->x2, op->y2, op->x2 - length * cos(a), op->y2 - length * sin(a), op->line_width);
+				}
+			}
+		}
+
+		if (err) {
+			g_object_unref(t);
+			return -1;
+		}
+		break;
+	}
+
+	case 8: { // text
+		VipsImage* overlay;
+		if (libvips_text_overlay(op->text, op->font_size, op->color, &overlay)) {
+			return -1;
+		}
+
+		VipsImage* composited;
+		int err = vips_composite2(img, overlay, &composited, VIPS_BLEND_MODE_OVER, "x", x, "y", y, NULL);
+		g_object_unref(overlay);
+		if (err) {
+			return -1;
+		}
+
+		// compositing adds an alpha channel, and may change the format
+		VipsImage* opaque = composited;
+		if (!vips_image_hasalpha(img)) {
+			err = vips_extract_band(composited, &opaque, 0, "n", 3, NULL);
+			g_object_unref(composited);
+			if (err) {
+				return -1;
+			}
+		}
+
+		err = vips_cast_uchar(opaque, &t, NULL);
+		g_object_unref(opaque);
+		if (err) {
+			return -1;
+		}
+		break;
+	}
+
+	case 9: { // blur
+		if (!libvips_clip(img, &x, &y, &width, &height)) {
+			// nothing to blur
+			return 0;
+		}
+
+		VipsImage* area;
+		if (vips_extract_area(img, &area, x, y, width, height, NULL)) {
+			return -1;
+		}
+
+		VipsImage* blurred;
+		int err = vips_gaussblur(area, &blurred, op->sigma, NULL);
+		g_object_unref(area);
+		if (err) {
+			return -1;
+		}
+
+		err = vips_insert(img, blurred, &t, x, y, NULL);
+		g_object_unref(blurred);
+		if (err) {
+			return -1;
+		}
+		break;
+	}
+
+	default:
+		vips_error("libvips_edit", "unknown operation: %d", op->type);
+		return -1;
+	}
+
+	g_object_unref(img);
+	*frame = t;
+	return 0;
+}
+
+// apply the operations in order to every frame of an image, and encode it
+// to the out type. Metadata is kept, and images are converted to 8-bit sRGB.
+static int libvips_edit_image(
+	char* buf,
+	int len,
+	void** out_buf,
+	size_t* out_size,
+	int outType,
+	int animated,
+	int lossless,
+	int Q,
+	int effort,
+	libvips_edit_op* ops,
+	int n_ops,
+	libvips_deadline* deadline
+){
+	VipsImage* img;
+	if (animated) {
+		img = vips_image_new_from_buffer(buf, len, "", "n", -1, NULL);
+	} else {
+		img = vips_image_new_from_buffer(buf, len, "", NULL);
+	}
+	if (!img) {
+		return -1;
+	}
+	libvips_watch_input(img, deadline);
+
+	VipsImage* t;
+
+	if (libvips_prepare(&img, animated, 2) ||
+		vips_colourspace(img, &t, VIPS_INTERPRETATION_sRGB, NULL)) {
+		g_object_unref(img);
+		libipvs_malloc_trim();
+		return -2;
+	}
+	g_object_unref(img);
+	img = t;
+
+	if (vips_cast_uchar(img, &t, NULL)) {
+		g_object_unref(img);
+		libipvs_malloc_trim();
+		return -2;
+	}
+	g_object_unref(img);
+	img = t;
+
+	// the frames of animated images are stacked vertically, and edited one by one
+	int width = vips_image_get_width(img);
+	int page_height = vips_image_get_page_height(img);
+	int n_pages = vips_image_get_height(img) / page_height;
+
+	VipsImage** frames = g_new0(VipsImage*, n_pages);
+	int err = 0;
+
+	for (int i = 0; i < n_pages && !err; i++) {
+		if (n_pages == 1) {
+			g_object_ref(img);
+			frames[i] = img;
+		} else if (vips_extract_area(img, &frames[i], 0, i * page_height, width, page_height, NULL)) {
+			err = -1;
+			break;
+		}
+
+		for (int j = 0; j < n_ops && !err; j++) {
+			err = libvips_edit_frame(&frames[i], &ops[j], deadline);
+		}
+	}
+
+	if (!err && n_pages > 1) {
+		err = vips_arrayjoin(frames, &t, n_pages, "across", 1, NULL);
+		if (!err) {
+			g_object_unref(img);
+			img = t;
+			err = vips_copy(img, &t, NULL);
+		}
+		if (!err) {
+			g_object_unref(img);
+			img = t;
+			vips_image_set_int(img, VIPS_META_PAGE_HEIGHT, vips_image_get_height(frames[0]));
+		}
+	} else if (!err) {
+		g_object_unref(img);
+		g_object_ref(frames[0]);
+		img = frames[0];
+	}
+
+	for (int i = 0; i < n_pages; i++) {
+		if (frames[i]) {
+			g_object_unref(frames[i]);
+		}
+	}
+	g_free(frames);
+
+	if (err) {
+		g_object_unref(img);
+		libipvs_malloc_trim();
+		return -2;
+	}
+
+	int ret = libvips_save(img, out_buf, out_size, outType, lossless, Q, effort, deadline);
+
+	g_object_unref(img);
+	libipvs_malloc_trim();
+	return ret;
+}
+
+int libvips_edit(
+	char* buf,
+	int len,
+	void** out_buf,
+	size_t* out_size,
+	int outType,
+	int animated,
+	int lossless,
+	int Q,            // [0,100]
+	int effort,       // [0,100]
+	libvips_edit_op* ops,
+	int n_ops,
+	int timeout_ms    // 0 for no timeout
+){
+	libvips_deadline deadline = libvips_deadline_after(timeout_ms);
+
+	int ret = libvips_check_input(buf, len, animated);
+	if (!ret) {
+		ret = libvips_edit_image(buf, len, out_buf, out_size, outType, animated, lossless, Q, effort, ops, n_ops, &deadline);
+	}
+
+	return libvips_deadline_finish(&deadline, ret);
+}
+
+// loader is set to the nickname of the loader, e.g. "pngload_buffer", and
+// compression to the "heif-compression" field of heif images, e.g. "av1"
+//
+// pages is the number of pages in the file, which are the frames of
+// animations or the pages of documents. timed is set if the image has
+// animation metadata, i.e. "delay" or "page-height"
+int libvips_probe(char* buf, int len, int* width, int* height, int* pages, int* timed, int* alpha, char* loader, char* compression, int str_size) {
+	if (!vips_foreign_find_load_buffer(buf, len)) {
+		return libvips_capture_error(-4);
+	}
+
+	// only the first frame is loaded, "n" is not accepted by loaders of
+	// single frame formats
+	VipsImage* img = vips_image_new_from_buffer(buf, len, "", "access", VIPS_ACCESS_SEQUENTIAL, NULL);
+	if (!img) {
+		return libvips_capture_error(-1);
+	}
+
+	// the number of pages in the file is recorded by loaders of multi-page formats
+	*width = vips_image_get_width(img);
+	*height = vips_image_get_height(img);
+	*pages = vips_image_get_n_pages(img);
+	*timed = vips_image_get_typeof(img, "delay") || vips_image_get_typeof(img, VIPS_META_PAGE_HEIGHT);
+	*alpha = vips_image_hasalpha(img);
+
+	const char* str;
+	if (vips_image_get_typeof(img, VIPS_META_LOADER) && !vips_image_get_string(img, VIPS_META_LOADER, &str)) {
+		g_strlcpy(loader, str, str_size);
+	}
+	if (vips_image_get_typeof(img, "heif-compression") && !vips_image_get_string(img, "heif-compression", &str)) {
+		g_strlcpy(compression, str, str_size);
+	}
+
+	// the dimensions after auto-rotation
+	int orientation = 1;
+	if (*pages == 1 && vips_image_get_typeof(img, VIPS_META_ORIENTATION)) {
+		vips_image_get_int(img, VIPS_META_ORIENTATION, &orientation);
+	}
+	if (orientation >= 5 && orientation <= 8) {
+		int t = *width;
+		*width = *height;
+		*height = t;
+	}
+
+	g_object_unref(img);
+	return 0;
+}
+
+// scale an image to fit inside width x height, or to exactly width x height
+// if force is set, and convert it to 8-bit sRGB, or to 8-bit grayscale if
+// grey is set. alpha is flattened onto white
+static int libvips_pixels_image(char* buf, int len, int width, int height, int force, int grey, void** out_buf, size_t* out_size, int* out_width, int* out_height, libvips_deadline* deadline) {
+	VipsImage* img;
+	if (vips_thumbnail_buffer(buf, len, &img, width, "height", height, "size", force ? VIPS_SIZE_FORCE : VIPS_SIZE_BOTH, NULL)) {
+		return -1;
+	}
+	libvips_watch_input(img, deadline);
+
+	VipsImage* t;
+
+	// 16-bit and CMYK images are converted to 8-bit sRGB first
+	if (vips_colourspace(img, &t, VIPS_INTERPRETATION_sRGB, NULL)) {
+		g_object_unref(img);
+		return -2;
+	}
+	g_object_unref(img);
+	img = t;
+
+	if (grey) {
+		if (vips_colourspace(img, &t, VIPS_INTERPRETATION_B_W, NULL)) {
+			g_object_unref(img);
+			return -2;
+		}
+		g_object_unref(img);
+		img = t;
+	}
+
+	if (vips_image_hasalpha(img)) {
+		VipsArrayDouble* background = vips_array_double_newv(1, 255.0);
+		int err = vips_flatten(img, &t, "background", background, NULL);
+		vips_area_unref(VIPS_AREA(background));
+		if (err) {
+			g_object_unref(img);
+			return -2;
+		}
+		g_object_unref(img);
+		img = t;
+	}
+
+	if (vips_cast_uchar(img, &t, NULL)) {
+		g_object_unref(img);
+		return -2;
+	}
+	g_object_unref(img);
+	img = t;
+
+	*out_width = vips_image_get_width(img);
+	*out_height = vips_image_get_height(img);
+
+	if (vips_image_get_bands(img) != (grey ? 1 : 3) || (force && (*out_width != width || *out_height != height))) {
+		g_object_unref(img);
+		vips_error("libvips_pixels", "unexpected image shape");
+		return -2;
+	}
+
+	gulong handler = libvips_watch_deadline(img, deadline);
+	*out_buf = vips_image_write_to_memory(img, out_size);
+	libvips_unwatch_deadline(img, handler);
+	g_object_unref(img);
+	libipvs_malloc_trim();
+	if (!*out_buf) {
+		return -2;
+	}
+
+	return 0;
+}
+
+int libvips_pixels(char* buf, int len, int width, int height, int force, int grey, void** out_buf, size_t* out_size, int* out_width, int* out_height, int timeout_ms) {
+	libvips_deadline deadline = libvips_deadline_after(timeout_ms);
+
+	int ret = libvips_check_input(buf, len, 0);
+	if (!ret) {
+		ret = libvips_pixels_image(buf, len, width, height, force, grey, out_buf, out_size, out_width, out_height, &deadline);
+	}
+
+	return libvips_deadline_finish(&deadline, ret);
+}
+
+void libvips_g_free(void* p) {
+	g_free(p);
+	libipvs_malloc_trim();
+}
+
+// message is set to the error of libheif if the plugins can not be loaded
+int libvips_heif_load_plugins(char* directory, char* message, int size) {
+	int nPlugins;
+	struct heif_error error = heif_load_plugins(directory, NULL, &nPlugins, 0);
+	if (error.code != heif_error_Ok) {
+		g_strlcpy(message, error.message, size);
+		return -1;
+	}
+	return 0;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+type Format int
+
+// Metadata is the metadata kept in encoded images
+type Metadata int
+
+const (
+	METADATA_STRIP    = Metadata(0) // remove all metadata
+	METADATA_KEEP_ICC = Metadata(1) // keep only the icc profile
+	METADATA_KEEP     = Metadata(2) // keep all metadata
+)
+
+const (
+	FORMAT_WEBP = Format(1)
+	FORMAT_PNG  = Format(2)
+	FORMAT_JEPG = Format(3)
+	FORMAT_GIF  = Format(4)
+	FORMAT_AVIF = Format(5)
+	FORMAT_JXL  = Format(6)
+)
+
+// the savers of formats, which may be missing from libvips
+var formatSavers = map[Format]string{
+	FORMAT_WEBP: "webpsave_buffer",
+	FORMAT_PNG:  "pngsave_buffer",
+	FORMAT_JEPG: "jpegsave_buffer",
+	FORMAT_GIF:  "gifsave_buffer",
+	FORMAT_AVIF: "heifsave_buffer",
+	FORMAT_JXL:  "jxlsave_buffer",
+}
+
+// the loaders of input types, which may be missing from libvips
+var typeLoaders = map[string]string{
+	"image/png":       "pngload_buffer",
+	"image/jpeg":      "jpegload_buffer",
+	"image/gif":       "gifload_buffer",
+	"image/webp":      "webpload_buffer",
+	"image/avif":      "heifload_buffer",
+	"image/heic":      "heifload_buffer",
+	"image/heif":      "heifload_buffer",
+	"image/jxl":       "jxlload_buffer",
+	"image/tiff":      "tiffload_buffer",
+	"image/svg+xml":   "svgload_buffer",
+	"application/pdf": "pdfload_buffer",
+}
+
+// formats and input types supported by the linked libvips, detected in LibvipsInit
+var (
+	supportedFormats = make(map[Format]bool)
+	supportedTypes   = make(map[string]bool)
+)
+
+var (
+	ErrBusy    = errors.New("libvips: too many queued jobs")
+	ErrTimeout = errors.New("libvips: timeout")
+)
+
+// ErrorKind is the category of an Error
+type ErrorKind int
+
+const (
+	ERROR_UNSUPPORTED_INPUT = ErrorKind(1) // the format is unknown, or libvips is built without its loader
+	ERROR_CORRUPT_INPUT     = ErrorKind(2) // the image can not be decoded
+	ERROR_ENCODE            = ErrorKind(3) // the image can not be processed or encoded
+	ERROR_OUT_OF_MEMORY     = ErrorKind(4)
+)
+
+var errorKindNames = map[ErrorKind]string{
+	ERROR_UNSUPPORTED_INPUT: "unsupported input",
+	ERROR_CORRUPT_INPUT:     "corrupt input",
+	ERROR_ENCODE:            "encoder failure",
+	ERROR_OUT_OF_MEMORY:     "out of memory",
+}
+
+// Error is returned by failed jobs, use errors.Is to check its kind, e.g.
+// errors.Is(err, ErrCorruptInput)
+type Error struct {
+	Kind    ErrorKind
+	Message string // the errors reported by libvips
+}
+
+var (
+	ErrUnsupportedInput = &Error{Kind: ERROR_UNSUPPORTED_INPUT}
+	ErrCorruptInput     = &Error{Kind: ERROR_CORRUPT_INPUT}
+	ErrEncode           = &Error{Kind: ERROR_ENCODE}
+	ErrOutOfMemory      = &Error{Kind: ERROR_OUT_OF_MEMORY}
+)
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return "libvips: " + errorKindNames[e.Kind]
+	}
+	return "libvips: " + errorKindNames[e.Kind] + ": " + e.Message
+}
+
+// errors of the same kind are equal
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Kind == e.Kind
+}
+
+var (
+	// messages of loaders, e.g. "jpegload_buffer: out of order read"
+	loaderMessage = regexp.MustCompile(`(?mi)^\w*load\w*:|premature end|truncated|corrupt`)
+
+	memoryMessage = regexp.MustCompile(`(?i)out of memory|failed to allocate|memory area too large`)
+)
+
+// the error of a C function returning code, the message is taken from the
+// errors captured on the calling thread, see libvips_take_error
+//
+// The function must be called on the thread the C function is called on,
+// see run. libvips does not report the kind of errors raised while images
+// are processed, so it is guessed from the message.
+func newError(code C.int) error {
+	if code == 0 {
+		return nil
+	}
+
+	var message string
+	cstring := C.libvips_take_error()
+	if cstring != nil {
+		message = strings.TrimSpace(C.GoString(cstring))
+		C.g_free(C.gpointer(unsafe.Pointer(cstring)))
+	}
+
+	kind := ERROR_ENCODE
+	switch {
+	case code == -3:
+		return ErrTimeout
+	case code == -4:
+		kind = ERROR_UNSUPPORTED_INPUT
+	case code == -5, memoryMessage.MatchString(message):
+		kind = ERROR_OUT_OF_MEMORY
+	case strings.Contains(message, "not in a known format"):
+		kind = ERROR_UNSUPPORTED_INPUT
+	case code == -1:
+		kind = ERROR_CORRUPT_INPUT
+	case loaderMessage.MatchString(message):
+		// images are decoded lazily, so decoding errors occur while encoding
+		kind = ERROR_CORRUPT_INPUT
+	}
+
+	return &Error{Kind: kind, Message: message}
+}
+
+// Encoding and decoding jobs are run by a limited number of workers, so a
+// burst of uploads can not exhaust the cpu and memory. Jobs wait in a
+// queue of limited length for a free worker, and are rejected with ErrBusy
+// if the queue is full or no worker is free in time. Running jobs are
+// killed after the timeout.
+var pool struct {
+	workers chan struct{} // a slot is taken by every running job
+	slots   chan struct{} // a slot is taken by every running or queued job
+	timeout time.Duration
+}
+
+// the maximum time a job waits for a worker if there is no timeout
+const maxQueueWait = time.Minute
+
+// run a job in the worker pool
+//
+// job is passed the timeout in milliseconds, and returns one of the codes
+// described at the top of this file
+func run(job func(timeoutMs C.int) C.int) error {
+	select {
+	case pool.slots <- struct{}{}:
+	default:
+		return ErrBusy
+	}
+	defer func() { <-pool.slots }()
+
+	wait := pool.timeout
+	if wait <= 0 {
+		wait = maxQueueWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case pool.workers <- struct{}{}:
+	case <-timer.C:
+		return ErrBusy
+	}
+	defer func() { <-pool.workers }()
+
+	// the errors of the job are captured on the thread it runs on
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	return newError(job(C.int(pool.timeout.Milliseconds())))
+}
+
+// initialize libvips and the worker pool
+//
+// workers is the maximum number of concurrent jobs, or 0 for the number of
+// cpus. queue is the maximum number of jobs waiting for a worker. timeout
+// is the maximum duration of a job, and of waiting for a worker, or 0 for
+// no timeout. maxPixels is the maximum number of pixels of an image
+// including all frames, larger images are rejected with ErrOutOfMemory
+// before they are decoded, or 0 for no limit.
+func LibvipsInit(workers int, queue int, timeout time.Duration, maxPixels int) {
+	runtime.LockOSThread()
+	err := newError(C.libvips_init())
+	runtime.UnlockOSThread()
+	if err != nil {
+		panic(err)
+	}
+	slog.Debug("libvips", "version", LibvipsVersion())
+
+	C.libvips_set_max_pixels(C.longlong(maxPixels))
+
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	pool.workers = make(chan struct{}, workers)
+	pool.slots = make(chan struct{}, workers+max(queue, 0))
+	pool.timeout = timeout
+	slog.Debug("libvips", "workers", workers, "queue", queue, "timeout", timeout, "max pixels", maxPixels)
+
+	for format, saver := range formatSavers {
+		supportedFormats[format] = hasOperation(saver)
+	}
+	for t, loader := range typeLoaders {
+		supportedTypes[t] = hasOperation(loader)
+	}
+	slog.Debug("libvips", "formats", supportedFormats, "input types", supportedTypes)
+
+	// For some unknown reason, libheif plugins are not loaded automatically
+	// on Ubuntu (at least not on my Ubuntu 23.10). Loading these plugins
+	// manually is required, or AVIF encoding will not work.
+
+	// IMGU2_DEBUG_LIBHEIF_PLUGIN_PATHS is the path to the plugin directory.
+	// For example, it might be set to /usr/lib/x86_64-linux-gnu/libheif/plugins
+	// on Ubuntu 23.10
+	libheifPlugin := os.Getenv("IMGU2_DEBUG_LIBHEIF_PLUGIN_PATHS")
+	if libheifPlugin != "" {
+		slog.Info("libvips_heif_load_plugins", "path", libheifPlugin)
+		cstring := C.CString(libheifPlugin)
+		defer C.free((unsafe.Pointer(cstring)))
+
+		var message [256]C.char
+		if C.libvips_heif_load_plugins(cstring, &message[0], C.int(len(message))) != 0 {
+			err := errors.New("libvips: load libheif plugins: " + C.GoString(&message[0]))
+			slog.Error("libvips_heif_load_plugins", "path", libheifPlugin, "err", err)
+			panic(err)
+		}
+	}
+}
+
+func hasOperation(name string) bool {
+	cstring := C.CString(name)
+	defer C.free(unsafe.Pointer(cstring))
+
+	return C.libvips_has_operation(cstring) != 0
+}
+
+// whether the linked libvips can encode images to the format
+func LibvipsCanEncode(format Format) bool {
+	return supportedFormats[format]
+}
+
+// whether the linked libvips can decode images of the mime type
+func LibvipsCanDecode(mimeType string) bool {
+	return supportedTypes[mimeType]
+}
+
+// the mime types of all input types supported by the linked libvips
+func LibvipsInputTypes() []string {
+	types := make([]string, 0, len(supportedTypes))
+	for t, ok := range supportedTypes {
+		if ok {
+			types = append(types, t)
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+func LibvipsShutdown() {
+	C.libvips_shutdown()
+}
+
+func LibvipsVersion() string {
+	return C.GoString(C.libvips_version())
+}
+
+type WatermarkPosition int
+
+const (
+	WATERMARK_TOP_LEFT     = WatermarkPosition(0)
+	WATERMARK_TOP_RIGHT    = WatermarkPosition(1)
+	WATERMARK_BOTTOM_LEFT  = WatermarkPosition(2)
+	WATERMARK_BOTTOM_RIGHT = WatermarkPosition(3)
+	WATERMARK_CENTER       = WatermarkPosition(4)
+)
+
+// Watermark is drawn on every frame of encoded images
+type Watermark struct {
+	// either Text or Image (a png file) is set
+	Text  string
+	Image []byte
+
+	Position WatermarkPosition
+	Opacity  int // [0,100]
+	Scale    int // width of the watermark in percent of the image width
+}
+
+// encode in to target format
+//
+// the image is downscaled to fit inside width x height if both are positive
+//
+// the image is always auto-rotated and converted to sRGB, metadata
+// decides which metadata is kept
+//
+// watermark may be nil
+//
+// the image is encoded in the worker pool, see run
+func LibvipsEncode(in []byte, target Format, animated bool, lossless bool, Q int, effort int, width int, height int, metadata Metadata, watermark *Watermark) ([]byte, error) {
+	var wm *C.libvips_watermark
+	if watermark != nil {
+		wm = &C.libvips_watermark{
+			position: C.int(int(watermark.Position)),
+			opacity:  C.int(watermark.Opacity),
+			scale:    C.int(watermark.Scale),
+		}
+
+		if watermark.Text != "" {
+			wm.text = C.CString(watermark.Text)
+			defer C.free(unsafe.Pointer(wm.text))
+		} else {
+			wm.image = C.CBytes(watermark.Image)
+			wm.image_len = C.int(len(watermark.Image))
+			defer C.free(wm.image)
+		}
+	}
+
 	cbytes := C.CBytes(in)
 
 	var outBuf unsafe.Pointer
@@ -240,18 +1621,378 @@ func LibvipsEncode(in []byte, target Format, animated bool, lossless bool, Q int
 		lossless_i = 1
 	}
 
-	result := C.libvips_encode((*C.char)(cbytes), C.int(len(in)), &outBuf, &outSize, C.int(int(target)), C.int(a), C.int(lossless_i), C.int(Q), C.int(effort))
 	defer C.free(cbytes)
+
+	err := run(func(timeoutMs C.int) C.int {
+		return C.libvips_encode((*C.char)(cbytes), C.int(len(in)), &outBuf, &outSize, C.int(int(target)), C.int(a), C.int(lossless_i), C.int(Q), C.int(effort), C.int(width), C.int(height), C.int(int(metadata)), wm, timeoutMs)
+	})
 	if outBuf != nil {
 		defer C.libvips_g_free(outBuf)
 	}
 
-	if result != 0 {
-		return nil
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, outSize)
+	copy(buf, (*[1 << 30]byte)(outBuf)[:outSize:outSize])
+
+	return buf, nil
+}
+
+// Transform describes the operations of LibvipsTransform
+type Transform struct {
+	// crop area in the source image, ignored if CropWidth or CropHeight is 0
+	CropX      int
+	CropY      int
+	CropWidth  int
+	CropHeight int
+
+	// the resized image fits inside Width x Height, 0 keeps the aspect ratio
+	Width  int
+	Height int
+
+	// crop the resized image to fill Width x Height instead
+	Cover bool
+
+	// clockwise rotation in degrees, 0, 90, 180 or 270
+	Rotate int
+}
+
+// crop, resize and rotate the first frame of an image, and encode it to target format
+//
+// the image is transformed in the worker pool, see run
+func LibvipsTransform(in []byte, t *Transform, target Format) ([]byte, error) {
+	cbytes := C.CBytes(in)
+	defer C.free(cbytes)
+
+	var outBuf unsafe.Pointer
+	var outSize C.size_t
+
+	cover := 0
+	if t.Cover {
+		cover = 1
+	}
+
+	err := run(func(timeoutMs C.int) C.int {
+		return C.libvips_transform((*C.char)(cbytes), C.int(len(in)), &outBuf, &outSize, C.int(int(target)),
+			C.int(t.CropX), C.int(t.CropY), C.int(t.CropWidth), C.int(t.CropHeight),
+			C.int(t.Width), C.int(t.Height), C.int(cover), C.int(t.Rotate), timeoutMs)
+	})
+	if outBuf != nil {
+		defer C.libvips_g_free(outBuf)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, outSize)
+	copy(buf, (*[1 << 30]byte)(outBuf)[:outSize:outSize])
+
+	return buf, nil
+}
+
+type EditOperationType int
+
+const (
+	EDIT_CROP   = EditOperationType(1)
+	EDIT_ROTATE = EditOperationType(2)
+	EDIT_FLIP   = EditOperationType(3)
+	EDIT_RESIZE = EditOperationType(4)
+	EDIT_RECT   = EditOperationType(5)
+	EDIT_LINE   = EditOperationType(6)
+	EDIT_ARROW  = EditOperationType(7)
+	EDIT_TEXT   = EditOperationType(8)
+	EDIT_BLUR   = EditOperationType(9)
+)
+
+// EditOperation is an operation of LibvipsEdit, the fields used depend on
+// the type. Coordinates are relative to the frame edited by the previous
+// operations.
+type EditOperation struct {
+	Type EditOperationType
+
+	// the area of crop, rect and blur, the position of text, or the start
+	// of lines and arrows
+	X      int
+	Y      int
+	Width  int // the size of resize, 0 keeps the aspect ratio
+	Height int
+
+	// the end of lines and arrows
+	X2 int
+	Y2 int
+
+	Angle    int  // clockwise rotation in degrees, 90, 180 or 270
+	Vertical bool // flip vertically instead of horizontally
+
+	Color     [3]byte // RGB colour of lines, rect outlines and text
+	Fill      [3]byte // RGB colour of rects
+	Filled    bool    // whether rects are filled
+	LineWidth int     // 0 draws rects without outlines
+
+	Text     string
+	FontSize int // in pixels
+
+	Sigma float64 // standard deviation of the gaussian blur
+}
+
+// LibvipsEdit applies the operations in order to every frame of an image,
+// and encodes it to target format. Metadata is kept, and the image is
+// auto-rotated and converted to 8-bit sRGB.
+//
+// the image is edited in the worker pool, see run
+func LibvipsEdit(in []byte, ops []EditOperation, target Format, animated bool, lossless bool, Q int, effort int) ([]byte, error) {
+	cbytes := C.CBytes(in)
+	defer C.free(cbytes)
+
+	var outBuf unsafe.Pointer
+	var outSize C.size_t
+
+	cops := (*C.libvips_edit_op)(C.calloc(C.size_t(max(len(ops), 1)), C.sizeof_libvips_edit_op))
+	defer C.free(unsafe.Pointer(cops))
+
+	cslice := unsafe.Slice(cops, len(ops))
+	for i, o := range ops {
+		c := &cslice[i]
+
+		c._type = C.int(int(o.Type))
+		c.x, c.y, c.width, c.height = C.int(o.X), C.int(o.Y), C.int(o.Width), C.int(o.Height)
+		c.x2, c.y2 = C.int(o.X2), C.int(o.Y2)
+		c.angle = C.int(o.Angle)
+		if o.Vertical {
+			c.vertical = 1
+		}
+		for j := 0; j < 3; j++ {
+			c.color[j] = C.int(o.Color[j])
+			c.fill[j] = C.int(o.Fill[j])
+		}
+		if o.Filled {
+			c.filled = 1
+		}
+		c.line_width = C.int(o.LineWidth)
+		if o.Text != "" {
+			c.text = C.CString(o.Text)
+			defer C.free(unsafe.Pointer(c.text))
+		}
+		c.font_size = C.int(o.FontSize)
+		c.sigma = C.double(o.Sigma)
+	}
+
+	a := 0
+	if animated {
+		a = 1
+	}
+
+	lossless_i := 0
+	if lossless {
+		lossless_i = 1
+	}
+
+	err := run(func(timeoutMs C.int) C.int {
+		return C.libvips_edit((*C.char)(cbytes), C.int(len(in)), &outBuf, &outSize, C.int(int(target)), C.int(a), C.int(lossless_i), C.int(Q), C.int(effort), cops, C.int(len(ops)), timeoutMs)
+	})
+	if outBuf != nil {
+		defer C.libvips_g_free(outBuf)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, outSize)
+	copy(buf, (*[1 << 30]byte)(outBuf)[:outSize:outSize])
+
+	return buf, nil
+}
+
+// the size which images are scaled to before they are compared by LibvipsSSIM
+const ssimSize = 256
+
+// scale an image to fit inside width x height, or to exactly width x height
+// if force is set, and return its 8-bit pixels, which are interleaved RGB or
+// grayscale if grey is set
+func pixels(in []byte, width int, height int, force bool, grey bool) ([]byte, int, int, error) {
+	cbytes := C.CBytes(in)
+	defer C.free(cbytes)
+
+	var outBuf unsafe.Pointer
+	var outSize C.size_t
+	var outWidth, outHeight C.int
+
+	f := 0
+	if force {
+		f = 1
+	}
+
+	g := 0
+	if grey {
+		g = 1
+	}
+
+	err := run(func(timeoutMs C.int) C.int {
+		return C.libvips_pixels((*C.char)(cbytes), C.int(len(in)), C.int(width), C.int(height), C.int(f), C.int(g), &outBuf, &outSize, &outWidth, &outHeight, timeoutMs)
+	})
+	if outBuf != nil {
+		defer C.libvips_g_free(outBuf)
+	}
+
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	bands := 3
+	if grey {
+		bands = 1
+	}
+	if int(outSize) != int(outWidth)*int(outHeight)*bands {
+		return nil, 0, 0, &Error{Kind: ERROR_ENCODE, Message: "unexpected pixels size"}
 	}
 
 	buf := make([]byte, outSize)
 	copy(buf, (*[1 << 30]byte)(outBuf)[:outSize:outSize])
 
-	return buf
+	return buf, int(outWidth), int(outHeight), nil
+}
+
+// scale an image to ssimSize x ssimSize and convert it to grayscale
+func luminance(in []byte) ([]byte, error) {
+	b, _, _, err := pixels(in, ssimSize, ssimSize, true, true)
+	return b, err
+}
+
+// LibvipsPixels scales an image to fit inside a square of the size, and
+// returns its 8-bit sRGB pixels interleaved as RGB, along with the width
+// and the height of the scaled image. Alpha is flattened onto white, and
+// only the first frame of animated images is returned.
+func LibvipsPixels(in []byte, size int) ([]byte, int, int, error) {
+	return pixels(in, size, size, false, false)
+}
+
+// LibvipsGrayscale scales an image to exactly width x height, ignoring the
+// aspect ratio, and returns its 8-bit grayscale pixels. Alpha is flattened
+// onto white, and only the first frame of animated images is returned.
+func LibvipsGrayscale(in []byte, width int, height int) ([]byte, error) {
+	b, _, _, err := pixels(in, width, height, true, true)
+	return b, err
+}
+
+// LibvipsSSIM measures the structural similarity of an encoded image to
+// the reference image. Both images are scaled to the same size and
+// converted to grayscale, so only the first frame of animated images is
+// compared.
+//
+// return a value up to 1, which means the images are identical
+func LibvipsSSIM(reference []byte, encoded []byte) (float64, error) {
+	x, err := luminance(reference)
+	if err != nil {
+		return 0, err
+	}
+
+	y, err := luminance(encoded)
+	if err != nil {
+		return 0, err
+	}
+
+	return ssim(x, y, ssimSize), nil
+}
+
+// the mean SSIM of 8x8 windows with a stride of 4 pixels
+func ssim(x []byte, y []byte, size int) float64 {
+	const (
+		window = 8
+		stride = 4
+		c1     = (0.01 * 255) * (0.01 * 255)
+		c2     = (0.03 * 255) * (0.03 * 255)
+		n      = window * window
+	)
+
+	total := 0.0
+	count := 0
+
+	for top := 0; top+window <= size; top += stride {
+		for left := 0; left+window <= size; left += stride {
+			var sumX, sumY, sumXX, sumYY, sumXY float64
+			for i := top; i < top+window; i++ {
+				for j := left; j < left+window; j++ {
+					a := float64(x[i*size+j])
+					b := float64(y[i*size+j])
+					sumX += a
+					sumY += b
+					sumXX += a * a
+					sumYY += b * b
+					sumXY += a * b
+				}
+			}
+
+			muX := sumX / n
+			muY := sumY / n
+			varX := sumXX/n - muX*muX
+			varY := sumYY/n - muY*muY
+			cov := sumXY/n - muX*muY
+
+			total += (2*muX*muY + c1) * (2*cov + c2) / ((muX*muX + muY*muY + c1) * (varX + varY + c2))
+			count++
+		}
+	}
+
+	return total / float64(count)
+}
+
+// the mime types of images loaded by loaders, heif images are either
+// image/avif or image/heic depending on the compression
+var loaderTypes = map[string]string{
+	"pngload_buffer":  "image/png",
+	"jpegload_buffer": "image/jpeg",
+	"gifload_buffer":  "image/gif",
+	"webpload_buffer": "image/webp",
+	"heifload_buffer": "image/heic",
+	"jxlload_buffer":  "image/jxl",
+	"tiffload_buffer": "image/tiff",
+	"svgload_buffer":  "image/svg+xml",
+	"pdfload_buffer":  "application/pdf",
+}
+
+type ImageInfo struct {
+	Width  int
+	Height int
+	Frames int    // number of frames of animated images, or 1 for still images and documents
+	Alpha  bool   // whether the image has an alpha channel
+	Type   string // the mime type detected from the content, or empty if it is unknown
+}
+
+// read the dimensions of an image without decoding it
+//
+// the width and height are swapped if the image is rotated by 90 or 270
+// degrees according to its EXIF orientation
+//
+// images are probed in the worker pool, see run, since reading the header
+// of some formats, e.g. svg and pdf, requires parsing the whole file
+func LibvipsProbe(in []byte) (*ImageInfo, error) {
+	cbytes := C.CBytes(in)
+	defer C.free(cbytes)
+
+	var width, height, pages, timed, alpha C.int
+	var loader, compression [64]C.char
+
+	err := run(func(timeoutMs C.int) C.int {
+		return C.libvips_probe((*C.char)(cbytes), C.int(len(in)), &width, &height, &pages, &timed, &alpha, &loader[0], &compression[0], C.int(len(loader)))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t := loaderTypes[C.GoString(&loader[0])]
+	if t == "image/heic" && C.GoString(&compression[0]) == "av1" {
+		t = "image/avif"
+	}
+
+	return &ImageInfo{
+		Width:  int(width),
+		Height: int(height),
+		Frames: animationFrames(t, int(pages), timed != 0),
+		Alpha:  alpha != 0,
+		Type:   t,
+	}, nil
 }
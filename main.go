@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/joho/godotenv"
@@ -28,6 +29,11 @@ func main() {
 	listen := flag.String("listen", "127.0.0.1:3000", "listening address")
 	debug := flag.Bool("debug", false, "debug logging")
 	sqlitePath := flag.String("sqlite", "./db.sqlite", "path to sqlite database")
+	partialUploadPath := flag.String("partial-uploads", "./partial_uploads", "directory where resumable uploads are staged")
+	vipsWorkers := flag.Int("vips-workers", 0, "maximum number of concurrent image encodes, 0 for the number of cpus")
+	vipsQueue := flag.Int("vips-queue", 32, "maximum number of image encodes waiting for a worker")
+	vipsTimeout := flag.Duration("vips-timeout", time.Minute, "maximum duration of an image encode, 0 for no timeout")
+	vipsMaxPixels := flag.Int("vips-max-pixels", 16384*16384, "maximum number of pixels of an image including all frames, 0 for no limit")
 	flag.Parse()
 
 	// logging
@@ -43,7 +49,7 @@ func main() {
 	db.Init(*sqlitePath)
 
 	// libvips
-	libvips.LibvipsInit()
+	libvips.LibvipsInit(*vipsWorkers, *vipsQueue, *vipsTimeout, *vipsMaxPixels)
 
 	// initialize storage drivers
 	err = services.Storage.Init()
@@ -52,6 +58,21 @@ func main() {
 		panic(err)
 	}
 
+	// probe images uploaded before the metadata is recorded
+	go func() {
+		err := services.Image.FillMetadata()
+		if err != nil {
+			slog.Error("failed to fill image metadata", "err", err)
+		}
+	}()
+
+	// staging directory for resumable uploads
+	err = services.PartialUpload.Init(*partialUploadPath)
+	if err != nil {
+		slog.Error("failed to initialize resumable uploads", "err", err)
+		panic(err)
+	}
+
 	// start scheduled tasks
 	services.TaskStart()
 
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"imgu2/db"
+	"log/slog"
+)
+
+type apiToken struct{}
+
+var APIToken = apiToken{}
+
+// only the sha256 hash of the token is stored in the database
+func hashAPIToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// create a new api token for the user
+//
+// return the plain text token, which can not be recovered later
+func (apiToken) Create(userId int, name string) (string, error) {
+	token := "imgu2_" + RandomHexString(20)
+
+	_, err := db.APITokenCreate(userId, name, hashAPIToken(token))
+	if err != nil {
+		return "", fmt.Errorf("create api token: %w", err)
+	}
+
+	return token, nil
+}
+
+func (apiToken) FindByUser(userId int) ([]db.APIToken, error) {
+	return db.APITokenFindByUser(userId)
+}
+
+// revoke a token owned by the user
+func (apiToken) Delete(id int, userId int) error {
+	return db.APITokenDelete(id, userId)
+}
+
+// find the owner of the token
+//
+// returns nil if token is invalid
+func (apiToken) FindUser(token string) (*db.User, error) {
+	t, err := db.APITokenFindByHash(hashAPIToken(token))
+	if err != nil {
+		return nil, err
+	}
+
+	if t == nil {
+		return nil, nil
+	}
+
+	err = db.APITokenUpdateLastUsed(t.Id)
+	if err != nil {
+		slog.Error("update api token last used", "err", err, "id", t.Id)
+	}
+
+	return db.UserFindById(t.UserId)
+}
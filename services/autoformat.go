@@ -0,0 +1,118 @@
+package services
+
+import (
+	"errors"
+	"imgu2/libvips"
+	"log/slog"
+	"time"
+)
+
+// formats tried by format=auto, faster encoders are tried first so that
+// the slower ones are skipped when the time budget runs out
+var autoFormats = []string{"webp", "jpeg", "png", "avif", "jxl"}
+
+// formats tried by format=auto for animated images
+var autoAnimatedFormats = []string{"webp", "gif"}
+
+// chooseAutoFormat encodes the image to every enabled format, and keeps
+// the smallest encoding whose SSIM compared to the uploaded image is at
+// least the minimum in the settings. The most similar encoding is kept if
+// none of them is good enough.
+//
+// Formats are tried until the time budget in the settings is used up,
+// the first format is always tried.
+//
+// return the chosen format and the encoded image, or an error if the image
+// can not be encoded to any format
+func chooseAutoFormat(file []byte, info *libvips.ImageInfo, lossless bool, encode func(libvips.Format) ([]byte, error)) (string, []byte, error) {
+	minSSIM, err := Setting.GetAutoFormatMinSSIM()
+	if err != nil {
+		return "", nil, err
+	}
+
+	budget, err := Setting.GetAutoFormatTimeBudget()
+	if err != nil {
+		return "", nil, err
+	}
+
+	formats := autoFormats
+	if info.Frames > 1 {
+		formats = autoAnimatedFormats
+	}
+
+	var (
+		best         string // the smallest encoding which is good enough
+		bestImage    []byte
+		closest      string // the most similar encoding
+		closestSSIM  float64
+		closestImage []byte
+		encodeErr    error = libvips.ErrEncode // the last error if no format is encoded
+	)
+
+	start := time.Now()
+
+	for _, format := range formats {
+		// jpeg drops the alpha channel, and is never lossless
+		if format == "jpeg" && (info.Alpha || lossless) {
+			continue
+		}
+
+		enabled, err := Upload.IsEncodingEnabled(format)
+		if err != nil {
+			return "", nil, err
+		}
+		if !enabled {
+			continue
+		}
+
+		if (best != "" || closest != "") && time.Since(start) > budget {
+			slog.Debug("auto format: time budget exceeded", "skipped", format, "elapsed", time.Since(start))
+			break
+		}
+
+		b, err := encode(transformFormats[format].vipsFormat)
+		if errors.Is(err, libvips.ErrBusy) {
+			return "", nil, err
+		}
+		if err != nil {
+			slog.Error("auto format: encode", "format", format, "err", err)
+			encodeErr = err
+			continue
+		}
+
+		if bestImage != nil && len(b) >= len(bestImage) {
+			continue
+		}
+
+		// lossless encodings are identical to the uploaded image
+		similarity := 1.0
+		if minSSIM > 0 && !lossless && format != "png" {
+			similarity, err = libvips.LibvipsSSIM(file, b)
+			if errors.Is(err, libvips.ErrBusy) {
+				return "", nil, err
+			}
+			if err != nil {
+				slog.Error("auto format: ssim", "format", format, "err", err)
+				continue
+			}
+		}
+
+		slog.Debug("auto format", "format", format, "size", len(b), "ssim", similarity)
+
+		if similarity >= minSSIM {
+			best, bestImage = format, b
+		} else if closest == "" || similarity > closestSSIM {
+			closest, closestSSIM, closestImage = format, similarity, b
+		}
+	}
+
+	if best != "" {
+		return best, bestImage, nil
+	}
+
+	if closest != "" {
+		return closest, closestImage, nil
+	}
+
+	return "", nil, encodeErr
+}
@@ -0,0 +1,203 @@
+package services
+
+import (
+	"fmt"
+	"imgu2/db"
+	"imgu2/libvips"
+	"log/slog"
+	"math"
+	"strings"
+)
+
+// images are scaled to fit inside a square of this size before the
+// BlurHash and the dominant colour are computed
+const blurHashSize = 32
+
+type blurHash struct{}
+
+var BlurHash = blurHash{}
+
+// Compute the BlurHash and the dominant colour (#rrggbb) of an image.
+// Only the first frame of animated images is used.
+func (*blurHash) Compute(b []byte) (string, string, error) {
+	pix, width, height, err := libvips.LibvipsPixels(b, blurHashSize)
+	if err != nil {
+		return "", "", fmt.Errorf("blurhash: %w", err)
+	}
+
+	// 4 components along the longer side, and 3 along the shorter side
+	xComponents, yComponents := 4, 3
+	if height > width {
+		xComponents, yComponents = 3, 4
+	}
+
+	return encodeBlurHash(pix, width, height, xComponents, yComponents), dominantColor(pix), nil
+}
+
+// Backfill computes the BlurHash of images uploaded before BlurHashes are
+// added. Images which can not be read are skipped, and are not retried after
+// failing a few times.
+func (h *blurHash) Backfill() error {
+	afterId := 0
+
+	for {
+		images, err := db.ImageFindWithoutBlurHash(afterId, 100)
+		if err != nil {
+			return err
+		}
+
+		if len(images) == 0 {
+			return nil
+		}
+
+		for _, v := range images {
+			afterId = v.Id
+
+			var hash, color string
+			b, err := readImageFile(&v)
+			if err == nil {
+				hash, color, err = h.Compute(b)
+			}
+			if err != nil {
+				slog.Error("compute blurhash", "file name", v.FileName, "err", err)
+
+				err = db.BackfillFailureRecord(v.Id, db.BackfillBlurHash)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			err = db.ImageSetBlurHash(v.Id, hash, color)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// append value to sb as length base 83 digits
+func writeBase83(sb *strings.Builder, value int, length int) {
+	for i := length - 1; i >= 0; i-- {
+		digit := value / int(math.Pow(83, float64(i))) % 83
+		sb.WriteByte(base83Chars[digit])
+	}
+}
+
+func sRGBToLinear(v byte) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = max(0, min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// the sign of v times |v| to the power of exp
+func signPow(v float64, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// encodeBlurHash implements the BlurHash algorithm, see
+// https://github.com/woltapp/blurhash/blob/master/Algorithm.md
+//
+// pix is interleaved 8-bit RGB
+func encodeBlurHash(pix []byte, width int, height int, xComponents int, yComponents int) string {
+	factors := make([][3]float64, 0, xComponents*yComponents)
+
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			var r, g, b float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation * math.Cos(math.Pi*float64(i*x)/float64(width)) * math.Cos(math.Pi*float64(j*y)/float64(height))
+					p := (y*width + x) * 3
+					r += basis * sRGBToLinear(pix[p])
+					g += basis * sRGBToLinear(pix[p+1])
+					b += basis * sRGBToLinear(pix[p+2])
+				}
+			}
+
+			scale := 1 / float64(width*height)
+			factors = append(factors, [3]float64{r * scale, g * scale, b * scale})
+		}
+	}
+
+	var sb strings.Builder
+
+	writeBase83(&sb, (xComponents-1)+(yComponents-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+
+	maximumValue := 1.0
+	if len(ac) > 0 {
+		actualMaximumValue := 0.0
+		for _, f := range ac {
+			actualMaximumValue = max(actualMaximumValue, math.Abs(f[0]), math.Abs(f[1]), math.Abs(f[2]))
+		}
+
+		quantisedMaximumValue := max(0, min(82, int(math.Floor(actualMaximumValue*166-0.5))))
+		maximumValue = float64(quantisedMaximumValue+1) / 166
+		writeBase83(&sb, quantisedMaximumValue, 1)
+	} else {
+		writeBase83(&sb, 0, 1)
+	}
+
+	writeBase83(&sb, linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+
+	for _, f := range ac {
+		quantise := func(v float64) int {
+			return max(0, min(18, int(math.Floor(signPow(v/maximumValue, 0.5)*9+9.5))))
+		}
+		writeBase83(&sb, quantise(f[0])*19*19+quantise(f[1])*19+quantise(f[2]), 2)
+	}
+
+	return sb.String()
+}
+
+// dominantColor returns the mean colour of the most common colour bucket as
+// #rrggbb, colours are bucketed by the high 4 bits of each channel
+//
+// pix is interleaved 8-bit RGB
+func dominantColor(pix []byte) string {
+	var (
+		count [4096]int
+		sum   [4096][3]int
+	)
+
+	for p := 0; p+2 < len(pix); p += 3 {
+		bucket := int(pix[p]>>4)<<8 | int(pix[p+1]>>4)<<4 | int(pix[p+2]>>4)
+		count[bucket]++
+		sum[bucket][0] += int(pix[p])
+		sum[bucket][1] += int(pix[p+1])
+		sum[bucket][2] += int(pix[p+2])
+	}
+
+	best := 0
+	for i := range count {
+		if count[i] > count[best] {
+			best = i
+		}
+	}
+
+	if count[best] == 0 {
+		return "#ffffff"
+	}
+
+	n := count[best]
+	return fmt.Sprintf("#%02x%02x%02x", sum[best][0]/n, sum[best][1]/n, sum[best][2]/n)
+}
@@ -0,0 +1,109 @@
+package services
+
+import "testing"
+
+// an image of width x height pixels, whose colour is given by f
+func testPixels(width int, height int, f func(x, y int) [3]byte) []byte {
+	pix := make([]byte, 0, width*height*3)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := f(x, y)
+			pix = append(pix, c[0], c[1], c[2])
+		}
+	}
+	return pix
+}
+
+func solidPixels(width int, height int, c [3]byte) []byte {
+	return testPixels(width, height, func(x, y int) [3]byte { return c })
+}
+
+func TestEncodeBlurHash(t *testing.T) {
+	tests := []struct {
+		name        string
+		pix         []byte
+		width       int
+		height      int
+		xComponents int
+		yComponents int
+		want        string
+	}{
+		{
+			name:  "black",
+			pix:   solidPixels(4, 4, [3]byte{0, 0, 0}),
+			width: 4, height: 4, xComponents: 4, yComponents: 3,
+			want: "L00000fQfQfQfQfQfQfQfQfQfQfQ",
+		},
+		{
+			name:  "white",
+			pix:   solidPixels(4, 4, [3]byte{255, 255, 255}),
+			width: 4, height: 4, xComponents: 4, yComponents: 3,
+			want: "L~TSUA~qfQ~q~q%MfQ%MfQfQfQfQ",
+		},
+		{
+			name:  "dc only",
+			pix:   solidPixels(4, 4, [3]byte{255, 255, 255}),
+			width: 4, height: 4, xComponents: 1, yComponents: 1,
+			want: "00TSUA",
+		},
+		{
+			name: "black and white halves",
+			pix: testPixels(4, 4, func(x, y int) [3]byte {
+				if x < 2 {
+					return [3]byte{0, 0, 0}
+				}
+				return [3]byte{255, 255, 255}
+			}),
+			width: 4, height: 4, xComponents: 4, yComponents: 3,
+			want: "L~Lqe94n00_3-;M{IUxufQfQfQfQ",
+		},
+		{
+			name: "portrait gradient",
+			pix: testPixels(5, 3, func(x, y int) [3]byte {
+				return [3]byte{byte(x * 60), byte(y * 80), 128}
+			}),
+			width: 5, height: 3, xComponents: 3, yComponents: 4,
+			want: "TnHc{I3CJl:vJCSMd_eqfQ?aKOSM",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := encodeBlurHash(tt.pix, tt.width, tt.height, tt.xComponents, tt.yComponents)
+			if got != tt.want {
+				t.Errorf("encodeBlurHash() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDominantColor(t *testing.T) {
+	tests := []struct {
+		name string
+		pix  []byte
+		want string
+	}{
+		{"empty", nil, "#ffffff"},
+		{"solid", solidPixels(3, 3, [3]byte{0x12, 0x34, 0x56}), "#123456"},
+		{
+			// 16 and 18 share a bucket, whose mean is used
+			name: "largest bucket",
+			pix:  []byte{16, 0, 0, 18, 0, 0, 200, 200, 200},
+			want: "#110000",
+		},
+		{
+			name: "incomplete pixel ignored",
+			pix:  []byte{0xff, 0x00, 0x00, 0x00},
+			want: "#ff0000",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := dominantColor(tt.pix)
+			if got != tt.want {
+				t.Errorf("dominantColor() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"math/big"
+	"unicode/utf8"
 )
 
 func RandomHexString(n int) string {
@@ -36,3 +37,15 @@ func RandomString(length int) string {
 
 	return s
 }
+
+// truncate s to at most n bytes without splitting a utf-8 character
+func truncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,116 @@
+package services
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"imgu2/db"
+	"log/slog"
+	"sync"
+)
+
+// contentMutex serializes changes to the reference count of contents, so a
+// stored file can not be reused while it is being deleted
+var contentMutex sync.Mutex
+
+type content struct{}
+
+var Content = content{}
+
+// Put stores the file in a storage driver, or adds a reference to the
+// stored file if a file with the same content is already stored.
+//
+// fileName is used as the internal name of new files
+func (*content) Put(fileName string, b []byte) (*db.Content, error) {
+	sum := sha256.Sum256(b)
+	hash := hex.EncodeToString(sum[:])
+
+	c, err := contentRefByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		slog.Debug("reuse stored file", "hash", hash, "internal name", c.InternalName)
+		return c, nil
+	}
+
+	// the stored file may be shared by images with different expire time,
+	// so it is deleted by the reference count instead of the storage driver
+	internalName, storageId, err := Storage.Put(fileName, b, sql.NullTime{})
+	if err != nil {
+		return nil, err
+	}
+
+	contentMutex.Lock()
+	defer contentMutex.Unlock()
+
+	// the same file may have been stored by a concurrent upload
+	c, err = db.ContentFindByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		err = Storage.DeleteFileFromDriver(storageId, internalName)
+		if err != nil {
+			slog.Error("delete duplicated file", "storage", storageId, "internal name", internalName, "err", err)
+		}
+
+		return c, db.ContentRef(c.Id)
+	}
+
+	id, err := db.ContentCreate(hash, storageId, internalName, len(b))
+	if err != nil {
+		return nil, err
+	}
+
+	return &db.Content{
+		Id:           id,
+		Hash:         hash,
+		StorageId:    storageId,
+		InternalName: internalName,
+		Size:         len(b),
+		RefCount:     1,
+	}, nil
+}
+
+// add a reference to the content with the hash
+//
+// return nil if not found
+func contentRefByHash(hash string) (*db.Content, error) {
+	contentMutex.Lock()
+	defer contentMutex.Unlock()
+
+	c, err := db.ContentFindByHash(hash)
+	if err != nil || c == nil {
+		return nil, err
+	}
+
+	err = db.ContentRef(c.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.RefCount++
+	return c, nil
+}
+
+// Unref removes a reference added by Put. The stored file is deleted when
+// there are no references left.
+func (*content) Unref(c *db.Content) error {
+	contentMutex.Lock()
+	defer contentMutex.Unlock()
+
+	current, err := db.ContentFindById(c.Id)
+	if err != nil || current == nil {
+		return err
+	}
+
+	if current.RefCount <= 1 {
+		err = Storage.DeleteFileFromDriver(current.StorageId, current.InternalName)
+		if err != nil {
+			return err
+		}
+	}
+
+	return db.ContentUnref(current.Id)
+}
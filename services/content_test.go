@@ -0,0 +1,214 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"imgu2/db"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// move the default local storage driver to a temporary directory
+//
+// return the directory of the stored files
+func initTestStorage(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	config, err := json.Marshal(map[string]string{"path": dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the default storage driver is created with the database
+	err = db.StorageUpdate(1, true, true, string(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := Storage
+	t.Cleanup(func() { Storage = old })
+
+	Storage = storage{}
+	err = Storage.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+// create an image whose stored file is the content
+func createTestImage(t *testing.T, fileName string, c *db.Content) *db.Image {
+	t.Helper()
+
+	_, err := db.ImageCreate(c.StorageId, sql.NullInt32{}, fileName, c.InternalName, "127.0.0.1", sql.NullTime{}, "", c.Id, "", db.ImageMetadata{Size: c.Size, MimeType: "image/png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := db.ImageFindByFileName(fileName)
+	if err != nil || i == nil {
+		t.Fatalf("ImageFindByFileName() = %v, %v", i, err)
+	}
+
+	return i
+}
+
+// check the reference count of a content, 0 means the content is deleted
+func checkRefCount(t *testing.T, c *db.Content, dir string, want int) {
+	t.Helper()
+
+	current, err := db.ContentFindById(c.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := 0
+	if current != nil {
+		got = current.RefCount
+	}
+	if got != want {
+		t.Errorf("reference count of %s = %d, want %d", c.InternalName, got, want)
+	}
+
+	_, err = os.Stat(filepath.Join(dir, c.InternalName))
+	if stored := err == nil; stored != (want > 0) {
+		t.Errorf("%s stored = %v, want %v", c.InternalName, stored, want > 0)
+	}
+}
+
+func TestContentPutDuplicate(t *testing.T) {
+	initTestDB(t)
+	dir := initTestStorage(t)
+
+	a, err := Content.Put("a.png", []byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := Content.Put("b.png", []byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the file is stored only once
+	if b.Id != a.Id || b.InternalName != "a.png" || b.RefCount != 2 {
+		t.Fatalf("Put() of the same content = %+v, want %+v with 2 references", b, a)
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "b.png"))
+	if !os.IsNotExist(err) {
+		t.Errorf("duplicated file stored, err = %v", err)
+	}
+
+	checkRefCount(t, a, dir, 2)
+
+	err = Content.Unref(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRefCount(t, a, dir, 1)
+
+	err = Content.Unref(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRefCount(t, a, dir, 0)
+}
+
+func TestContentDeleteImageWithVersion(t *testing.T) {
+	initTestDB(t)
+	dir := initTestStorage(t)
+
+	a, err := Content.Put("a.png", []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := createTestImage(t, "first.png", a)
+
+	// the first image is replaced, and its previous version keeps the
+	// reference to a
+	b, err := Content.Put("b.png", []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.ImageSetContent(first.Id, b.StorageId, b.InternalName, b.Id, db.ImageMetadata{Size: b.Size, MimeType: "image/png"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another image with the same content as the previous version
+	a2, err := Content.Put("a2.png", []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := createTestImage(t, "second.png", a2)
+
+	checkRefCount(t, a, dir, 2)
+
+	err = Image.Delete(second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the previous version of the first image can still be restored
+	checkRefCount(t, a, dir, 1)
+	checkRefCount(t, b, dir, 1)
+
+	versions, err := db.ImageVersionFindByImage(first.Id)
+	if err != nil || len(versions) != 1 || versions[0].ContentId.Int32 != int32(a.Id) {
+		t.Fatalf("ImageVersionFindByImage() = %+v, %v", versions, err)
+	}
+
+	first, err = db.ImageFindByFileName("first.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Image.Delete(first, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkRefCount(t, a, dir, 0)
+	checkRefCount(t, b, dir, 0)
+}
+
+func TestContentDeleteImageWithThumbnail(t *testing.T) {
+	initTestDB(t)
+	dir := initTestStorage(t)
+
+	c, err := Content.Put("a.webp", []byte("small image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := createTestImage(t, "a.webp", c)
+
+	// the thumbnail of a small image may be identical to the image
+	thumb, err := Content.Put("a_thumb.webp", []byte("small image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := db.ImageSetThumbnail(i.Id, thumb.Id)
+	if err != nil || !ok {
+		t.Fatalf("ImageSetThumbnail() = %v, %v", ok, err)
+	}
+
+	checkRefCount(t, c, dir, 2)
+
+	i, err = db.ImageFindByFileName("a.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Image.Delete(i, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkRefCount(t, c, dir, 0)
+}
@@ -0,0 +1,379 @@
+package services
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"imgu2/db"
+	"imgu2/libvips"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// the maximum number of operations in an edit
+const maxEditOperations = 100
+
+// coordinates are limited so that they can not overflow in libvips
+const maxEditCoordinate = 1000000
+
+// the maximum size of resized images
+const maxEditSize = 16383
+
+var ErrInvalidEditOperations = errors.New("edit: invalid operations")
+
+type edit struct{}
+
+var Edit = edit{}
+
+// editOperation is an operation in the JSON operation list, e.g.
+//
+//	[
+//	  {"op": "crop", "x": 10, "y": 10, "width": 200, "height": 100},
+//	  {"op": "rotate", "angle": 90},
+//	  {"op": "flip", "direction": "horizontal"},
+//	  {"op": "resize", "width": 100, "height": 0},
+//	  {"op": "rect", "x": 0, "y": 0, "width": 50, "height": 50, "color": "#ff0000", "fill": "#ffffff", "line_width": 2},
+//	  {"op": "line", "x1": 0, "y1": 0, "x2": 50, "y2": 50, "color": "#ff0000", "line_width": 5},
+//	  {"op": "arrow", "x1": 0, "y1": 0, "x2": 50, "y2": 50, "color": "#ff0000", "line_width": 5},
+//	  {"op": "text", "x": 10, "y": 10, "text": "hello", "color": "#000000", "size": 24},
+//	  {"op": "blur", "x": 0, "y": 0, "width": 50, "height": 50, "radius": 10}
+//	]
+//
+// Coordinates may be fractional, and the areas of rect and blur may have a
+// negative size.
+type editOperation struct {
+	Op        string   `json:"op"`
+	X         float64  `json:"x"`
+	Y         float64  `json:"y"`
+	Width     float64  `json:"width"`
+	Height    float64  `json:"height"`
+	X1        float64  `json:"x1"`
+	Y1        float64  `json:"y1"`
+	X2        float64  `json:"x2"`
+	Y2        float64  `json:"y2"`
+	Angle     int      `json:"angle"`
+	Direction string   `json:"direction"`
+	Color     string   `json:"color"`
+	Fill      string   `json:"fill"`
+	LineWidth *float64 `json:"line_width"`
+	Text      string   `json:"text"`
+	Size      float64  `json:"size"`
+	Radius    float64  `json:"radius"`
+}
+
+// parse a #rrggbb colour, an empty string is the default colour
+func parseEditColor(s string, defaultColor [3]byte) ([3]byte, error) {
+	if s == "" {
+		return defaultColor, nil
+	}
+
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "#"))
+	if err != nil || len(b) != 3 || !strings.HasPrefix(s, "#") {
+		return [3]byte{}, fmt.Errorf("%w: invalid colour: %s", ErrInvalidEditOperations, s)
+	}
+
+	return [3]byte{b[0], b[1], b[2]}, nil
+}
+
+// round coordinates, and check that they are in range
+func editCoordinates(fs ...float64) ([]int, error) {
+	v := make([]int, len(fs))
+
+	for i, f := range fs {
+		if math.IsNaN(f) || math.Abs(f) > maxEditCoordinate {
+			return nil, fmt.Errorf("%w: coordinate out of range: %v", ErrInvalidEditOperations, f)
+		}
+		v[i] = int(math.Round(f))
+	}
+
+	return v, nil
+}
+
+// the rounded coordinates of an area with a non-negative size
+func editArea(x, y, width, height float64) (int, int, int, int, error) {
+	if width < 0 {
+		x, width = x+width, -width
+	}
+	if height < 0 {
+		y, height = y+height, -height
+	}
+
+	v, err := editCoordinates(x, y, width, height)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+
+	return v[0], v[1], v[2], v[3], nil
+}
+
+// ParseOperations parses a JSON list of edit operations, see editOperation.
+// An empty string is an empty list.
+//
+// ErrInvalidEditOperations is returned if any operation is invalid.
+func (*edit) ParseOperations(s string) ([]libvips.EditOperation, error) {
+	ops := make([]libvips.EditOperation, 0)
+
+	if strings.TrimSpace(s) == "" {
+		return ops, nil
+	}
+
+	var list []editOperation
+	err := json.Unmarshal([]byte(s), &list)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidEditOperations, err)
+	}
+
+	if len(list) > maxEditOperations {
+		return nil, fmt.Errorf("%w: more than %d operations", ErrInvalidEditOperations, maxEditOperations)
+	}
+
+	for _, v := range list {
+		var op libvips.EditOperation
+
+		op.Color, err = parseEditColor(v.Color, [3]byte{0, 0, 0})
+		if err != nil {
+			return nil, err
+		}
+
+		lineWidth := 1.0
+		if v.LineWidth != nil {
+			lineWidth = *v.LineWidth
+		}
+		if lineWidth < 0 || lineWidth > 1000 {
+			return nil, fmt.Errorf("%w: line width out of range: %v", ErrInvalidEditOperations, lineWidth)
+		}
+		op.LineWidth = int(math.Round(lineWidth))
+
+		switch v.Op {
+		case "crop":
+			op.Type = libvips.EDIT_CROP
+			op.X, op.Y, op.Width, op.Height, err = editArea(v.X, v.Y, v.Width, v.Height)
+			if err == nil && (op.Width == 0 || op.Height == 0) {
+				err = fmt.Errorf("%w: empty crop area", ErrInvalidEditOperations)
+			}
+
+		case "rotate":
+			op.Type = libvips.EDIT_ROTATE
+			op.Angle = (v.Angle%360 + 360) % 360
+			if op.Angle == 0 {
+				continue
+			}
+			if op.Angle%90 != 0 {
+				err = fmt.Errorf("%w: angle is not a multiple of 90: %d", ErrInvalidEditOperations, v.Angle)
+			}
+
+		case "flip":
+			op.Type = libvips.EDIT_FLIP
+			switch v.Direction {
+			case "horizontal":
+			case "vertical":
+				op.Vertical = true
+			default:
+				err = fmt.Errorf("%w: unknown flip direction: %s", ErrInvalidEditOperations, v.Direction)
+			}
+
+		case "resize":
+			op.Type = libvips.EDIT_RESIZE
+			op.Width, op.Height = int(math.Round(v.Width)), int(math.Round(v.Height))
+			if op.Width < 0 || op.Height < 0 || op.Width > maxEditSize || op.Height > maxEditSize || (op.Width == 0 && op.Height == 0) {
+				err = fmt.Errorf("%w: invalid size: %v x %v", ErrInvalidEditOperations, v.Width, v.Height)
+			}
+
+		case "rect":
+			op.Type = libvips.EDIT_RECT
+			op.X, op.Y, op.Width, op.Height, err = editArea(v.X, v.Y, v.Width, v.Height)
+			if err == nil && v.Fill != "" {
+				op.Filled = true
+				op.Fill, err = parseEditColor(v.Fill, op.Color)
+			}
+
+		case "line", "arrow":
+			op.Type = libvips.EDIT_LINE
+			if v.Op == "arrow" {
+				op.Type = libvips.EDIT_ARROW
+			}
+			var c []int
+			c, err = editCoordinates(v.X1, v.Y1, v.X2, v.Y2)
+			if err == nil {
+				op.X, op.Y, op.X2, op.Y2 = c[0], c[1], c[2], c[3]
+			}
+			op.LineWidth = max(op.LineWidth, 1)
+
+		case "text":
+			op.Type = libvips.EDIT_TEXT
+			var c []int
+			c, err = editCoordinates(v.X, v.Y)
+			if err == nil {
+				op.X, op.Y = c[0], c[1]
+			}
+			op.Text = v.Text
+			op.FontSize = int(math.Round(v.Size))
+			if op.FontSize == 0 {
+				op.FontSize = 24
+			}
+			if err == nil && (strings.TrimSpace(v.Text) == "" || utf8.RuneCountInString(v.Text) > 1000) {
+				err = fmt.Errorf("%w: text is empty or too long", ErrInvalidEditOperations)
+			}
+			if err == nil && (op.FontSize < 1 || op.FontSize > 1000) {
+				err = fmt.Errorf("%w: font size out of range: %v", ErrInvalidEditOperations, v.Size)
+			}
+
+		case "blur":
+			op.Type = libvips.EDIT_BLUR
+			op.X, op.Y, op.Width, op.Height, err = editArea(v.X, v.Y, v.Width, v.Height)
+			op.Sigma = v.Radius
+			if op.Sigma == 0 {
+				op.Sigma = 10
+			}
+			if err == nil && (op.Sigma < 0 || op.Sigma > 100) {
+				err = fmt.Errorf("%w: blur radius out of range: %v", ErrInvalidEditOperations, v.Radius)
+			}
+
+		default:
+			err = fmt.Errorf("%w: unknown operation: %s", ErrInvalidEditOperations, v.Op)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		ops = append(ops, op)
+	}
+
+	return ops, nil
+}
+
+// checkEditSize checks that an image and every intermediate result of ops
+// fit inside limit without downscaling, since the image is decoded at full
+// size before it is edited
+//
+// ErrImageDimensionsTooLarge is returned if any size exceeds the limits
+func checkEditSize(limit *DimensionLimit, width int, height int, frames int, ops []libvips.EditOperation) error {
+	if frames > maxAnimationFrames {
+		return ErrImageDimensionsTooLarge
+	}
+
+	if _, _, oversized := limit.fit(width, height, frames); oversized {
+		return ErrImageDimensionsTooLarge
+	}
+
+	for _, op := range ops {
+		width, height = editedSize(width, height, &op)
+
+		if _, _, oversized := limit.fit(width, height, frames); oversized {
+			return ErrImageDimensionsTooLarge
+		}
+	}
+
+	return nil
+}
+
+// the size of a frame after an operation, the same as libvips_edit_frame
+func editedSize(width int, height int, op *libvips.EditOperation) (int, int) {
+	switch op.Type {
+	case libvips.EDIT_CROP:
+		// the crop area is clipped to the image
+		x1, y1 := max(op.X, 0), max(op.Y, 0)
+		x2, y2 := min(op.X+op.Width, width), min(op.Y+op.Height, height)
+		return max(x2-x1, 0), max(y2-y1, 0)
+
+	case libvips.EDIT_ROTATE:
+		if op.Angle == 90 || op.Angle == 270 {
+			return height, width
+		}
+
+	case libvips.EDIT_RESIZE:
+		if width == 0 || height == 0 {
+			return width, height
+		}
+		if op.Width <= 0 {
+			return int(math.Round(float64(width) * float64(op.Height) / float64(height))), op.Height
+		}
+		if op.Height <= 0 {
+			return op.Width, int(math.Round(float64(height) * float64(op.Width) / float64(width)))
+		}
+		return op.Width, op.Height
+	}
+
+	return width, height
+}
+
+// Replace edits the stored file of an image, and replaces it with the
+// result under the same file name. The edited image is encoded to the same
+// format as the image.
+//
+// The limits are the same as uploaded images: ErrEncodedFileTooLarge is
+// returned if the edited image is larger than fileSizeLimit,
+// ErrStorageQuotaExceeded if it exceeds storageLimit (zero means no limit),
+// ErrImageDimensionsTooLarge if the image or any intermediate result exceeds
+// dimensionLimit, and ErrImageBlocked if it is similar to a blocked image.
+func (*edit) Replace(i *db.Image, ops []libvips.EditOperation, fileSizeLimit int, storageLimit int, dimensionLimit DimensionLimit) error {
+	b, err := readImageFile(i)
+	if err != nil {
+		return fmt.Errorf("edit: %w", err)
+	}
+
+	info, err := libvips.LibvipsProbe(b)
+	if err != nil {
+		return fmt.Errorf("edit: %w", err)
+	}
+
+	err = checkEditSize(&dimensionLimit, info.Width, info.Height, info.Frames, ops)
+	if err != nil {
+		return err
+	}
+
+	mimeType := i.MimeType
+	if mimeType == "" {
+		mimeType = info.Type
+	}
+
+	_, format, ok := targetEncoding(mimeType)
+	if !ok {
+		return fmt.Errorf("edit: unsupported format: %s", mimeType)
+	}
+
+	animated := info.Frames > 1
+
+	encode := func(f libvips.Format) ([]byte, error) {
+		return libvips.LibvipsEdit(b, ops, f, animated, false, -1, -1)
+	}
+
+	edited, err := encode(format)
+	if err != nil {
+		return fmt.Errorf("edit: %w", err)
+	}
+
+	if len(edited) > fileSizeLimit {
+		return ErrEncodedFileTooLarge
+	}
+
+	if storageLimit > 0 {
+		used, err := Upload.StorageUsage(i.Uploader, i.UploaderIP)
+		if err != nil {
+			return err
+		}
+
+		// the previous file still counts if it is kept as a version
+		if used+len(edited) > storageLimit {
+			return ErrStorageQuotaExceeded
+		}
+	}
+
+	phash, err := PerceptualHash.Compute(edited)
+	if err != nil {
+		return fmt.Errorf("edit: %w", err)
+	}
+
+	blocked, err := PerceptualHash.IsBlocked(phash)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return ErrImageBlocked
+	}
+
+	return Image.Replace(i, edited, mimeType, phash, encode)
+}
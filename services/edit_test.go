@@ -0,0 +1,205 @@
+package services
+
+import (
+	"errors"
+	"imgu2/libvips"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseOperations(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    []libvips.EditOperation
+		wantErr bool
+	}{
+		{name: "empty", s: "", want: []libvips.EditOperation{}},
+		{name: "blank", s: "  \n", want: []libvips.EditOperation{}},
+		{name: "empty list", s: "[]", want: []libvips.EditOperation{}},
+		{
+			name: "crop",
+			s:    `[{"op": "crop", "x": 10, "y": 20, "width": 200, "height": 100}]`,
+			want: []libvips.EditOperation{{Type: libvips.EDIT_CROP, X: 10, Y: 20, Width: 200, Height: 100, LineWidth: 1}},
+		},
+		{
+			name: "crop with negative size",
+			s:    `[{"op": "crop", "x": 110, "y": 120, "width": -100, "height": -100.4}]`,
+			want: []libvips.EditOperation{{Type: libvips.EDIT_CROP, X: 10, Y: 20, Width: 100, Height: 100, LineWidth: 1}},
+		},
+		{name: "empty crop", s: `[{"op": "crop", "x": 10, "y": 10, "width": 0, "height": 10}]`, wantErr: true},
+		{
+			name: "rotate",
+			s:    `[{"op": "rotate", "angle": -90}, {"op": "rotate", "angle": 540}]`,
+			want: []libvips.EditOperation{
+				{Type: libvips.EDIT_ROTATE, Angle: 270, LineWidth: 1},
+				{Type: libvips.EDIT_ROTATE, Angle: 180, LineWidth: 1},
+			},
+		},
+		{name: "rotate by 360 is skipped", s: `[{"op": "rotate", "angle": 360}]`, want: []libvips.EditOperation{}},
+		{name: "rotate by 45", s: `[{"op": "rotate", "angle": 45}]`, wantErr: true},
+		{
+			name: "flip",
+			s:    `[{"op": "flip", "direction": "horizontal"}, {"op": "flip", "direction": "vertical"}]`,
+			want: []libvips.EditOperation{
+				{Type: libvips.EDIT_FLIP, LineWidth: 1},
+				{Type: libvips.EDIT_FLIP, Vertical: true, LineWidth: 1},
+			},
+		},
+		{name: "flip diagonally", s: `[{"op": "flip", "direction": "diagonal"}]`, wantErr: true},
+		{
+			name: "resize keeping aspect ratio",
+			s:    `[{"op": "resize", "width": 100.4}]`,
+			want: []libvips.EditOperation{{Type: libvips.EDIT_RESIZE, Width: 100, LineWidth: 1}},
+		},
+		{name: "resize to nothing", s: `[{"op": "resize", "width": 0, "height": 0}]`, wantErr: true},
+		{name: "resize too large", s: `[{"op": "resize", "width": 16384, "height": 10}]`, wantErr: true},
+		{name: "resize negative", s: `[{"op": "resize", "width": -1, "height": 10}]`, wantErr: true},
+		{
+			name: "filled rect",
+			s:    `[{"op": "rect", "x": 0, "y": 0, "width": 50, "height": 50, "color": "#ff0000", "fill": "#00ff00", "line_width": 2}]`,
+			want: []libvips.EditOperation{{
+				Type: libvips.EDIT_RECT, Width: 50, Height: 50,
+				Color: [3]byte{0xff, 0, 0}, Fill: [3]byte{0, 0xff, 0}, Filled: true, LineWidth: 2,
+			}},
+		},
+		{
+			name: "rect without outline",
+			s:    `[{"op": "rect", "x": 0, "y": 0, "width": 50, "height": 50, "fill": "#ffffff", "line_width": 0}]`,
+			want: []libvips.EditOperation{{
+				Type: libvips.EDIT_RECT, Width: 50, Height: 50,
+				Fill: [3]byte{0xff, 0xff, 0xff}, Filled: true,
+			}},
+		},
+		{name: "invalid colour", s: `[{"op": "rect", "width": 1, "height": 1, "color": "red"}]`, wantErr: true},
+		{name: "colour without #", s: `[{"op": "rect", "width": 1, "height": 1, "color": "ff0000"}]`, wantErr: true},
+		{name: "line width out of range", s: `[{"op": "rect", "width": 1, "height": 1, "line_width": 1001}]`, wantErr: true},
+		{
+			name: "arrow",
+			s:    `[{"op": "arrow", "x1": 1, "y1": 2, "x2": 3, "y2": 4, "line_width": 0}]`,
+			want: []libvips.EditOperation{{Type: libvips.EDIT_ARROW, X: 1, Y: 2, X2: 3, Y2: 4, LineWidth: 1}},
+		},
+		{name: "coordinate out of range", s: `[{"op": "line", "x1": 1000001}]`, wantErr: true},
+		{
+			name: "text",
+			s:    `[{"op": "text", "x": 10, "y": 10, "text": "hello"}]`,
+			want: []libvips.EditOperation{{Type: libvips.EDIT_TEXT, X: 10, Y: 10, Text: "hello", FontSize: 24, LineWidth: 1}},
+		},
+		{name: "empty text", s: `[{"op": "text", "text": " "}]`, wantErr: true},
+		{name: "font size out of range", s: `[{"op": "text", "text": "a", "size": 1001}]`, wantErr: true},
+		{
+			name: "blur",
+			s:    `[{"op": "blur", "x": 0, "y": 0, "width": 50, "height": 50}]`,
+			want: []libvips.EditOperation{{Type: libvips.EDIT_BLUR, Width: 50, Height: 50, Sigma: 10, LineWidth: 1}},
+		},
+		{name: "blur radius out of range", s: `[{"op": "blur", "width": 1, "height": 1, "radius": 101}]`, wantErr: true},
+		{name: "unknown operation", s: `[{"op": "sharpen"}]`, wantErr: true},
+		{name: "not a list", s: `{"op": "flip"}`, wantErr: true},
+		{name: "too many operations", s: "[" + strings.Repeat(`{"op": "flip", "direction": "vertical"},`, 100) + `{"op": "flip", "direction": "vertical"}]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Edit.ParseOperations(tt.s)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidEditOperations) {
+					t.Errorf("ParseOperations() error = %v, want ErrInvalidEditOperations", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ParseOperations() error = %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseOperations() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEditedSize(t *testing.T) {
+	tests := []struct {
+		name       string
+		width      int
+		height     int
+		op         libvips.EditOperation
+		wantWidth  int
+		wantHeight int
+	}{
+		{"crop", 640, 480, libvips.EditOperation{Type: libvips.EDIT_CROP, X: 10, Y: 10, Width: 100, Height: 50}, 100, 50},
+		{"crop clipped", 640, 480, libvips.EditOperation{Type: libvips.EDIT_CROP, X: -10, Y: 400, Width: 100, Height: 200}, 90, 80},
+		{"crop outside", 640, 480, libvips.EditOperation{Type: libvips.EDIT_CROP, X: 700, Y: 0, Width: 100, Height: 100}, 0, 100},
+		{"rotate 90", 640, 480, libvips.EditOperation{Type: libvips.EDIT_ROTATE, Angle: 90}, 480, 640},
+		{"rotate 180", 640, 480, libvips.EditOperation{Type: libvips.EDIT_ROTATE, Angle: 180}, 640, 480},
+		{"rotate 270", 640, 480, libvips.EditOperation{Type: libvips.EDIT_ROTATE, Angle: 270}, 480, 640},
+		{"resize", 640, 480, libvips.EditOperation{Type: libvips.EDIT_RESIZE, Width: 100, Height: 100}, 100, 100},
+		{"resize by width", 640, 480, libvips.EditOperation{Type: libvips.EDIT_RESIZE, Width: 320}, 320, 240},
+		{"resize by height", 640, 480, libvips.EditOperation{Type: libvips.EDIT_RESIZE, Height: 100}, 133, 100},
+		{"resize empty image", 0, 480, libvips.EditOperation{Type: libvips.EDIT_RESIZE, Width: 100}, 0, 480},
+		{"flip", 640, 480, libvips.EditOperation{Type: libvips.EDIT_FLIP}, 640, 480},
+		{"blur", 640, 480, libvips.EditOperation{Type: libvips.EDIT_BLUR, Width: 10, Height: 10}, 640, 480},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, h := editedSize(tt.width, tt.height, &tt.op)
+			if w != tt.wantWidth || h != tt.wantHeight {
+				t.Errorf("editedSize() = %d x %d, want %d x %d", w, h, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestCheckEditSize(t *testing.T) {
+	limit := DimensionLimit{MaxWidth: 1000, MaxHeight: 800, Downscale: true}
+
+	tests := []struct {
+		name    string
+		width   int
+		height  int
+		frames  int
+		ops     []libvips.EditOperation
+		wantErr bool
+	}{
+		{"within limits", 640, 480, 1, nil, false},
+		{"source too large", 2000, 480, 1, nil, true},
+		{"rotated too tall", 1000, 480, 1, []libvips.EditOperation{{Type: libvips.EDIT_ROTATE, Angle: 90}}, true},
+		{"rotated back", 800, 480, 1, []libvips.EditOperation{{Type: libvips.EDIT_ROTATE, Angle: 180}}, false},
+		{
+			name: "resized too large in between",
+			// the final size fits, but the intermediate result does not
+			width: 640, height: 480, frames: 1,
+			ops: []libvips.EditOperation{
+				{Type: libvips.EDIT_RESIZE, Width: 2000},
+				{Type: libvips.EDIT_RESIZE, Width: 500},
+			},
+			wantErr: true,
+		},
+		{
+			name:  "cropped then resized",
+			width: 1000, height: 800, frames: 1,
+			ops: []libvips.EditOperation{
+				{Type: libvips.EDIT_CROP, Width: 100, Height: 100},
+				{Type: libvips.EDIT_RESIZE, Width: 800},
+			},
+			wantErr: false,
+		},
+		{"too many frames", 10, 10, maxAnimationFrames + 1, nil, true},
+		{"animation too large", 1000, 800, 200, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkEditSize(&limit, tt.width, tt.height, tt.frames, tt.ops)
+			if tt.wantErr && !errors.Is(err, ErrImageDimensionsTooLarge) {
+				t.Errorf("checkEditSize() error = %v, want ErrImageDimensionsTooLarge", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("checkEditSize() error = %v", err)
+			}
+		})
+	}
+}
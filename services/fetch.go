@@ -0,0 +1,148 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrInvalidURL     = errors.New("fetch: invalid url")
+	ErrForbiddenURL   = errors.New("fetch: url points to a non-public address")
+	ErrRemoteTooLarge = errors.New("fetch: remote file too large")
+	ErrRemoteStatus   = errors.New("fetch: unexpected http status")
+)
+
+const (
+	fetchTimeout      = time.Second * 30
+	fetchMaxRedirects = 5
+)
+
+// address ranges which are not covered by the net.IP helpers
+var fetchBlockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade nat
+	netip.MustParsePrefix("192.0.0.0/24"),  // ietf protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),   // reserved
+	netip.MustParsePrefix("64:ff9b::/96"),  // nat64
+}
+
+// whether the ip address is a public unicast address
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, p := range fetchBlockedPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// The address is checked after DNS resolution, right before connecting,
+// so redirects and DNS rebinding can not be used to reach internal services.
+var fetchClient = &http.Client{
+	Timeout: fetchTimeout,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: time.Second * 10,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+
+				ip := net.ParseIP(host)
+				if ip == nil || !isPublicIP(ip) {
+					return ErrForbiddenURL
+				}
+
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   time.Second * 10,
+		ResponseHeaderTimeout: time.Second * 10,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= fetchMaxRedirects {
+			return fmt.Errorf("fetch: stopped after %d redirects", fetchMaxRedirects)
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return ErrInvalidURL
+		}
+		return nil
+	},
+}
+
+// FetchURL downloads a remote image for uploading
+//
+// maxSize is the maximum size of the response body in bytes
+//
+// return the content and the content type of the file
+func (*upload) FetchURL(rawURL string, maxSize int) ([]byte, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, "", ErrInvalidURL
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", ErrInvalidURL
+	}
+
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		if errors.Is(err, ErrForbiddenURL) {
+			return nil, "", ErrForbiddenURL
+		}
+		return nil, "", fmt.Errorf("fetch: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%w: %d", ErrRemoteStatus, resp.StatusCode)
+	}
+
+	if resp.ContentLength > int64(maxSize) {
+		return nil, "", ErrRemoteTooLarge
+	}
+
+	// read one more byte to find out whether the body exceeds the limit
+	content, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxSize)+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("fetch: %w", err)
+	}
+
+	if len(content) > maxSize {
+		return nil, "", ErrRemoteTooLarge
+	}
+
+	contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		contentType = ""
+	}
+
+	return content, contentType, nil
+}
@@ -62,6 +62,9 @@ func (*group) Delete(id int) error {
 	return db.GroupDelete(id)
 }
 
-func (*group) Edit(id int, name string, allow_upload bool, max_file_size, upload_per_minute, upload_per_hour, upload_per_day, upload_per_month, total_uploads, max_retention_seconds int) error {
-	return db.GroupEdit(id, name, allow_upload, max_file_size, upload_per_minute, upload_per_hour, upload_per_day, upload_per_month, total_uploads, max_retention_seconds)
+func (*group) Edit(id int, name string, allow_upload bool, max_file_size, upload_per_minute, upload_per_hour, upload_per_day, upload_per_month, total_uploads, max_retention_seconds, max_storage_bytes, max_width, max_height, max_pixels int, downscale_oversized bool, metadata_policy string, watermark bool) error {
+	if _, ok := metadataPolicies[metadata_policy]; !ok {
+		metadata_policy = METADATA_STRIP
+	}
+	return db.GroupEdit(id, name, allow_upload, max_file_size, upload_per_minute, upload_per_hour, upload_per_day, upload_per_month, total_uploads, max_retention_seconds, max_storage_bytes, max_width, max_height, max_pixels, downscale_oversized, metadata_policy, watermark)
 }
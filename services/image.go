@@ -1,31 +1,67 @@
 package services
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"imgu2/db"
+	"imgu2/libvips"
 	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
 )
 
 type image struct{}
 
 var Image = image{}
 
-// Get the content of the file using the public file name.
+// Get the content of the file using the public file name, or the content
+// of a variant if the type of the variant is in the Accept header.
 //
-// return a byte array or a URL
+// return a byte array or a URL, the content type (which may be empty for
+// images uploaded before the metadata is recorded), the entity tag of the
+// content, and whether the response depends on the Accept header
 //
 // return nil if image not found
-func (*image) Get(fileName string) (any, error) {
+func (m *image) Get(fileName string, accept string) (any, string, string, bool, error) {
 	img, err := db.ImageFindByFileName(fileName)
 	if err != nil {
-		return nil, err
+		return nil, "", "", false, err
 	}
 
 	if img == nil {
-		return nil, nil
+		return nil, "", "", false, nil
+	}
+
+	v, vary, err := Variant.Negotiate(img.Id, accept)
+	if err != nil {
+		return nil, "", "", false, err
+	}
+
+	if v != nil {
+		c, err := Storage.GetFile(v.StorageId, v.InternalName)
+		return c, v.MimeType, m.ETag(img, strings.TrimPrefix(v.MimeType, "image/")), vary, err
 	}
 
-	return Storage.GetFile(img.StorageId, img.InternalName)
+	c, err := Storage.GetFile(img.StorageId, img.InternalName)
+	return c, img.MimeType, m.ETag(img, ""), vary, err
+}
+
+// ETag returns a strong entity tag which changes with the version of an
+// image. suffix tells apart the files derived from the image, e.g. the
+// variants and the thumbnail.
+func (*image) ETag(i *db.Image, suffix string) string {
+	tag := strconv.Itoa(i.Id) + "." + strconv.Itoa(i.Version)
+	if suffix != "" {
+		tag += "." + suffix
+	}
+	return `"` + tag + `"`
 }
 
 // return nil if not found
@@ -62,10 +98,259 @@ func (*image) CountByUser(userId int) (int, error) {
 	return db.ImageCountByUser(userId)
 }
 
+// only the sha256 hash of the delete token is stored in the database
+func hashDeleteToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// whether token is the secret token in the deletion link of the image
+func (*image) VerifyDeleteToken(i *db.Image, token string) bool {
+	if i.DeleteTokenHash == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashDeleteToken(token)), []byte(i.DeleteTokenHash)) == 1
+}
+
+// Read the stored file of an image
+func (*image) Read(i *db.Image) ([]byte, error) {
+	return readImageFile(i)
+}
+
+// the mime type of the stored file, which is guessed from the file name of
+// images uploaded before the type is recorded
+func (*image) MimeType(i *db.Image) string {
+	if i.MimeType != "" {
+		return i.MimeType
+	}
+	return mime.TypeByExtension(path.Ext(i.FileName))
+}
+
+// Replace the stored file of an image with an encoded image under the same
+// file name. The thumbnail and the variants are generated again.
+//
+// The previous file is kept as a version of the image if the settings keep
+// any versions, and the oldest versions beyond the limit are deleted.
+// Otherwise, the previous file is deleted if no other images share it.
+//
+// mimeType must be the type of the image, since the file name is kept.
+// encode encodes the new image to other formats for the variants.
+func (*image) Replace(i *db.Image, b []byte, mimeType string, phash int64, encode func(libvips.Format) ([]byte, error)) error {
+	kept, err := Setting.GetImageVersionsKept()
+	if err != nil {
+		return err
+	}
+
+	meta, err := describeImage(b, mimeType)
+	if err != nil {
+		return fmt.Errorf("replace image: %w", err)
+	}
+	meta.PHash = sql.NullInt64{Valid: true, Int64: phash}
+
+	c, err := Content.Put(i.FileName, b)
+	if err != nil {
+		return fmt.Errorf("replace image: %w", err)
+	}
+
+	err = db.ImageSetContent(i.Id, c.StorageId, c.InternalName, c.Id, meta, kept > 0)
+	if err != nil {
+		unrefErr := Content.Unref(c)
+		if unrefErr != nil {
+			slog.Error("replace image: unref content", "err", unrefErr, "content", c.Id)
+		}
+		return err
+	}
+
+	if kept > 0 {
+		err = pruneImageVersions(i.Id, kept)
+		if err != nil {
+			slog.Error("replace image: delete old versions", "file name", i.FileName, "err", err)
+		}
+	} else {
+		err = deleteStoredFile(i.StorageId, i.InternalName, i.ContentId)
+		if err != nil {
+			slog.Error("replace image: delete previous file", "file name", i.FileName, "err", err)
+		}
+	}
+
+	regenerateImageFiles(i, b, mimeType, meta.Frames, encode)
+
+	return nil
+}
+
+// list the previous versions of an image, newest first
+func (*image) Versions(i *db.Image) ([]db.ImageVersion, error) {
+	return db.ImageVersionFindByImage(i.Id)
+}
+
+// Restore makes a previous version the current file of an image, and keeps
+// the current file as a version. The restored file gets a new version
+// number, so that cached copies of the current file are not reused.
+//
+// return false if the version is not a version of the image
+func (*image) Restore(i *db.Image, versionId int) (bool, error) {
+	ok, err := db.ImageVersionRestore(i.Id, versionId)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	restored, err := db.ImageFindByFileName(i.FileName)
+	if err != nil {
+		return false, err
+	}
+	if restored == nil {
+		// the image expired in the meantime
+		return true, nil
+	}
+
+	b, err := readImageFile(restored)
+	if err != nil {
+		// the thumbnail is generated again by the backfill task
+		slog.Error("restore image: read file", "file name", i.FileName, "err", err)
+		regenerateImageFiles(i, nil, "", 0, nil)
+		return true, nil
+	}
+
+	// the restored file is already encoded with the options of its upload
+	encode := func(format libvips.Format) ([]byte, error) {
+		return libvips.LibvipsEncode(b, format, restored.Frames > 1, false, -1, -1, 0, 0, libvips.METADATA_KEEP, nil)
+	}
+
+	regenerateImageFiles(i, b, restored.MimeType, restored.Frames, encode)
+
+	return true, nil
+}
+
+// regenerateImageFiles deletes the thumbnail and the variants of the
+// previous file of an image, and generates them from the new file b
+//
+// nothing is generated if b is nil
+func regenerateImageFiles(i *db.Image, b []byte, mimeType string, frames int, encode func(libvips.Format) ([]byte, error)) {
+	if i.Thumbnail.Valid {
+		err := Content.Unref(&db.Content{Id: int(i.Thumbnail.Int32)})
+		if err != nil {
+			slog.Error("delete thumbnail", "file name", i.FileName, "content", i.Thumbnail.Int32, "err", err)
+		}
+	}
+
+	err := Variant.DeleteAll(i.Id)
+	if err != nil {
+		slog.Error("delete variants", "file name", i.FileName, "err", err)
+	}
+
+	if b == nil {
+		return
+	}
+
+	// the image is usable without a thumbnail, which is generated again by the backfill task
+	err = Thumbnail.Generate(i.Id, i.FileName, b)
+	if err != nil {
+		slog.Error("generate thumbnail", "file name", i.FileName, "err", err)
+	}
+
+	err = Variant.Create(i.Id, i.FileName, mimeType, len(b), frames, encode)
+	if err != nil {
+		slog.Error("create variants", "file name", i.FileName, "err", err)
+	}
+}
+
+// delete the oldest versions of an image, so that at most kept versions
+// are left
+func pruneImageVersions(imageId int, kept int) error {
+	versions, err := db.ImageVersionFindByImage(imageId)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range versions[min(kept, len(versions)):] {
+		err = deleteImageVersion(&v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func deleteImageVersion(v *db.ImageVersion) error {
+	err := db.ImageVersionDelete(v.Id)
+	if err != nil {
+		return err
+	}
+
+	return deleteStoredFile(v.StorageId, v.InternalName, v.ContentId)
+}
+
+// remove a reference to the stored file of an image or a version, files
+// stored before deduplication are not shared and are deleted directly
+func deleteStoredFile(storageId int, internalName string, contentId sql.NullInt32) error {
+	if contentId.Valid {
+		return Content.Unref(&db.Content{Id: int(contentId.Int32)})
+	}
+	return Storage.DeleteFileFromDriver(storageId, internalName)
+}
+
 // permanently delete an image (delete from database and storage driver)
+// and its previous versions
+//
+// The stored file is only deleted from the storage driver if no other
+// images share the same content.
 //
 // error occurred when delete the file from storage is ignored if force == true
 func (*image) Delete(i *db.Image, force bool) error {
+	err := Variant.DeleteAll(i.Id)
+	if err != nil {
+		return fmt.Errorf("delete image: %w", err)
+	}
+
+	err = pruneImageVersions(i.Id, 0)
+	if err != nil {
+		if !force {
+			return fmt.Errorf("delete image: %w", err)
+		}
+		slog.Error("delete image versions", "file name", i.FileName, "err", err)
+	}
+
+	err = deleteImage(i, force)
+	if err != nil {
+		return err
+	}
+
+	if i.Thumbnail.Valid {
+		err = Content.Unref(&db.Content{Id: int(i.Thumbnail.Int32)})
+		if err != nil {
+			slog.Error("delete thumbnail", "file name", i.FileName, "content", i.Thumbnail.Int32, "err", err)
+		}
+	}
+
+	err = db.BackfillFailureDeleteByImage(i.Id)
+	if err != nil {
+		slog.Error("delete backfill failures", "file name", i.FileName, "err", err)
+	}
+
+	return nil
+}
+
+func deleteImage(i *db.Image, force bool) error {
+	if i.ContentId.Valid {
+		contentMutex.Lock()
+		defer contentMutex.Unlock()
+
+		c, err := db.ContentFindById(int(i.ContentId.Int32))
+		if err != nil {
+			return fmt.Errorf("delete image: %w", err)
+		}
+
+		if c != nil && c.RefCount > 1 {
+			// the file is still used by other images
+			err = db.ImageDeleteWithContent(i.Id, c.Id)
+			if err != nil {
+				return fmt.Errorf("delete image: %w", err)
+			}
+			return nil
+		}
+	}
+
 	err := Storage.DeleteFileFromDriver(i.StorageId, i.InternalName)
 	if err != nil {
 		if force {
@@ -75,10 +360,83 @@ func (*image) Delete(i *db.Image, force bool) error {
 		}
 	}
 
-	err = db.ImageDelete(i.Id)
+	if i.ContentId.Valid {
+		err = db.ImageDeleteWithContent(i.Id, int(i.ContentId.Int32))
+	} else {
+		err = db.ImageDelete(i.Id)
+	}
 	if err != nil {
 		return fmt.Errorf("delete image: %w", err)
 	}
 
 	return nil
 }
+
+// FillMetadata probes the stored files of images uploaded before the
+// metadata is recorded. Images which can not be read are skipped, and are
+// not retried after failing a few times.
+func (*image) FillMetadata() error {
+	afterId := 0
+
+	for {
+		images, err := db.ImageFindWithoutMetadata(afterId, 100)
+		if err != nil {
+			return err
+		}
+
+		if len(images) == 0 {
+			return nil
+		}
+
+		for _, v := range images {
+			afterId = v.Id
+
+			err := fillImageMetadata(&v)
+			if err != nil {
+				slog.Error("fill image metadata", "file name", v.FileName, "err", err)
+
+				err = db.BackfillFailureRecord(v.Id, db.BackfillMetadata)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// read the stored file of an image, which is downloaded if the storage
+// driver returns a url
+func readImageFile(i *db.Image) ([]byte, error) {
+	c, err := Storage.GetFile(i.StorageId, i.InternalName)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := c.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return fetchStorageURL(v)
+	default:
+		return nil, fmt.Errorf("unexpected type: %s", reflect.TypeOf(c))
+	}
+}
+
+func fillImageMetadata(i *db.Image) error {
+	b, err := readImageFile(i)
+	if err != nil {
+		return err
+	}
+
+	info, err := libvips.LibvipsProbe(b)
+	if err != nil {
+		return err
+	}
+
+	mimeType := mime.TypeByExtension(path.Ext(i.FileName))
+	if mimeType == "" {
+		mimeType = http.DetectContentType(b)
+	}
+
+	return db.ImageSetMetadata(i.Id, info.Width, info.Height, info.Frames, len(b), mimeType)
+}
@@ -0,0 +1,320 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"imgu2/db"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrOffsetMismatch = errors.New("partial upload: offset mismatch")
+
+// the uploader has too many unfinished uploads, or too many bytes staged
+var ErrTooManyPartialUploads = errors.New("partial upload: too many unfinished uploads")
+
+// all bytes of the upload are received, and the image is being saved or
+// has been saved by another request
+var ErrUploadFinished = errors.New("partial upload: finished")
+
+type partialUpload struct {
+	// directory where partial uploads are staged
+	dir string
+
+	// prevent concurrent writes to the same upload
+	locks sync.Map
+}
+
+var PartialUpload = partialUpload{}
+
+// partial uploads which have not received any data for this long are deleted
+const partialUploadMaxIdle = time.Hour * 24
+
+const (
+	// maximum number of unfinished uploads of an uploader
+	maxOpenPartialUploads = 10
+
+	// maximum total length of the unfinished uploads of an uploader, or the
+	// maximum file size of the user group if it is larger
+	maxStagedBytes = 1 << 30
+)
+
+// createMutex serializes checking the unfinished uploads and creating one
+var createMutex sync.Mutex
+
+// create the staging directory
+func (p *partialUpload) Init(dir string) error {
+	absPath, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("partial upload: invalid path: %w", err)
+	}
+
+	err = os.MkdirAll(absPath, fs.ModePerm)
+	if err != nil {
+		return fmt.Errorf("partial upload: create dir: %w", err)
+	}
+
+	p.dir = absPath
+	return nil
+}
+
+func (p *partialUpload) path(id string) string {
+	return filepath.Join(p.dir, id)
+}
+
+func (p *partialUpload) lock(id string) func() {
+	m, _ := p.locks.LoadOrStore(id, &sync.Mutex{})
+	m.(*sync.Mutex).Lock()
+	return m.(*sync.Mutex).Unlock
+}
+
+// create an empty partial upload
+//
+// userId may be set to nil to represent a guest user
+//
+// The upload is reserved in the rate limits when it is created, see
+// Upload.ReserveUpload, so it is not rejected after all bytes are received.
+// The reservation is cancelled if the upload is deleted before it is
+// finished. ErrTooManyPartialUploads is returned if the uploader has too
+// many unfinished uploads.
+//
+// return the id of the upload, or whether the uploader is rate limited and
+// the reset time, see Upload.CheckRateLimit
+func (p *partialUpload) Create(userId sql.NullInt32, group *db.Group, ipAddr string, length int, metadata string) (id string, limited bool, reset time.Time, err error) {
+	createMutex.Lock()
+	defer createMutex.Unlock()
+
+	cnt, size, err := db.PartialUploadCountOpen(userId, ipAddr)
+	if err != nil {
+		return "", false, time.Time{}, err
+	}
+
+	if cnt >= maxOpenPartialUploads || size+length > max(maxStagedBytes, group.MaxFileSize) {
+		return "", false, time.Time{}, ErrTooManyPartialUploads
+	}
+
+	limited, reset, uploadLog, err := Upload.reserve(userId, group, ipAddr)
+	if err != nil || limited {
+		return "", limited, reset, err
+	}
+
+	id = RandomHexString(16)
+
+	f, err := os.OpenFile(p.path(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		cancelReservation(uploadLog)
+		return "", false, time.Time{}, fmt.Errorf("partial upload: %w", err)
+	}
+	f.Close()
+
+	err = db.PartialUploadCreate(id, userId, ipAddr, length, metadata, uploadLog)
+	if err != nil {
+		os.Remove(p.path(id))
+		cancelReservation(uploadLog)
+		return "", false, time.Time{}, err
+	}
+
+	return id, false, time.Time{}, nil
+}
+
+// return (nil, 0, nil) if not found
+//
+// return the upload and the number of bytes received
+func (p *partialUpload) Find(id string) (*db.PartialUpload, int, error) {
+	u, err := db.PartialUploadFindById(id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if u == nil {
+		return nil, 0, nil
+	}
+
+	// all bytes are received, and the staged file is removed once the
+	// upload is finished
+	if u.Finishing {
+		return u, u.Length, nil
+	}
+
+	stat, err := os.Stat(p.path(id))
+	if err != nil {
+		return nil, 0, fmt.Errorf("partial upload: %w", err)
+	}
+
+	return u, int(stat.Size()), nil
+}
+
+// Append writes a chunk to the end of the upload. Data exceeding the
+// length of the upload is ignored.
+//
+// offset must be equal to the number of bytes received, or ErrOffsetMismatch
+// is returned. ErrUploadFinished is returned if all bytes have been received.
+//
+// return the number of bytes received after writing the chunk, which is
+// updated even if the chunk is not completely received, and whether the
+// upload is complete. Only one call returns true for an upload, and the
+// caller must save the image and call Finish, or Delete if it fails.
+func (p *partialUpload) Append(u *db.PartialUpload, offset int, r io.Reader) (int, bool, error) {
+	unlock := p.lock(u.Id)
+	defer unlock()
+
+	// the upload may have been completed by another request
+	current, err := db.PartialUploadFindById(u.Id)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if current == nil {
+		return 0, false, fmt.Errorf("partial upload: %s not found", u.Id)
+	}
+
+	if current.Finishing {
+		return u.Length, false, ErrUploadFinished
+	}
+
+	f, err := os.OpenFile(p.path(u.Id), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, false, fmt.Errorf("partial upload: %w", err)
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, false, fmt.Errorf("partial upload: %w", err)
+	}
+
+	if int(stat.Size()) != offset {
+		return int(stat.Size()), false, ErrOffsetMismatch
+	}
+
+	n, err := io.Copy(f, io.LimitReader(r, int64(u.Length-offset)))
+
+	touchErr := db.PartialUploadTouch(u.Id)
+	if touchErr != nil {
+		slog.Error("partial upload: touch", "err", touchErr, "id", u.Id)
+	}
+
+	newOffset := offset + int(n)
+
+	if err != nil {
+		return newOffset, false, fmt.Errorf("partial upload: %w", err)
+	}
+
+	if newOffset < u.Length {
+		return newOffset, false, nil
+	}
+
+	complete, err := db.PartialUploadSetFinishing(u.Id)
+	if err != nil {
+		return newOffset, false, err
+	}
+
+	return newOffset, complete, nil
+}
+
+// read the content of a finished upload
+func (p *partialUpload) ReadAll(id string) ([]byte, error) {
+	content, err := os.ReadFile(p.path(id))
+	if err != nil {
+		return nil, fmt.Errorf("partial upload: %w", err)
+	}
+	return content, nil
+}
+
+// Finish removes the staged file and records the result of the upload
+//
+// The delete token of the image is not kept, and is only returned to the
+// request which completes the upload.
+func (p *partialUpload) Finish(id string, fileName string, mimeType string) error {
+	defer p.locks.Delete(id)
+
+	err := os.Remove(p.path(id))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("partial upload: %w", err)
+	}
+
+	return db.PartialUploadSetResult(id, fileName, mimeType)
+}
+
+// delete the upload and the staged file
+//
+// the rate limit reservation is cancelled if the upload is not finished
+func (p *partialUpload) Delete(id string) error {
+	unlock := p.lock(id)
+	defer unlock()
+	defer p.locks.Delete(id)
+
+	u, err := db.PartialUploadFindById(id)
+	if err != nil {
+		return err
+	}
+
+	if u == nil {
+		return nil
+	}
+
+	err = os.Remove(p.path(id))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("partial upload: %w", err)
+	}
+
+	err = db.PartialUploadDelete(id)
+	if err != nil {
+		return err
+	}
+
+	if u.FileName == "" && u.UploadLog.Valid {
+		return db.UploadLogDelete(int(u.UploadLog.Int32))
+	}
+
+	return nil
+}
+
+// delete uploads which are abandoned or finished a long time ago
+func (p *partialUpload) CleanStale() error {
+	ids, err := db.PartialUploadFindStale(time.Now().Add(-partialUploadMaxIdle))
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		err := p.Delete(id)
+		if err != nil {
+			slog.Error("delete stale partial upload", "id", id, "err", err)
+		}
+	}
+
+	return nil
+}
+
+// ParseMetadata decodes the Upload-Metadata header of the tus protocol,
+// which consists of comma separated key and base64 encoded value pairs
+func (*partialUpload) ParseMetadata(header string) (map[string]string, error) {
+	m := make(map[string]string)
+
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, value, _ := strings.Cut(pair, " ")
+
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("partial upload: invalid metadata: %s", key)
+		}
+
+		m[key] = string(decoded)
+	}
+
+	return m, nil
+}
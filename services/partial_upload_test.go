@@ -0,0 +1,210 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"imgu2/db"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"empty", "", map[string]string{}, false},
+		{
+			name:   "pairs",
+			header: "filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==,filetype aW1hZ2UvcG5n",
+			want:   map[string]string{"filename": "world_domination_plan.pdf", "filetype": "image/png"},
+		},
+		{"key without value", "is_confidential", map[string]string{"is_confidential": ""}, false},
+		{"spaces and empty pairs", " expire MzYwMA== ,, format d2VicA== ", map[string]string{"expire": "3600", "format": "webp"}, false},
+		{"invalid base64", "filename !!!", nil, true},
+		{"space in value", "filename YWJj ZA", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PartialUpload.ParseMetadata(tt.header)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseMetadata() = %v, want an error", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ParseMetadata() error = %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseMetadata() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPartialUploadAppend(t *testing.T) {
+	initTestDB(t)
+
+	p := &partialUpload{}
+	err := p.Init(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, _, _, err := p.Create(sql.NullInt32{}, &db.Group{MaxFileSize: 10}, "127.0.0.1", 10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, offset, err := p.Find(id)
+	if err != nil || u == nil || offset != 0 {
+		t.Fatalf("Find() = %v, %d, %v", u, offset, err)
+	}
+
+	// each step is applied to the same upload in order
+	steps := []struct {
+		name         string
+		offset       int
+		data         string
+		wantOffset   int
+		wantComplete bool
+		wantErr      error
+	}{
+		{"first chunk", 0, "hello", 5, false, nil},
+		{"retried chunk", 0, "hello", 5, false, ErrOffsetMismatch},
+		{"offset ahead", 6, "orld", 5, false, ErrOffsetMismatch},
+		{"empty chunk", 5, "", 5, false, nil},
+		{"last chunk truncated", 5, "world and more", 10, true, nil},
+		{"retried last chunk", 5, "world", 10, false, ErrUploadFinished},
+		{"after the end", 10, "", 10, false, ErrUploadFinished},
+	}
+
+	for _, tt := range steps {
+		newOffset, complete, err := p.Append(u, tt.offset, strings.NewReader(tt.data))
+		if !errors.Is(err, tt.wantErr) {
+			t.Fatalf("%s: Append() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+
+		if newOffset != tt.wantOffset || complete != tt.wantComplete {
+			t.Fatalf("%s: Append() = %d, %v, want %d, %v", tt.name, newOffset, complete, tt.wantOffset, tt.wantComplete)
+		}
+	}
+
+	content, err := p.ReadAll(id)
+	if err != nil || string(content) != "helloworld" {
+		t.Fatalf("ReadAll() = %q, %v", content, err)
+	}
+
+	err = p.Finish(id, "abc.png", "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, offset, err = p.Find(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if offset != 10 || u.FileName != "abc.png" || u.MimeType != "image/png" {
+		t.Errorf("Find() after Finish() = %+v, %d", u, offset)
+	}
+}
+
+func TestPartialUploadCreateLimits(t *testing.T) {
+	initTestDB(t)
+
+	p := &partialUpload{}
+	err := p.Init(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	group := &db.Group{MaxFileSize: maxStagedBytes / 2, UploadPerHour: maxOpenPartialUploads}
+	guest := sql.NullInt32{}
+
+	// uploads reserved in the rate limits
+	reserved := func() int {
+		cnt, err := db.UploadLogCountSince(guest, "127.0.0.1", time.Unix(0, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cnt
+	}
+
+	// at most half of the staged bytes are left for the other uploads
+	big, _, _, err := p.Create(guest, group, "127.0.0.1", maxStagedBytes/2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, _, err = p.Create(guest, group, "127.0.0.1", maxStagedBytes/2+1, "")
+	if !errors.Is(err, ErrTooManyPartialUploads) {
+		t.Fatalf("Create() exceeding the staged bytes error = %v, want ErrTooManyPartialUploads", err)
+	}
+
+	for i := 1; i < maxOpenPartialUploads; i++ {
+		_, _, _, err := p.Create(guest, group, "127.0.0.1", 1, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, _, _, err = p.Create(guest, group, "127.0.0.1", 1, "")
+	if !errors.Is(err, ErrTooManyPartialUploads) {
+		t.Fatalf("Create() exceeding the open uploads error = %v, want ErrTooManyPartialUploads", err)
+	}
+
+	// other uploaders are not affected
+	_, _, _, err = p.Create(guest, group, "127.0.0.2", 1, "")
+	if err != nil {
+		t.Fatalf("Create() by another uploader error = %v", err)
+	}
+
+	if n := reserved(); n != maxOpenPartialUploads {
+		t.Fatalf("reserved uploads = %d, want %d", n, maxOpenPartialUploads)
+	}
+
+	// deleting an unfinished upload cancels its reservation
+	err = p.Delete(big)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := reserved(); n != maxOpenPartialUploads-1 {
+		t.Fatalf("reserved uploads after Delete() = %d, want %d", n, maxOpenPartialUploads-1)
+	}
+
+	// the last upload within the rate limit, which is kept after it is
+	// finished and deleted
+	last, limited, _, err := p.Create(guest, group, "127.0.0.1", 1, "")
+	if err != nil || limited {
+		t.Fatalf("Create() = %v, %v", limited, err)
+	}
+
+	err = p.Finish(last, "abc.png", "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.Delete(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, limited, reset, err := p.Create(guest, group, "127.0.0.1", 1, "")
+	if err != nil || !limited || reset.IsZero() {
+		t.Fatalf("Create() over the rate limit = %v, %v, %v", limited, reset, err)
+	}
+
+	if n := reserved(); n != maxOpenPartialUploads {
+		t.Errorf("reserved uploads = %d, want %d", n, maxOpenPartialUploads)
+	}
+}
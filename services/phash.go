@@ -0,0 +1,202 @@
+package services
+
+import (
+	"fmt"
+	"imgu2/db"
+	"imgu2/libvips"
+	"log/slog"
+	"math/bits"
+	"sort"
+)
+
+// images within this Hamming distance are listed by FindSimilar
+const similarDistance = 12
+
+// the maximum number of images listed by FindSimilar
+const similarLimit = 100
+
+type perceptualHash struct{}
+
+var PerceptualHash = perceptualHash{}
+
+// SimilarImage is an image found by FindSimilar
+type SimilarImage struct {
+	db.Image
+	Distance int // Hamming distance between the perceptual hashes
+}
+
+// Compute the 64-bit difference hash (dHash) of an image. The image is
+// scaled to 9x8 grayscale pixels, and each bit is set if a pixel is brighter
+// than the pixel on its right, so the hash survives re-encoding, resizing
+// and small edits. Only the first frame of animated images is used.
+func (*perceptualHash) Compute(b []byte) (int64, error) {
+	pix, err := libvips.LibvipsGrayscale(b, 9, 8)
+	if err != nil {
+		return 0, fmt.Errorf("perceptual hash: %w", err)
+	}
+
+	return differenceHash(pix), nil
+}
+
+// the dHash of 9x8 grayscale pixels, the first pixel is the highest bit
+func differenceHash(pix []byte) int64 {
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if pix[y*9+x] > pix[y*9+x+1] {
+				hash |= 1
+			}
+		}
+	}
+
+	return int64(hash)
+}
+
+// the number of different bits of two hashes
+func hammingDistance(a int64, b int64) int {
+	return bits.OnesCount64(uint64(a ^ b))
+}
+
+// IsBlocked checks whether a hash is within the Hamming distance in the
+// settings of any blocked hash
+func (*perceptualHash) IsBlocked(hash int64) (bool, error) {
+	distance, err := Setting.GetPHashBlockDistance()
+	if err != nil {
+		return false, err
+	}
+
+	blocked, err := db.BlockedHashFindAll()
+	if err != nil {
+		return false, err
+	}
+
+	for _, v := range blocked {
+		if hammingDistance(hash, v.Hash) <= distance {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Block the perceptual hash of an image, the file name of the image is
+// recorded as the note
+//
+// return false if the perceptual hash of the image has not been computed
+func (h *perceptualHash) Block(i *db.Image) (bool, error) {
+	if !i.PHash.Valid {
+		return false, nil
+	}
+
+	err := h.BlockHash(i.PHash.Int64, i.FileName)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// BlockHash blocks a perceptual hash, note is shown in the blocklist
+func (*perceptualHash) BlockHash(hash int64, note string) error {
+	return db.BlockedHashCreate(hash, note)
+}
+
+func (*perceptualHash) Unblock(id int) error {
+	return db.BlockedHashDelete(id)
+}
+
+// list all blocked hashes, newest first
+func (*perceptualHash) Blocklist() ([]db.BlockedHash, error) {
+	return db.BlockedHashFindAll()
+}
+
+// FindSimilar lists unexpired images whose perceptual hash is close to the
+// hash of an image, the most similar images first. The image itself is not
+// listed.
+func (*perceptualHash) FindSimilar(i *db.Image) ([]SimilarImage, error) {
+	similar := make([]SimilarImage, 0)
+
+	if !i.PHash.Valid {
+		return similar, nil
+	}
+
+	afterId := 0
+
+	for {
+		images, err := db.ImageFindWithPHash(afterId, 1000)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(images) == 0 {
+			break
+		}
+
+		for _, v := range images {
+			afterId = v.Id
+
+			if v.Id == i.Id {
+				continue
+			}
+
+			d := hammingDistance(i.PHash.Int64, v.PHash.Int64)
+			if d <= similarDistance {
+				similar = append(similar, SimilarImage{Image: v, Distance: d})
+			}
+		}
+	}
+
+	sort.SliceStable(similar, func(a, b int) bool {
+		return similar[a].Distance < similar[b].Distance
+	})
+
+	if len(similar) > similarLimit {
+		similar = similar[:similarLimit]
+	}
+
+	return similar, nil
+}
+
+// Backfill computes the perceptual hash of images uploaded before perceptual
+// hashes are added. The stored file is hashed, since the uploaded file is
+// not kept. Images which can not be read are skipped, and are not retried
+// after failing a few times.
+func (h *perceptualHash) Backfill() error {
+	afterId := 0
+
+	for {
+		images, err := db.ImageFindWithoutPHash(afterId, 100)
+		if err != nil {
+			return err
+		}
+
+		if len(images) == 0 {
+			return nil
+		}
+
+		for _, v := range images {
+			afterId = v.Id
+
+			var hash int64
+			b, err := readImageFile(&v)
+			if err == nil {
+				hash, err = h.Compute(b)
+			}
+			if err != nil {
+				slog.Error("compute perceptual hash", "file name", v.FileName, "err", err)
+
+				err = db.BackfillFailureRecord(v.Id, db.BackfillPHash)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			err = db.ImageSetPHash(v.Id, hash)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package services
+
+import "testing"
+
+// 9x8 grayscale pixels, whose brightness is given by f
+func grayPixels(f func(x, y int) byte) []byte {
+	pix := make([]byte, 0, 9*8)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 9; x++ {
+			pix = append(pix, f(x, y))
+		}
+	}
+	return pix
+}
+
+func TestDifferenceHash(t *testing.T) {
+	tests := []struct {
+		name string
+		pix  []byte
+		want int64
+	}{
+		{"flat", grayPixels(func(x, y int) byte { return 128 }), 0},
+		{"brighter on the right", grayPixels(func(x, y int) byte { return byte(x * 10) }), 0},
+		{"darker on the right", grayPixels(func(x, y int) byte { return byte(255 - x*10) }), -1},
+		{
+			name: "first pixel",
+			pix: grayPixels(func(x, y int) byte {
+				if x == 0 && y == 0 {
+					return 255
+				}
+				return 0
+			}),
+			want: -1 << 63,
+		},
+		{
+			// the last column is only compared with its left neighbour
+			name: "last pixel",
+			pix: grayPixels(func(x, y int) byte {
+				if x == 7 && y == 7 {
+					return 255
+				}
+				return 0
+			}),
+			want: 1,
+		},
+		{
+			name: "top half",
+			pix: grayPixels(func(x, y int) byte {
+				if y < 4 {
+					return byte(255 - x*10)
+				}
+				return 0
+			}),
+			want: -1 << 32,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := differenceHash(tt.pix)
+			if got != tt.want {
+				t.Errorf("differenceHash() = %016x, want %016x", uint64(got), uint64(tt.want))
+			}
+		})
+	}
+}
+
+func TestHammingDistance(t *testing.T) {
+	tests := []struct {
+		a    int64
+		b    int64
+		want int
+	}{
+		{0, 0, 0},
+		{0, 1, 1},
+		{0b1010, 0b0101, 4},
+		{0, -1, 64},
+		{-1 << 63, 0, 1},
+		{0x0f0f0f0f0f0f0f0f, 0x0f0f0f0f0f0f0f0e, 1},
+	}
+
+	for _, tt := range tests {
+		got := hammingDistance(tt.a, tt.b)
+		if got != tt.want {
+			t.Errorf("hammingDistance(%x, %x) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+
+		// the distance is symmetric
+		got = hammingDistance(tt.b, tt.a)
+		if got != tt.want {
+			t.Errorf("hammingDistance(%x, %x) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
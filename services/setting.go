@@ -1,9 +1,16 @@
 package services
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"imgu2/db"
+	"imgu2/libvips"
+	"net/http"
 	"strconv"
+	"strings"
+	"time"
+	"unicode"
 )
 
 type setting struct{}
@@ -109,6 +116,203 @@ func (*setting) IsWEBPEncodingEnabled() (bool, error) {
 	return s == "true", nil
 }
 
+func (*setting) IsJXLEncodingEnabled() (bool, error) {
+	s, err := db.SettingFind("JXL_ENCODING")
+	if err != nil {
+		return false, err
+	}
+
+	return s == "true", nil
+}
+
+// whether AVIF and WebP variants are stored for new uploads
+func (*setting) IsStoreVariantsEnabled() (bool, error) {
+	s, err := db.SettingFind("STORE_VARIANTS")
+	if err != nil {
+		return false, err
+	}
+
+	return s == "true", nil
+}
+
+// the mime types of images which can be uploaded, regardless of the content
+// type sent by the client
+func (*setting) GetAllowedInputTypes() (map[string]bool, error) {
+	s, err := db.SettingFind("ALLOWED_INPUT_TYPES")
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]bool)
+	for _, t := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		m[strings.ToLower(t)] = true
+	}
+
+	return m, nil
+}
+
+// the minimum SSIM of images encoded by format=auto compared to the
+// uploaded image, or 0 if the quality is not checked
+func (*setting) GetAutoFormatMinSSIM() (float64, error) {
+	s, err := db.SettingFind("AUTO_FORMAT_MIN_SSIM")
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 || f > 1 {
+		return 0, fmt.Errorf("settings: auto format min ssim is not a number in [0,1]: %s", s)
+	}
+
+	return f, nil
+}
+
+// no more formats are tried by format=auto after this duration
+func (*setting) GetAutoFormatTimeBudget() (time.Duration, error) {
+	s, err := db.SettingFind("AUTO_FORMAT_TIME_BUDGET")
+	if err != nil {
+		return 0, err
+	}
+
+	ms, err := strconv.Atoi(s)
+	if err != nil || ms < 0 {
+		return 0, fmt.Errorf("settings: auto format time budget is not a positive integer: %s", s)
+	}
+
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// GetPHashBlockDistance returns the maximum Hamming distance between the
+// perceptual hash of an upload and a blocked hash for the upload to be
+// rejected
+func (*setting) GetPHashBlockDistance() (int, error) {
+	s, err := db.SettingFind("PHASH_BLOCK_DISTANCE")
+	if err != nil {
+		return 0, err
+	}
+
+	d, err := strconv.Atoi(s)
+	if err != nil || d < 0 || d > 64 {
+		return 0, fmt.Errorf("settings: perceptual hash block distance is not an integer between 0 and 64: %s", s)
+	}
+
+	return d, nil
+}
+
+// GetImageVersionsKept returns the number of previous versions kept when
+// an image is replaced, zero means previous versions are deleted
+func (*setting) GetImageVersionsKept() (int, error) {
+	s, err := db.SettingFind("IMAGE_VERSIONS_KEPT")
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > 100 {
+		return 0, fmt.Errorf("settings: image versions kept is not an integer between 0 and 100: %s", s)
+	}
+
+	return n, nil
+}
+
+var watermarkPositions = map[string]libvips.WatermarkPosition{
+	"top-left":     libvips.WATERMARK_TOP_LEFT,
+	"top-right":    libvips.WATERMARK_TOP_RIGHT,
+	"bottom-left":  libvips.WATERMARK_BOTTOM_LEFT,
+	"bottom-right": libvips.WATERMARK_BOTTOM_RIGHT,
+	"center":       libvips.WATERMARK_CENTER,
+}
+
+// GetWatermark returns the watermark drawn on uploaded images, or nil if
+// watermarks are disabled
+func (*setting) GetWatermark() (*libvips.Watermark, error) {
+	m, err := db.SettingFindAll()
+	if err != nil {
+		return nil, err
+	}
+
+	wm := &libvips.Watermark{
+		Position: watermarkPositions[m["WATERMARK_POSITION"]],
+	}
+
+	switch m["WATERMARK"] {
+	case "text":
+		if m["WATERMARK_TEXT"] == "" {
+			return nil, nil
+		}
+		wm.Text = m["WATERMARK_TEXT"]
+	case "image":
+		if m["WATERMARK_IMAGE"] == "" {
+			return nil, nil
+		}
+		wm.Image, err = base64.StdEncoding.DecodeString(m["WATERMARK_IMAGE"])
+		if err != nil {
+			return nil, fmt.Errorf("settings: invalid watermark image: %w", err)
+		}
+	default:
+		return nil, nil
+	}
+
+	wm.Opacity, err = strconv.Atoi(m["WATERMARK_OPACITY"])
+	if err != nil || wm.Opacity < 0 || wm.Opacity > 100 {
+		return nil, fmt.Errorf("settings: watermark opacity is not an integer in [0,100]: %s", m["WATERMARK_OPACITY"])
+	}
+
+	wm.Scale, err = strconv.Atoi(m["WATERMARK_SCALE"])
+	if err != nil || wm.Scale <= 0 || wm.Scale > 100 {
+		return nil, fmt.Errorf("settings: watermark scale is not an integer in [1,100]: %s", m["WATERMARK_SCALE"])
+	}
+
+	return wm, nil
+}
+
+var ErrInvalidWatermark = errors.New("settings: watermark is not a png image")
+
+// set the png image of the watermark
+func (*setting) SetWatermarkImage(b []byte) error {
+	if http.DetectContentType(b) != "image/png" {
+		return ErrInvalidWatermark
+	}
+
+	if _, err := libvips.LibvipsProbe(b); err != nil {
+		return ErrInvalidWatermark
+	}
+
+	return db.SetttingUpdate("WATERMARK_IMAGE", base64.StdEncoding.EncodeToString(b))
+}
+
+// return nil if the watermark image is not set
+func (*setting) GetWatermarkImage() ([]byte, error) {
+	s, err := db.SettingFind("WATERMARK_IMAGE")
+	if err != nil || s == "" {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// GetTransformPresets returns the transform presets which can be used
+// without signatures, mapping preset names to query strings
+//
+// the setting contains one preset per line, e.g. "thumb: width=200&height=200&fit=cover"
+func (*setting) GetTransformPresets() (map[string]string, error) {
+	s, err := db.SettingFind("TRANSFORM_PRESETS")
+	if err != nil {
+		return nil, err
+	}
+
+	presets := make(map[string]string)
+	for _, line := range strings.Split(s, "\n") {
+		name, query, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		presets[strings.TrimSpace(name)] = strings.TrimSpace(query)
+	}
+
+	return presets, nil
+}
+
 func (*setting) DefaultGroupGuest() (int, error) {
 	s, err := db.SettingFind("DEFAULT_GROUP_GUEST")
 	if err != nil {
@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"imgu2/db"
 	"imgu2/services/storages"
+	"io"
 	"log/slog"
+	"net/http"
+	"time"
 )
 
 type storage struct {
@@ -105,7 +108,7 @@ func (*storage) Create(name string, t string) (int, error) {
 }
 
 func (*storage) Delete(id int) error {
-	cnt, err := db.ImageCountByStorage(id)
+	cnt, err := db.StorageCountFiles(id)
 	if err != nil {
 		return err
 	}
@@ -166,3 +169,43 @@ func (s *storage) GetFile(id int, internalName string) (any, error) {
 
 	return nil, fmt.Errorf("storage driver %d does not exist", id)
 }
+
+// storageClient downloads files from storage drivers which return urls.
+// Unlike fetchClient, private addresses are allowed, since storage drivers
+// are configured by admins and are often on the local network.
+var storageClient = &http.Client{
+	Timeout: storageFetchTimeout,
+}
+
+const (
+	storageFetchTimeout = time.Minute
+
+	// the largest file read from storage drivers, which is also the
+	// largest file libvips returns
+	storageFetchMaxSize = 1 << 30
+)
+
+// download a file from a url returned by a storage driver
+func fetchStorageURL(rawURL string) ([]byte, error) {
+	resp, err := storageClient.Get(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("storage: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("storage: unexpected http status: %d", resp.StatusCode)
+	}
+
+	// read one more byte to find out whether the body exceeds the limit
+	b, err := io.ReadAll(io.LimitReader(resp.Body, storageFetchMaxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("storage: %w", err)
+	}
+
+	if len(b) > storageFetchMaxSize {
+		return nil, fmt.Errorf("storage: file larger than %d bytes", storageFetchMaxSize)
+	}
+
+	return b, nil
+}
@@ -21,15 +21,8 @@ func TaskStart() {
 		}
 
 		for _, v := range images {
-			// delete from storage
-			err = Storage.DeleteFileFromDriver(v.StorageId, v.InternalName)
-			if err != nil {
-				slog.Error("delete expired image", "storage", v.StorageId, "file name", v.FileName, "err", err)
-				continue
-			}
-
-			// delete from database
-			err = db.ImageDelete(v.Id)
+			// the stored file is kept if it is shared by other images
+			err = Image.Delete(&v, false)
 			if err != nil {
 				slog.Error("delete expired image", "storage", v.StorageId, "file name", v.FileName, "err", err)
 			}
@@ -37,6 +30,26 @@ func TaskStart() {
 		return nil
 	})
 
+	// clean abandoned resumable uploads
+	taskRegister("clean partial uploads", time.Hour, func() error {
+		return PartialUpload.CleanStale()
+	})
+
+	// generate missing thumbnails
+	taskRegister("generate thumbnails", time.Hour, func() error {
+		return Thumbnail.Backfill()
+	})
+
+	// compute missing blurhashes
+	taskRegister("compute blurhashes", time.Hour, func() error {
+		return BlurHash.Backfill()
+	})
+
+	// compute missing perceptual hashes
+	taskRegister("compute perceptual hashes", time.Hour, func() error {
+		return PerceptualHash.Backfill()
+	})
+
 	// clean expired sessions
 	taskRegister("clean sessions", time.Hour, func() error {
 		return db.SessionCleanExpired()
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"fmt"
+	"imgu2/db"
+	"imgu2/libvips"
+	"log/slog"
+	"path"
+	"strings"
+)
+
+// thumbnails fit inside a square of this size
+const thumbnailSize = 320
+
+type thumbnail struct{}
+
+var Thumbnail = thumbnail{}
+
+// Generate encodes a webp thumbnail from the content of the stored file of
+// an image, and stores it like an image
+func (*thumbnail) Generate(imageId int, fileName string, b []byte) error {
+	thumb, err := libvips.LibvipsTransform(b, &libvips.Transform{
+		Width:  thumbnailSize,
+		Height: thumbnailSize,
+	}, libvips.FORMAT_WEBP)
+	if err != nil {
+		return fmt.Errorf("thumbnail: %w", err)
+	}
+
+	c, err := Content.Put(strings.TrimSuffix(fileName, path.Ext(fileName))+"_thumb.webp", thumb)
+	if err != nil {
+		return fmt.Errorf("thumbnail: %w", err)
+	}
+
+	ok, err := db.ImageSetThumbnail(imageId, c.Id)
+	if err != nil || !ok {
+		// the image is deleted, or the thumbnail is generated concurrently
+		unrefErr := Content.Unref(c)
+		if unrefErr != nil {
+			slog.Error("thumbnail: unref content", "err", unrefErr, "content", c.Id)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Get the content of the thumbnail of an image.
+//
+// return a byte array or a URL
+//
+// return nil if the thumbnail has not been generated
+func (*thumbnail) Get(i *db.Image) (any, error) {
+	if !i.Thumbnail.Valid {
+		return nil, nil
+	}
+
+	c, err := db.ContentFindById(int(i.Thumbnail.Int32))
+	if err != nil || c == nil {
+		return nil, err
+	}
+
+	return Storage.GetFile(c.StorageId, c.InternalName)
+}
+
+// Backfill generates thumbnails of images uploaded before thumbnails are
+// added, or whose thumbnail failed to generate. Images which can not be
+// read are skipped, and are not retried after failing a few times.
+func (t *thumbnail) Backfill() error {
+	afterId := 0
+
+	for {
+		images, err := db.ImageFindWithoutThumbnail(afterId, 100)
+		if err != nil {
+			return err
+		}
+
+		if len(images) == 0 {
+			return nil
+		}
+
+		for _, v := range images {
+			afterId = v.Id
+
+			b, err := readImageFile(&v)
+			if err == nil {
+				err = t.Generate(v.Id, v.FileName, b)
+			}
+			if err != nil {
+				slog.Error("generate thumbnail", "file name", v.FileName, "err", err)
+
+				err = db.BackfillFailureRecord(v.Id, db.BackfillThumbnail)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package services
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"imgu2/db"
+	"imgu2/libvips"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// On-the-fly transformations of images, requested with the query string of
+// /i/{fileName}:
+//
+//	width, height  size of the bounding box, either may be omitted
+//	fit            "contain" (default) or "cover"
+//	crop           x,y,width,height of the area to keep, applied before resizing
+//	rotate         0, 90, 180 or 270
+//	format         webp, png, jpeg, gif, avif or jxl, defaults to the format of the image
+//
+// Arbitrary parameters are not accepted, or anyone could make the server
+// encode an endless number of variants. The parameters must either be an
+// admin defined preset (?preset=name) or be signed with the JWT secret (&sig=...).
+
+var (
+	ErrInvalidTransform    = errors.New("transform: invalid parameters")
+	ErrTransformNotAllowed = errors.New("transform: parameters are neither a preset nor signed")
+)
+
+const (
+	// the maximum width and height of the bounding box
+	transformMaxSize = 4096
+
+	// the maximum total size of cached results in bytes
+	transformCacheSize = 64 * 1024 * 1024
+)
+
+// the query parameters describing a transformation, other parameters are ignored
+var transformKeys = []string{"width", "height", "fit", "crop", "rotate", "format"}
+
+var transformFormats = map[string]struct {
+	vipsFormat  libvips.Format
+	contentType string
+}{
+	"webp": {libvips.FORMAT_WEBP, "image/webp"},
+	"png":  {libvips.FORMAT_PNG, "image/png"},
+	"jpeg": {libvips.FORMAT_JEPG, "image/jpeg"},
+	"gif":  {libvips.FORMAT_GIF, "image/gif"},
+	"avif": {libvips.FORMAT_AVIF, "image/avif"},
+	"jxl":  {libvips.FORMAT_JXL, "image/jxl"},
+}
+
+type TransformOptions struct {
+	libvips.Transform
+
+	// output format, one of the keys of transformFormats, or empty to keep the format
+	Format string
+
+	// the canonical query string, used as the cache key
+	key string
+}
+
+type transformResult struct {
+	key         string
+	content     []byte
+	contentType string
+}
+
+type transform struct {
+	mu sync.Mutex
+
+	// least recently used results are at the back
+	lru   *list.List
+	items map[string]*list.Element
+	size  int
+}
+
+var Transform = transform{
+	lru:   list.New(),
+	items: make(map[string]*list.Element),
+}
+
+// whether the query string requests a transformation
+func (*transform) Requested(q url.Values) bool {
+	if q.Has("preset") {
+		return true
+	}
+	for _, k := range transformKeys {
+		if q.Has(k) {
+			return true
+		}
+	}
+	return false
+}
+
+// keep only the transform parameters, sorted by key
+func canonicalTransformQuery(q url.Values) string {
+	v := url.Values{}
+	for _, k := range transformKeys {
+		if q.Has(k) {
+			v.Set(k, q.Get(k))
+		}
+	}
+	return v.Encode()
+}
+
+func transformSignature(fileName string, query string) string {
+	mac := hmac.New(sha256.New, []byte(getJWTSecret()))
+	mac.Write([]byte("transform:" + fileName + "?" + query))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign validates the transform parameters in q, and returns the signed
+// query string
+func (*transform) Sign(fileName string, q url.Values) (string, error) {
+	query := canonicalTransformQuery(q)
+	if query == "" {
+		return "", fmt.Errorf("%w: empty", ErrInvalidTransform)
+	}
+
+	_, err := parseTransformOptions(query)
+	if err != nil {
+		return "", err
+	}
+
+	return query + "&sig=" + transformSignature(fileName, query), nil
+}
+
+// Parse resolves the preset, or verifies the signature of the parameters
+func (*transform) Parse(fileName string, q url.Values) (*TransformOptions, error) {
+	if q.Has("preset") {
+		presets, err := Setting.GetTransformPresets()
+		if err != nil {
+			return nil, err
+		}
+
+		query, ok := presets[q.Get("preset")]
+		if !ok {
+			return nil, ErrTransformNotAllowed
+		}
+
+		return parseTransformOptions(query)
+	}
+
+	query := canonicalTransformQuery(q)
+	if !hmac.Equal([]byte(q.Get("sig")), []byte(transformSignature(fileName, query))) {
+		return nil, ErrTransformNotAllowed
+	}
+
+	return parseTransformOptions(query)
+}
+
+func parseTransformOptions(query string) (*TransformOptions, error) {
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidTransform, err)
+	}
+
+	query = canonicalTransformQuery(q)
+	opts := &TransformOptions{key: query}
+
+	parseSize := func(key string) (int, error) {
+		if !q.Has(key) {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(q.Get(key))
+		if err != nil || n <= 0 || n > transformMaxSize {
+			return 0, fmt.Errorf("%w: %s", ErrInvalidTransform, key)
+		}
+		return n, nil
+	}
+
+	opts.Width, err = parseSize("width")
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Height, err = parseSize("height")
+	if err != nil {
+		return nil, err
+	}
+
+	switch q.Get("fit") {
+	case "", "contain":
+	case "cover":
+		if opts.Width == 0 || opts.Height == 0 {
+			return nil, fmt.Errorf("%w: fit=cover requires width and height", ErrInvalidTransform)
+		}
+		opts.Cover = true
+	default:
+		return nil, fmt.Errorf("%w: fit", ErrInvalidTransform)
+	}
+
+	if q.Has("crop") {
+		parts := strings.Split(q.Get("crop"), ",")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("%w: crop", ErrInvalidTransform)
+		}
+
+		var crop [4]int
+		for i, v := range parts {
+			crop[i], err = strconv.Atoi(v)
+			if err != nil || crop[i] < 0 {
+				return nil, fmt.Errorf("%w: crop", ErrInvalidTransform)
+			}
+		}
+		if crop[2] == 0 || crop[3] == 0 {
+			return nil, fmt.Errorf("%w: crop", ErrInvalidTransform)
+		}
+
+		opts.CropX, opts.CropY, opts.CropWidth, opts.CropHeight = crop[0], crop[1], crop[2], crop[3]
+	}
+
+	switch q.Get("rotate") {
+	case "", "0":
+	case "90", "180", "270":
+		opts.Rotate, _ = strconv.Atoi(q.Get("rotate"))
+	default:
+		return nil, fmt.Errorf("%w: rotate", ErrInvalidTransform)
+	}
+
+	opts.Format = q.Get("format")
+	if opts.Format != "" {
+		if _, ok := transformFormats[opts.Format]; !ok {
+			return nil, fmt.Errorf("%w: format", ErrInvalidTransform)
+		}
+	}
+
+	return opts, nil
+}
+
+// the output format of an image, which is guessed from the file extension
+func defaultTransformFormat(fileName string) string {
+	switch strings.ToLower(path.Ext(fileName)) {
+	case ".webp":
+		return "webp"
+	case ".jpg", ".jpeg":
+		return "jpeg"
+	case ".gif":
+		return "gif"
+	case ".avif":
+		return "avif"
+	case ".jxl":
+		return "jxl"
+	default:
+		return "png"
+	}
+}
+
+// Apply transforms an image, the results are cached in memory
+//
+// return the content, the content type and the entity tag of the result
+func (t *transform) Apply(img *db.Image, opts *TransformOptions) ([]byte, string, string, error) {
+	format := opts.Format
+	if format == "" {
+		format = defaultTransformFormat(img.FileName)
+	}
+
+	// the dimensions are unknown if the metadata is not filled yet, and
+	// are probed after the file is read
+	if img.Width > 0 {
+		err := checkCropArea(opts, img.Width, img.Height)
+		if err != nil {
+			return nil, "", "", err
+		}
+	}
+
+	if opts.Format != "" {
+		enabled, err := Upload.IsEncodingEnabled(opts.Format)
+		if err != nil {
+			return nil, "", "", err
+		}
+		if !enabled {
+			return nil, "", "", fmt.Errorf("%w: %s encoding is disabled", ErrInvalidTransform, opts.Format)
+		}
+	}
+
+	// the version is part of the key, so that results of replaced images are not reused
+	key := strconv.Itoa(img.Id) + "." + strconv.Itoa(img.Version) + "/" + img.FileName + "?" + opts.key + "&output=" + format
+
+	// results of different parameters are told apart by a hash of the parameters
+	h := sha256.Sum256([]byte(opts.key + "&output=" + format))
+	etag := Image.ETag(img, "t"+base64.RawURLEncoding.EncodeToString(h[:9]))
+
+	if r := t.get(key); r != nil {
+		return r.content, r.contentType, etag, nil
+	}
+
+	b, err := readImageFile(img)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	if img.Width == 0 && opts.CropWidth > 0 {
+		info, err := libvips.LibvipsProbe(b)
+		if err != nil {
+			return nil, "", "", fmt.Errorf("transform: %w", err)
+		}
+
+		err = checkCropArea(opts, info.Width, info.Height)
+		if err != nil {
+			return nil, "", "", err
+		}
+	}
+
+	out, err := libvips.LibvipsTransform(b, &opts.Transform, transformFormats[format].vipsFormat)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("transform: %w", err)
+	}
+
+	r := &transformResult{
+		key:         key,
+		content:     out,
+		contentType: transformFormats[format].contentType,
+	}
+	t.put(r)
+
+	return r.content, r.contentType, etag, nil
+}
+
+// the crop area must be inside the image
+func checkCropArea(opts *TransformOptions, width int, height int) error {
+	if opts.CropWidth > 0 && (opts.CropX+opts.CropWidth > width || opts.CropY+opts.CropHeight > height) {
+		return fmt.Errorf("%w: crop area outside of the image", ErrInvalidTransform)
+	}
+	return nil
+}
+
+func (t *transform) get(key string) *transformResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.items[key]
+	if !ok {
+		return nil
+	}
+
+	t.lru.MoveToFront(e)
+	return e.Value.(*transformResult)
+}
+
+func (t *transform) put(r *transformResult) {
+	if len(r.content) > transformCacheSize {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.items[r.key]; ok {
+		// transformed concurrently
+		return
+	}
+
+	t.items[r.key] = t.lru.PushFront(r)
+	t.size += len(r.content)
+
+	for t.size > transformCacheSize {
+		e := t.lru.Back()
+		old := t.lru.Remove(e).(*transformResult)
+		delete(t.items, old.key)
+		t.size -= len(old.content)
+	}
+}
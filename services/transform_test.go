@@ -0,0 +1,173 @@
+package services
+
+import (
+	"errors"
+	"imgu2/libvips"
+	"net/url"
+	"testing"
+)
+
+func TestCanonicalTransformQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"empty", "", ""},
+		{"sorted", "width=100&format=webp&height=50", "format=webp&height=50&width=100"},
+		{"other parameters dropped", "width=100&sig=abc&preset=x&foo=bar", "width=100"},
+		{"first value kept", "width=100&width=200", "width=100"},
+		{"escaped", "crop=0%2C0%2C10%2C10", "crop=0%2C0%2C10%2C10"},
+		{"unescaped", "crop=0,0,10,10", "crop=0%2C0%2C10%2C10"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := canonicalTransformQuery(q)
+			if got != tt.want {
+				t.Errorf("canonicalTransformQuery() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformSign(t *testing.T) {
+	t.Setenv("IMGU2_JWT_SECRET", "test secret")
+
+	signed, err := Transform.Sign("abc.png", url.Values{"width": {"100"}, "format": {"webp"}, "foo": {"bar"}})
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+
+	signedQuery, err := url.ParseQuery(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := signedQuery.Get("sig")
+
+	tests := []struct {
+		name     string
+		fileName string
+		query    string
+		wantErr  error
+	}{
+		{"signed", "abc.png", signed, nil},
+		{"extra parameters", "abc.png", signed + "&foo=baz", nil},
+		{"reordered", "abc.png", "sig=" + sig + "&width=100&format=webp", nil},
+		{"other image", "def.png", signed, ErrTransformNotAllowed},
+		{"changed parameter", "abc.png", signed + "&height=100", ErrTransformNotAllowed},
+		{"unsigned", "abc.png", "width=100&format=webp", ErrTransformNotAllowed},
+		{"wrong signature", "abc.png", "width=100&format=webp&sig=abc", ErrTransformNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			opts, err := Transform.Parse(tt.fileName, q)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Parse() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if err == nil && (opts.Width != 100 || opts.Format != "webp") {
+				t.Errorf("Parse() = %+v", opts)
+			}
+		})
+	}
+}
+
+func TestTransformSignInvalid(t *testing.T) {
+	t.Setenv("IMGU2_JWT_SECRET", "test secret")
+
+	tests := []url.Values{
+		{},
+		{"foo": {"bar"}},
+		{"width": {"0"}},
+		{"width": {"100"}, "format": {"bmp"}},
+	}
+
+	for _, q := range tests {
+		_, err := Transform.Sign("abc.png", q)
+		if !errors.Is(err, ErrInvalidTransform) {
+			t.Errorf("Sign(%v) error = %v, want ErrInvalidTransform", q, err)
+		}
+	}
+}
+
+func TestParseTransformOptions(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    libvips.Transform
+		format  string
+		wantErr bool
+	}{
+		{query: "width=100", want: libvips.Transform{Width: 100}},
+		{query: "width=100&height=50&fit=cover", want: libvips.Transform{Width: 100, Height: 50, Cover: true}},
+		{query: "height=50&fit=contain", want: libvips.Transform{Height: 50}},
+		{query: "crop=1,2,3,4&rotate=90", want: libvips.Transform{CropX: 1, CropY: 2, CropWidth: 3, CropHeight: 4, Rotate: 90}},
+		{query: "rotate=0&format=avif", want: libvips.Transform{}, format: "avif"},
+		{query: "width=4096", want: libvips.Transform{Width: 4096}},
+		{query: "width=4097", wantErr: true},
+		{query: "width=-1", wantErr: true},
+		{query: "width=abc", wantErr: true},
+		{query: "width=100&fit=cover", wantErr: true},
+		{query: "fit=fill", wantErr: true},
+		{query: "crop=1,2,3", wantErr: true},
+		{query: "crop=1,2,0,4", wantErr: true},
+		{query: "crop=-1,2,3,4", wantErr: true},
+		{query: "rotate=45", wantErr: true},
+		{query: "format=bmp", wantErr: true},
+		{query: "width=%zz", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			opts, err := parseTransformOptions(tt.query)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidTransform) {
+					t.Errorf("parseTransformOptions() error = %v, want ErrInvalidTransform", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("parseTransformOptions() error = %v", err)
+			}
+
+			if opts.Transform != tt.want || opts.Format != tt.format {
+				t.Errorf("parseTransformOptions() = %+v, want %+v and format %q", opts, tt.want, tt.format)
+			}
+		})
+	}
+}
+
+func TestCheckCropArea(t *testing.T) {
+	tests := []struct {
+		name    string
+		crop    libvips.Transform
+		wantErr bool
+	}{
+		{"no crop", libvips.Transform{}, false},
+		{"whole image", libvips.Transform{CropWidth: 640, CropHeight: 480}, false},
+		{"inside", libvips.Transform{CropX: 10, CropY: 20, CropWidth: 100, CropHeight: 100}, false},
+		{"too wide", libvips.Transform{CropX: 600, CropWidth: 41, CropHeight: 10}, true},
+		{"too tall", libvips.Transform{CropY: 480, CropWidth: 10, CropHeight: 1}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkCropArea(&TransformOptions{Transform: tt.crop}, 640, 480)
+			if tt.wantErr != errors.Is(err, ErrInvalidTransform) || (!tt.wantErr && err != nil) {
+				t.Errorf("checkCropArea() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
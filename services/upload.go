@@ -2,88 +2,619 @@ package services
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"imgu2/db"
 	"imgu2/libvips"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
 )
 
 type upload struct{}
 
+// the target format which chooses the smallest encoding, see chooseAutoFormat
+const AUTO_FORMAT = "auto"
+
 var Upload = upload{}
 
-// UploadImage re-encodes the image and save it to a random choosen storage driver
-//
-// userId may be set to nil to represent a guest user
-//
-// expire may be nil
-//
-// fileSizeLimit is the maximium file size in bytes after encoding
+var (
+	ErrStorageQuotaExceeded    = errors.New("upload: storage quota exceeded")
+	ErrImageDimensionsTooLarge = errors.New("upload: image dimensions too large")
+	ErrEncodedFileTooLarge     = errors.New("upload: encoded image too large")
+	ErrInputTypeNotAllowed     = errors.New("upload: input type not allowed")
+	ErrImageBlocked            = errors.New("upload: image is similar to a blocked image")
+)
+
+// metadata policies of user groups
+const (
+	METADATA_STRIP    = "strip" // strip all metadata
+	METADATA_KEEP_ICC = "icc"   // keep only the icc profile
+	METADATA_KEEP     = "keep"  // keep all metadata
+)
+
+var metadataPolicies = map[string]libvips.Metadata{
+	METADATA_STRIP:    libvips.METADATA_STRIP,
+	METADATA_KEEP_ICC: libvips.METADATA_KEEP_ICC,
+	METADATA_KEEP:     libvips.METADATA_KEEP,
+}
+
+// DimensionLimit limits the dimensions of uploaded images, zero means no limit
+type DimensionLimit struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int // width * height of a frame
+
+	// downscale images exceeding the limits instead of rejecting them
+	Downscale bool
+}
+
+// limits of animated images which apply to all user groups, since all
+// frames are decoded into a single tall image
+const (
+	maxAnimationFrames = 1000
+	maxAnimationPixels = 100_000_000 // width * height * frames
+)
+
+// the dimension limits of a user group
+func GroupDimensionLimit(g *db.Group) DimensionLimit {
+	return DimensionLimit{
+		MaxWidth:  g.MaxWidth,
+		MaxHeight: g.MaxHeight,
+		MaxPixels: g.MaxPixels,
+		Downscale: g.DownscaleOversized,
+	}
+}
+
+// fit returns the size of the frames of an image downscaled to the limits,
+// and whether the image exceeds the limits. All frames together must also
+// be smaller than maxAnimationPixels.
+func (l *DimensionLimit) fit(width int, height int, frames int) (int, int, bool) {
+	scale := 1.0
+
+	if frames > 1 && width*height*frames > maxAnimationPixels {
+		scale = math.Sqrt(float64(maxAnimationPixels) / float64(width*height*frames))
+	}
+
+	if l.MaxWidth > 0 && width > l.MaxWidth {
+		scale = min(scale, float64(l.MaxWidth)/float64(width))
+	}
+	if l.MaxHeight > 0 && height > l.MaxHeight {
+		scale = min(scale, float64(l.MaxHeight)/float64(height))
+	}
+	if l.MaxPixels > 0 && width*height > l.MaxPixels {
+		scale = min(scale, math.Sqrt(float64(l.MaxPixels)/float64(width*height)))
+	}
+
+	if scale == 1 {
+		return width, height, false
+	}
+
+	return max(1, int(float64(width)*scale)), max(1, int(float64(height)*scale)), true
+}
+
+// whether images can be encoded to the format, which is one of webp, png,
+// jpeg, gif, avif and jxl
 //
-// return a random generated file name
-func (*upload) UploadImage(userId sql.NullInt32, file []byte, expire sql.NullTime, ipAddr string, targetFormat string, fileSizeLimit int, lossless bool, Q int, effort int, contentType string) (string, error) {
-	// re-encode image
-	var fileExtension string
-
-	// detect whether the source image is animated
-	animated := false
-	switch contentType {
-	case "image/gif":
-		animated = true
-	case "image/webp":
-		animated = true
-	case "application/pdf":
-		animated = true
+// optional formats must be enabled in the settings, and all formats must be
+// supported by the linked libvips
+func (*upload) IsEncodingEnabled(format string) (bool, error) {
+	f, ok := transformFormats[format]
+	if !ok || !libvips.LibvipsCanEncode(f.vipsFormat) {
+		return false, nil
 	}
 
-	var vipsForamt libvips.Format
+	switch format {
+	case "webp":
+		return Setting.IsWEBPEncodingEnabled()
+	case "avif":
+		return Setting.IsAVIFEncodingEnabled()
+	case "jxl":
+		return Setting.IsJXLEncodingEnabled()
+	}
+
+	return true, nil
+}
 
-	switch targetFormat {
+// the formats which images can be encoded to, see IsEncodingEnabled
+func (u *upload) EnabledEncodings() (map[string]bool, error) {
+	m := make(map[string]bool)
+
+	for format := range transformFormats {
+		enabled, err := u.IsEncodingEnabled(format)
+		if err != nil {
+			return nil, err
+		}
+		m[format] = enabled
+	}
+
+	return m, nil
+}
+
+// the mime types of uploaded files which are allowed in the settings, and
+// can be decoded by the linked libvips
+func (*upload) InputTypes() ([]string, error) {
+	allowed, err := Setting.GetAllowedInputTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	types := make([]string, 0)
+	for _, t := range libvips.LibvipsInputTypes() {
+		if allowed[t] {
+			types = append(types, t)
+		}
+	}
+
+	return types, nil
+}
+
+// the file extension and the libvips format of a target mime type
+func targetEncoding(mimeType string) (string, libvips.Format, bool) {
+	switch mimeType {
 	case "image/png":
-		fileExtension = ".png"
-		vipsForamt = libvips.FORMAT_PNG
+		return ".png", libvips.FORMAT_PNG, true
 	case "image/jpeg":
-		fileExtension = ".jpg"
-		vipsForamt = libvips.FORMAT_JEPG
+		return ".jpg", libvips.FORMAT_JEPG, true
 	case "image/gif":
-		fileExtension = ".gif"
-		vipsForamt = libvips.FORMAT_GIF
+		return ".gif", libvips.FORMAT_GIF, true
 	case "image/webp":
-		fileExtension = ".webp"
-		vipsForamt = libvips.FORMAT_WEBP
+		return ".webp", libvips.FORMAT_WEBP, true
 	case "image/avif":
-		fileExtension = ".avif"
-		vipsForamt = libvips.FORMAT_AVIF
+		return ".avif", libvips.FORMAT_AVIF, true
+	case "image/jxl":
+		return ".jxl", libvips.FORMAT_JXL, true
 	default:
-		return "", fmt.Errorf("upload: unknown format: %s", targetFormat)
+		return "", 0, false
 	}
+}
+
+// UploadOptions are the options of UploadImage
+type UploadOptions struct {
+	UserId sql.NullInt32 // the uploader, or null for guest users
+	IPAddr string
+	Expire sql.NullTime // may be null
+
+	// TargetFormat is the mime type of the encoded image, or AUTO_FORMAT to
+	// choose the smallest of the enabled formats
+	TargetFormat string
+
+	// FileSizeLimit is the maximium file size in bytes after encoding
+	FileSizeLimit int
+
+	// StorageLimit is the maximum total size in bytes of images stored by
+	// the uploader, or zero if there is no limit
+	StorageLimit int
+
+	DimensionLimit DimensionLimit
+
+	// MetadataPolicy is one of the METADATA_* policies, which decides the
+	// metadata kept in the encoded image
+	MetadataPolicy string
+
+	// Watermark is whether the watermark in the settings is drawn on the image
+	Watermark bool
+
+	Lossless bool
+	Q        int
+	Effort   int
+
+	// Ops are applied to the image before it is checked and encoded, see
+	// Edit.ParseOperations
+	Ops []libvips.EditOperation
+
+	// ContentType and OriginalName are the content type and the name of
+	// the uploaded file, which may be empty
+	ContentType  string
+	OriginalName string
 
-	encodedImage := libvips.LibvipsEncode(file, vipsForamt, animated, lossless, Q, effort)
-	if encodedImage == nil {
-		return "", fmt.Errorf("upload: malformatted image")
+	// SourceURL is the url which the file is fetched from, or empty if the
+	// file is uploaded directly
+	SourceURL string
+}
+
+// UploadImage re-encodes the image and save it to a random choosen storage driver
+//
+// ErrStorageQuotaExceeded is returned if the encoded image exceeds
+// opts.StorageLimit.
+//
+// The type of the image is detected from its content, and must be one of
+// the allowed input types in the settings, or ErrInputTypeNotAllowed is
+// returned.
+//
+// The dimensions of the image are checked before it is decoded, so images
+// which are small files but huge bitmaps are rejected early. Images exceeding
+// opts.DimensionLimit are downscaled if opts.DimensionLimit.Downscale is
+// true, or ErrImageDimensionsTooLarge is returned. Animated images with more
+// than maxAnimationFrames frames are always rejected.
+//
+// ErrImageBlocked is returned if the perceptual hash of the image is close
+// to a blocked hash, see PerceptualHash.IsBlocked
+//
+// The image is always auto-rotated and converted to sRGB.
+//
+// Since the image is decoded at full size to be edited, the image and every
+// intermediate result of opts.Ops must fit inside opts.DimensionLimit
+// without downscaling.
+//
+// return a random generated file name, the secret token in the deletion
+// link which can not be recovered later, and the mime type of the image
+func (*upload) UploadImage(file []byte, opts *UploadOptions) (string, string, string, error) {
+	encoded, err := encodeUpload(file, opts)
+	if err != nil {
+		return "", "", "", err
 	}
 
-	if len(encodedImage) > fileSizeLimit {
-		return "", fmt.Errorf("upload: image too large")
+	if opts.StorageLimit > 0 {
+		used, err := Upload.StorageUsage(opts.UserId, opts.IPAddr)
+		if err != nil {
+			return "", "", "", err
+		}
+
+		if used+len(encoded.image) > opts.StorageLimit {
+			return "", "", "", ErrStorageQuotaExceeded
+		}
 	}
 
-	fileName := RandomString(8) + fileExtension
+	meta, err := describeImage(encoded.image, encoded.mimeType)
+	if err != nil {
+		return "", "", "", fmt.Errorf("upload: %w", err)
+	}
+
+	meta.OriginalName = truncateString(opts.OriginalName[strings.LastIndexAny(opts.OriginalName, `/\`)+1:], 255)
+	meta.SourceContentType = truncateString(opts.ContentType, 255)
+	meta.PHash = sql.NullInt64{Valid: true, Int64: encoded.phash}
 
-	// upload file
-	var err error
-	var id int
+	fileExtension, _, _ := targetEncoding(encoded.mimeType)
+	fileName := RandomString(8) + fileExtension
 
-	// internal name is the file name used in storage drivers
-	internalName, id, err := Storage.Put(fileName, encodedImage, expire)
+	// upload file, identical files are stored only once
+	c, err := Content.Put(fileName, encoded.image)
 	if err != nil {
-		return "", fmt.Errorf("upload: %w", err)
+		return "", "", "", fmt.Errorf("upload: %w", err)
 	}
 
 	// insert to database
-	_, err = db.ImageCreate(id, userId, fileName, internalName, ipAddr, expire)
+	deleteToken := RandomHexString(16)
+
+	imageId, err := db.ImageCreate(c.StorageId, opts.UserId, fileName, c.InternalName, opts.IPAddr, opts.Expire, opts.SourceURL, c.Id, hashDeleteToken(deleteToken), meta)
+	if err != nil {
+		unrefErr := Content.Unref(c)
+		if unrefErr != nil {
+			slog.Error("upload: unref content", "err", unrefErr, "content", c.Id)
+		}
+		return "", "", "", err
+	}
+
+	// the image is usable without a thumbnail, which is generated again by the backfill task
+	err = Thumbnail.Generate(imageId, fileName, encoded.image)
+	if err != nil {
+		slog.Error("upload: generate thumbnail", "err", err, "file name", fileName)
+	}
+
+	err = Variant.Create(imageId, fileName, encoded.mimeType, len(encoded.image), meta.Frames, encoded.encode)
+	if err != nil {
+		slog.Error("upload: create variants", "err", err, "file name", fileName)
+	}
+
+	return fileName, deleteToken, encoded.mimeType, nil
+
+}
+
+// UploadVersion re-encodes a file like UploadImage, and replaces the stored
+// file of an image with it under the same file name, see Image.Replace.
+//
+// The file is encoded to the format of the image, since the extension of
+// the file name is kept, so opts.TargetFormat is ignored. The uploader,
+// the expire time and the description of the uploaded file in opts are
+// ignored as well, and the previous version still counts towards
+// opts.StorageLimit if it is kept.
+func (*upload) UploadVersion(i *db.Image, file []byte, opts *UploadOptions) error {
+	versionOpts := *opts
+	versionOpts.TargetFormat = Image.MimeType(i)
+
+	encoded, err := encodeUpload(file, &versionOpts)
+	if err != nil {
+		return err
+	}
+
+	if opts.StorageLimit > 0 {
+		used, err := Upload.StorageUsage(i.Uploader, i.UploaderIP)
+		if err != nil {
+			return err
+		}
+
+		if used+len(encoded.image) > opts.StorageLimit {
+			return ErrStorageQuotaExceeded
+		}
+	}
+
+	return Image.Replace(i, encoded.image, encoded.mimeType, encoded.phash, encoded.encode)
+}
+
+// encodedUpload is an uploaded file which is checked and encoded
+type encodedUpload struct {
+	image    []byte
+	mimeType string
+	phash    int64 // the perceptual hash of the uploaded file
+
+	// encode encodes the uploaded file to another format with the same options
+	encode func(libvips.Format) ([]byte, error)
+}
+
+// encodeUpload checks an uploaded file, applies opts.Ops and encodes it to
+// opts.TargetFormat, see UploadImage for the options and the errors
+func encodeUpload(file []byte, opts *UploadOptions) (*encodedUpload, error) {
+	targetFormat := opts.TargetFormat
+	_, vipsForamt, ok := targetEncoding(targetFormat)
+	if !ok && targetFormat != AUTO_FORMAT {
+		return nil, fmt.Errorf("upload: unknown format: %s", targetFormat)
+	}
+
+	// only the header is read
+	srcInfo, err := libvips.LibvipsProbe(file)
+	if err != nil {
+		return nil, fmt.Errorf("upload: %w", err)
+	}
+
+	// the type sent by the client is not trusted
+	allowed, err := Setting.GetAllowedInputTypes()
+	if err != nil {
+		return nil, err
+	}
+	if !allowed[srcInfo.Type] {
+		return nil, fmt.Errorf("%w: %s", ErrInputTypeNotAllowed, srcInfo.Type)
+	}
+
+	// the edited image is encoded losslessly, and then encoded like uploaded images
+	if len(opts.Ops) > 0 {
+		// the limits are checked again on the edited image below
+		err = checkEditSize(&opts.DimensionLimit, srcInfo.Width, srcInfo.Height, srcInfo.Frames, opts.Ops)
+		if err != nil {
+			return nil, err
+		}
+
+		intermediate := libvips.FORMAT_PNG
+		if srcInfo.Frames > 1 {
+			intermediate = libvips.FORMAT_WEBP
+		}
+
+		file, err = libvips.LibvipsEdit(file, opts.Ops, intermediate, srcInfo.Frames > 1, true, -1, 10)
+		if err != nil {
+			return nil, fmt.Errorf("upload: edit: %w", err)
+		}
+
+		srcInfo, err = libvips.LibvipsProbe(file)
+		if err != nil {
+			return nil, fmt.Errorf("upload: probe edited image: %w", err)
+		}
+	}
+
+	// all frames are loaded if the image is animated, only the first page of
+	// documents is kept, see libvips.LibvipsProbe
+	animated := srcInfo.Frames > 1
+
+	if srcInfo.Frames > maxAnimationFrames {
+		return nil, ErrImageDimensionsTooLarge
+	}
+
+	// zero keeps the size
+	width, height, oversized := opts.DimensionLimit.fit(srcInfo.Width, srcInfo.Height, srcInfo.Frames)
+	if !oversized {
+		width, height = 0, 0
+	} else if !opts.DimensionLimit.Downscale {
+		return nil, ErrImageDimensionsTooLarge
+	}
+
+	// the uploaded file is hashed, so that watermarks do not change the hash
+	phash, err := PerceptualHash.Compute(file)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("upload: %w", err)
 	}
 
-	return fileName, nil
+	blocked, err := PerceptualHash.IsBlocked(phash)
+	if err != nil {
+		return nil, err
+	}
+	if blocked {
+		return nil, ErrImageBlocked
+	}
 
+	metadata, ok := metadataPolicies[opts.MetadataPolicy]
+	if !ok {
+		return nil, fmt.Errorf("upload: unknown metadata policy: %s", opts.MetadataPolicy)
+	}
+
+	var wm *libvips.Watermark
+	if opts.Watermark {
+		var err error
+		wm, err = Setting.GetWatermark()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	encode := func(format libvips.Format) ([]byte, error) {
+		return libvips.LibvipsEncode(file, format, animated, opts.Lossless, opts.Q, opts.Effort, width, height, metadata, wm)
+	}
+
+	var encodedImage []byte
+	if targetFormat == AUTO_FORMAT {
+		format, b, err := chooseAutoFormat(file, srcInfo, opts.Lossless, encode)
+		if err != nil {
+			return nil, fmt.Errorf("upload: encode: %w", err)
+		}
+
+		targetFormat = transformFormats[format].contentType
+		encodedImage = b
+	} else {
+		var err error
+		encodedImage, err = encode(vipsForamt)
+		if err != nil {
+			return nil, fmt.Errorf("upload: encode: %w", err)
+		}
+	}
+
+	if len(encodedImage) > opts.FileSizeLimit {
+		return nil, ErrEncodedFileTooLarge
+	}
+
+	return &encodedUpload{
+		image:    encodedImage,
+		mimeType: targetFormat,
+		phash:    phash,
+		encode:   encode,
+	}, nil
+}
+
+// describeImage probes an encoded image, and computes its BlurHash. The
+// original name, the source content type and the perceptual hash are not
+// filled in.
+func describeImage(b []byte, mimeType string) (db.ImageMetadata, error) {
+	info, err := libvips.LibvipsProbe(b)
+	if err != nil {
+		return db.ImageMetadata{}, fmt.Errorf("probe encoded image: %w", err)
+	}
+
+	// the image is usable without a BlurHash, which is computed again by the backfill task
+	blurHash, dominantColor, err := BlurHash.Compute(b)
+	if err != nil {
+		slog.Error("compute blurhash", "err", err)
+	}
+
+	return db.ImageMetadata{
+		Width:         info.Width,
+		Height:        info.Height,
+		Frames:        info.Frames,
+		Size:          len(b),
+		MimeType:      mimeType,
+		BlurHash:      blurHash,
+		DominantColor: dominantColor,
+	}, nil
+}
+
+// StorageUsage returns the total size in bytes of unexpired images stored
+// by the uploader
+//
+// userId may be set to nil to represent a guest user, in which case
+// guest uploads are counted by ipAddr
+func (*upload) StorageUsage(userId sql.NullInt32, ipAddr string) (int, error) {
+	return db.ImageSumSize(userId, ipAddr)
+}
+
+// CheckRateLimit checks whether the uploader has exceeded the upload limits
+// of the user group. Zero means there is no limit. Uploads are counted even
+// if the images are deleted.
+//
+// userId may be set to nil to represent a guest user, in which case
+// guest uploads are counted by ipAddr
+//
+// reset is the time when the uploader is allowed to upload again.
+// reset is zero if the total upload limit is exceeded, which never resets.
+func (*upload) CheckRateLimit(userId sql.NullInt32, group *db.Group, ipAddr string) (limited bool, reset time.Time, err error) {
+	// total uploads
+	if group.TotalUpload > 0 {
+		cnt, err := db.UploadLogCountSince(userId, ipAddr, time.Unix(0, 0))
+		if err != nil {
+			return false, time.Time{}, err
+		}
+
+		if cnt >= group.TotalUpload {
+			return true, time.Time{}, nil
+		}
+	}
+
+	windows := []struct {
+		limit    int
+		duration time.Duration
+	}{
+		{group.UploadPerMinute, time.Minute},
+		{group.UploadPerHour, time.Hour},
+		{group.UploadPerDay, time.Hour * 24},
+		{group.UploadPerMonth, time.Hour * 24 * 30},
+	}
+
+	now := time.Now()
+
+	for _, w := range windows {
+		if w.limit <= 0 {
+			continue
+		}
+
+		since := now.Add(-w.duration)
+
+		cnt, err := db.UploadLogCountSince(userId, ipAddr, since)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+
+		if cnt < w.limit {
+			continue
+		}
+
+		// the quota is available again when enough uploads in the window
+		// are older than the window duration
+		t, err := db.UploadLogFindTimeSince(userId, ipAddr, since, cnt-w.limit)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+
+		// report the latest reset time if more than one limit is exceeded
+		if t.Add(w.duration).After(reset) {
+			reset = t.Add(w.duration)
+		}
+		limited = true
+	}
+
+	return limited, reset, nil
+}
+
+// rateLimitMutex serializes checking the rate limits and recording uploads,
+// so concurrent uploads can not exceed the limits
+var rateLimitMutex sync.Mutex
+
+// ReserveUpload checks the rate limits like CheckRateLimit, and records an
+// upload if they are not exceeded
+//
+// cancel removes the record, and must be called if the upload fails. It is
+// nil if the uploader is limited.
+func (u *upload) ReserveUpload(userId sql.NullInt32, group *db.Group, ipAddr string) (limited bool, reset time.Time, cancel func(), err error) {
+	limited, reset, id, err := u.reserve(userId, group, ipAddr)
+	if err != nil || limited {
+		return limited, reset, nil, err
+	}
+
+	cancel = func() {
+		cancelReservation(id)
+	}
+
+	return false, time.Time{}, cancel, nil
+}
+
+// ReserveUpload without cancel, return the id of the record in upload_log
+func (u *upload) reserve(userId sql.NullInt32, group *db.Group, ipAddr string) (limited bool, reset time.Time, id int, err error) {
+	rateLimitMutex.Lock()
+	defer rateLimitMutex.Unlock()
+
+	limited, reset, err = u.CheckRateLimit(userId, group, ipAddr)
+	if err != nil || limited {
+		return limited, reset, 0, err
+	}
+
+	id, err = db.UploadLogCreate(userId, ipAddr)
+	if err != nil {
+		return false, time.Time{}, 0, err
+	}
+
+	return false, time.Time{}, id, nil
+}
+
+// remove the record of a failed upload from upload_log
+func cancelReservation(id int) {
+	err := db.UploadLogDelete(id)
+	if err != nil {
+		slog.Error("upload: cancel reservation", "err", err, "id", id)
+	}
 }
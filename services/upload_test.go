@@ -0,0 +1,145 @@
+package services
+
+import (
+	"database/sql"
+	"imgu2/db"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDimensionLimitFit(t *testing.T) {
+	tests := []struct {
+		name          string
+		limit         DimensionLimit
+		width         int
+		height        int
+		frames        int
+		wantWidth     int
+		wantHeight    int
+		wantOversized bool
+	}{
+		{"no limit", DimensionLimit{}, 10000, 8000, 1, 10000, 8000, false},
+		{"within limits", DimensionLimit{MaxWidth: 1000, MaxHeight: 1000, MaxPixels: 1000000}, 1000, 1000, 1, 1000, 1000, false},
+		{"too wide", DimensionLimit{MaxWidth: 1000}, 2000, 500, 1, 1000, 250, true},
+		{"too tall", DimensionLimit{MaxHeight: 1000}, 300, 3000, 1, 100, 1000, true},
+		{"width and height", DimensionLimit{MaxWidth: 1000, MaxHeight: 1000}, 2000, 4000, 1, 500, 1000, true},
+		{"too many pixels", DimensionLimit{MaxPixels: 10000}, 400, 100, 1, 200, 50, true},
+		{"at least one pixel", DimensionLimit{MaxWidth: 100}, 100000, 10, 1, 100, 1, true},
+		{"small animation", DimensionLimit{}, 100, 100, 100, 100, 100, false},
+		{
+			// all frames together are limited to maxAnimationPixels
+			name:  "large animation",
+			limit: DimensionLimit{},
+			width: 4000, height: 2500, frames: 40,
+			wantWidth: 2000, wantHeight: 1250, wantOversized: true,
+		},
+		{
+			// a single frame is not limited by maxAnimationPixels
+			name:  "large still image",
+			limit: DimensionLimit{},
+			width: 20000, height: 10000, frames: 1,
+			wantWidth: 20000, wantHeight: 10000, wantOversized: false,
+		},
+		{
+			name:  "smallest scale wins",
+			limit: DimensionLimit{MaxWidth: 1000},
+			width: 4000, height: 2500, frames: 40,
+			wantWidth: 1000, wantHeight: 625, wantOversized: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, h, oversized := tt.limit.fit(tt.width, tt.height, tt.frames)
+			if w != tt.wantWidth || h != tt.wantHeight || oversized != tt.wantOversized {
+				t.Errorf("fit() = %d, %d, %v, want %d, %d, %v", w, h, oversized, tt.wantWidth, tt.wantHeight, tt.wantOversized)
+			}
+		})
+	}
+}
+
+func TestReserveUpload(t *testing.T) {
+	initTestDB(t)
+
+	group := &db.Group{UploadPerHour: 2}
+	guest := sql.NullInt32{}
+
+	reserve := func() (bool, func()) {
+		t.Helper()
+		limited, reset, cancel, err := Upload.ReserveUpload(guest, group, "127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limited != (cancel == nil) || limited == reset.IsZero() {
+			t.Fatalf("ReserveUpload() = %v, %v, %v", limited, reset, cancel != nil)
+		}
+		return limited, cancel
+	}
+
+	_, cancel := reserve()
+	reserve()
+
+	if limited, _ := reserve(); !limited {
+		t.Fatal("ReserveUpload() over the limit is not limited")
+	}
+
+	// a cancelled upload does not count
+	cancel()
+
+	if limited, _ := reserve(); limited {
+		t.Fatal("ReserveUpload() after cancel() is limited")
+	}
+
+	// other uploaders are not affected
+	limited, _, _, err := Upload.ReserveUpload(guest, group, "127.0.0.2")
+	if err != nil || limited {
+		t.Fatalf("ReserveUpload() by another uploader = %v, %v", limited, err)
+	}
+}
+
+func TestReserveUploadConcurrent(t *testing.T) {
+	initTestDB(t)
+
+	const limit = 5
+	group := &db.Group{UploadPerMinute: limit}
+	guest := sql.NullInt32{}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reserved := 0
+
+	// all goroutines start reserving at the same time
+	start := make(chan struct{})
+
+	for i := 0; i < limit*4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+
+			limited, _, _, err := Upload.ReserveUpload(guest, group, "127.0.0.1")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if !limited {
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if reserved != limit {
+		t.Errorf("%d concurrent uploads reserved, want %d", reserved, limit)
+	}
+
+	cnt, err := db.UploadLogCountSince(guest, "127.0.0.1", time.Unix(0, 0))
+	if err != nil || cnt != limit {
+		t.Errorf("UploadLogCountSince() = %d, %v, want %d", cnt, err, limit)
+	}
+}
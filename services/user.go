@@ -441,3 +441,32 @@ func (*user) ChangeGroup(id int, group int) error {
 func (*user) ChangeGroupExpire(id int, expire int) error {
 	return db.UserChangeGroupExpire(id, expire)
 }
+
+// generate a new upload key for screenshot tools, which replaces the previous one
+func (*user) GenerateUploadKey(id int) (string, error) {
+	key := RandomHexString(20)
+
+	err := db.UserChangeUploadKey(id, key)
+	if err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+func (*user) RevokeUploadKey(id int) error {
+	return db.UserChangeUploadKey(id, "")
+}
+
+// return an empty string if the upload key is not generated
+func (*user) GetUploadKey(id int) (string, error) {
+	return db.UserFindUploadKey(id)
+}
+
+// return nil if the upload key is invalid
+func (*user) FindByUploadKey(key string) (*db.User, error) {
+	if key == "" {
+		return nil, nil
+	}
+	return db.UserFindByUploadKey(key)
+}
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"imgu2/db"
+	"imgu2/libvips"
+	"log/slog"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// formats which are stored as variants of uploaded images
+var variantFormats = []struct {
+	format     string
+	mimeType   string
+	extension  string
+	vipsFormat libvips.Format
+}{
+	{"avif", "image/avif", ".avif", libvips.FORMAT_AVIF},
+	{"webp", "image/webp", ".webp", libvips.FORMAT_WEBP},
+}
+
+type variant struct{}
+
+var Variant = variant{}
+
+// Create encodes and stores the AVIF and WebP variants of a new image if
+// they are enabled. Variants which are not smaller than the image are
+// discarded, since they would not save any bandwidth.
+//
+// mimeType, size and frames are the type, the size and the number of frames
+// of the encoded image, and encode encodes the uploaded file with the same
+// options as the image
+//
+// AVIF variants of animated images are not stored, since heifsave only
+// writes the first frame.
+func (*variant) Create(imageId int, fileName string, mimeType string, size int, frames int, encode func(libvips.Format) ([]byte, error)) error {
+	enabled, err := Setting.IsStoreVariantsEnabled()
+	if err != nil || !enabled {
+		return err
+	}
+
+	for _, f := range variantFormats {
+		if f.mimeType == mimeType || (frames > 1 && f.format == "avif") {
+			continue
+		}
+
+		enabled, err := Upload.IsEncodingEnabled(f.format)
+		if err != nil {
+			return err
+		}
+		if !enabled {
+			continue
+		}
+
+		b, err := encode(f.vipsFormat)
+		if err != nil {
+			slog.Error("variant: encode", "file name", fileName, "mime type", f.mimeType, "err", err)
+			continue
+		}
+
+		if len(b) >= size {
+			slog.Debug("variant: discard larger variant", "file name", fileName, "mime type", f.mimeType, "size", len(b))
+			continue
+		}
+
+		c, err := Content.Put(strings.TrimSuffix(fileName, path.Ext(fileName))+f.extension, b)
+		if err != nil {
+			return err
+		}
+
+		err = db.ImageVariantCreate(imageId, f.mimeType, c.Id, len(b))
+		if err != nil {
+			unrefErr := Content.Unref(c)
+			if unrefErr != nil {
+				slog.Error("variant: unref content", "err", unrefErr, "content", c.Id)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// delete all variants of an image
+func (*variant) DeleteAll(imageId int) error {
+	variants, err := db.ImageVariantFindByImage(imageId)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range variants {
+		err = Content.Unref(&db.Content{Id: v.ContentId})
+		if err != nil {
+			return err
+		}
+
+		err = db.ImageVariantDelete(v.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Negotiate chooses the smallest variant of an image whose type is in the
+// Accept header
+//
+// Wildcards are not taken into account, since clients sending "*/*" do not
+// necessarily support newer formats.
+//
+// return nil if the image should be served as it is, and whether the image
+// has any variants
+func (*variant) Negotiate(imageId int, accept string) (*db.ImageVariant, bool, error) {
+	variants, err := db.ImageVariantFindByImage(imageId)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(variants) == 0 {
+		return nil, false, nil
+	}
+
+	accepted := acceptedTypes(accept)
+
+	// variants are ordered by size
+	for _, v := range variants {
+		if accepted[v.MimeType] {
+			return &v, true, nil
+		}
+	}
+
+	return nil, true, nil
+}
+
+// the media types in an Accept header with a non-zero quality
+func acceptedTypes(accept string) map[string]bool {
+	m := make(map[string]bool)
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+
+		if q, ok := params["q"]; ok {
+			f, err := strconv.ParseFloat(q, 64)
+			if err != nil || f <= 0 {
+				continue
+			}
+		}
+
+		m[mediaType] = true
+	}
+
+	return m
+}
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"imgu2/db"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// initialize an empty database in a temporary directory
+func initTestDB(t *testing.T) {
+	t.Helper()
+	db.Init(filepath.Join(t.TempDir(), "db.sqlite"))
+}
+
+func TestAcceptedTypes(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		want   map[string]bool
+	}{
+		{"empty", "", map[string]bool{}},
+		{"single", "image/webp", map[string]bool{"image/webp": true}},
+		{
+			name:   "browser",
+			accept: "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8",
+			want: map[string]bool{
+				"image/avif": true, "image/webp": true, "image/apng": true,
+				"image/svg+xml": true, "image/*": true, "*/*": true,
+			},
+		},
+		{"spaces and case", " Image/WebP ; q=0.5 , image/avif", map[string]bool{"image/webp": true, "image/avif": true}},
+		{"q=0 rejects", "image/avif;q=0, image/webp;q=0.0", map[string]bool{}},
+		{"q=0.001 accepts", "image/avif;q=0.001", map[string]bool{"image/avif": true}},
+		{"invalid q", "image/avif;q=abc, image/webp;q=1", map[string]bool{"image/webp": true}},
+		{"invalid media type", "image/avif;;, /webp, image/png", map[string]bool{"image/png": true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := acceptedTypes(tt.accept)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("acceptedTypes(%q) = %v, want %v", tt.accept, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVariantNegotiate(t *testing.T) {
+	initTestDB(t)
+
+	// the AVIF variant is smaller than the WebP variant
+	for _, v := range []struct {
+		mimeType string
+		size     int
+	}{{"image/webp", 200}, {"image/avif", 100}} {
+		contentId, err := db.ContentCreate(v.mimeType, 1, v.mimeType, v.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.ImageVariantCreate(1, v.mimeType, contentId, v.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		imageId     int
+		accept      string
+		want        string // the mime type of the variant, or empty
+		hasVariants bool
+	}{
+		{"smallest", 1, "image/avif,image/webp,*/*;q=0.8", "image/avif", true},
+		{"avif rejected", 1, "image/avif;q=0,image/webp", "image/webp", true},
+		{"wildcards ignored", 1, "image/*,*/*", "", true},
+		{"no accept header", 1, "", "", true},
+		{"no variants", 2, "image/avif,image/webp", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, hasVariants, err := Variant.Negotiate(tt.imageId, tt.accept)
+			if err != nil {
+				t.Fatalf("Negotiate() error = %v", err)
+			}
+
+			got := ""
+			if v != nil {
+				got = v.MimeType
+			}
+
+			if got != tt.want || hasVariants != tt.hasVariants {
+				t.Errorf("Negotiate() = %q, %v, want %q, %v", got, hasVariants, tt.want, tt.hasVariants)
+			}
+		})
+	}
+}